@@ -48,7 +48,7 @@ func main() {
 	bot.AddTimer(60 * time.Second)
 	bot.Handle(`/timer/60s`, func(arg2 wechat.Event) {
 		data := arg2.Data.(wechat.EventTimerData)
-		if bot.IsLogin {
+		if bot.LoggedIn() {
 			bot.SendTextMsg(fmt.Sprintf(`第%v次`, data.Count), `filehelper`)
 		}
 	})
@@ -0,0 +1,385 @@
+package wechat
+
+import (
+	"errors"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotArchived is returned by ArchiveStore.Get when msg is not archived.
+var ErrNotArchived = errors.New(`message not archived`)
+
+// msgTypeRevoke is the MsgType of `"xx" 撤回了一条消息`, msgTypeStatusNotify is
+// sent when chats are opened on phone, it is not a message.
+const (
+	msgTypeRevoke       = 10002
+	msgTypeStatusNotify = 51
+)
+
+var revokedMsgIDReg = regexp.MustCompile(`<msgid>(\d+)</msgid>`)
+
+// ArchivedMessage is an inbound or outbound message in archive.
+// Conversation and Sender are ContactID, so they are the same after re-login,
+// UserName of them are the ones when message is archived. A group member not
+// identified yet is kept by the ID assigned to it, which it gets again when
+// matched in next session, see ArchiveID.
+type ArchivedMessage struct {
+	MsgID      string
+	LocalID    string // outbound only
+	Outbound   bool
+	MsgType    int64
+	AppMsgType int64
+	IsGroupMsg bool
+	Time       time.Time // CreateTime of inbound, sent time of outbound
+
+	Conversation         ContactID
+	ConversationUserName string
+	ConversationName     string
+	Sender               ContactID
+	SenderUserName       string
+	SenderName           string // DisplayName in group or NickName
+
+	Content    string // plain text
+	RawContent string
+	Mentions   []string
+
+	Title    string // title of link or file name of attachment
+	URL      string // url of link
+	FileName string
+	FileSize int64
+	MediaURL string // expires with session, read cached media by Media(MsgID)
+	MediaID  string // outbound only
+
+	Revoked   bool
+	RevokedAt time.Time
+}
+
+// ArchiveQuery select archived messages, zero fields are not filtered,
+// results are ordered by Time then MsgID.
+type ArchiveQuery struct {
+	Conversation ContactID
+	Sender       ContactID
+	Since        time.Time // inclusive
+	Until        time.Time // exclusive
+	Limit        int       // latest Limit messages if > 0
+}
+
+// matches reports whether m is selected by q, Limit is not considered.
+func (q *ArchiveQuery) matches(m *ArchivedMessage) bool {
+	if len(q.Conversation) > 0 && m.Conversation != q.Conversation {
+		return false
+	}
+	if len(q.Sender) > 0 && m.Sender != q.Sender {
+		return false
+	}
+	if !q.Since.IsZero() && m.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !m.Time.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// ArchiveStore is the storage of archive, Configure.ArchiveStore replace the
+// file store in CachePath.
+type ArchiveStore interface {
+	// Put insert or replace message by MsgID
+	Put(m *ArchivedMessage) error
+	// Get returns ErrNotArchived if msg is not archived
+	Get(msgID string) (*ArchivedMessage, error)
+	Query(q ArchiveQuery) ([]*ArchivedMessage, error)
+	Close() error
+}
+
+// Archive records every inbound and outbound message, it is nil unless
+// Configure.Archive is on.
+type Archive struct {
+	store   ArchiveStore
+	index   *searchIndex
+	putLock sync.Mutex
+}
+
+func newArchive(conf *Configure) (*Archive, error) {
+
+	store := conf.ArchiveStore
+	if store == nil {
+		var err error
+		if store, err = OpenFileArchiveStore(conf.archivePath()); err != nil {
+			return nil, err
+		}
+	}
+
+	// 全文索引只在内存里, 启动时重建
+	msgs, err := store.Query(ArchiveQuery{})
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	a := &Archive{store: store, index: newSearchIndex()}
+	for _, m := range msgs {
+		a.index.add(m)
+	}
+
+	return a, nil
+}
+
+// put save m and update search index.
+func (a *Archive) put(m *ArchivedMessage) error {
+	return a.update(m.MsgID, func(*ArchivedMessage) *ArchivedMessage { return m })
+}
+
+// update save the message returned by fn, which gets the archived one of
+// msgID or nil, nothing is saved if fn returns nil. The old one is removed
+// from search index.
+func (a *Archive) update(msgID string, fn func(old *ArchivedMessage) *ArchivedMessage) error {
+	a.putLock.Lock()
+	defer a.putLock.Unlock()
+
+	old, err := a.store.Get(msgID)
+	if err != nil && err != ErrNotArchived {
+		return err
+	}
+	m := fn(old)
+	if m == nil {
+		return nil
+	}
+	if err = a.store.Put(m); err != nil {
+		return err
+	}
+	if old != nil {
+		a.index.remove(old)
+	}
+	a.index.add(m)
+	return nil
+}
+
+// Archive returns the message archive, nil if Configure.Archive is off.
+func (wechat *WeChat) Archive() *Archive {
+	return wechat.archive
+}
+
+// Get returns the archived message of msgID.
+func (a *Archive) Get(msgID string) (*ArchivedMessage, error) {
+	return a.store.Get(msgID)
+}
+
+// Query returns archived messages selected by q.
+func (a *Archive) Query(q ArchiveQuery) ([]*ArchivedMessage, error) {
+	return a.store.Query(q)
+}
+
+// Conversation returns the latest limit messages with contact or in group, 0 means all.
+func (a *Archive) Conversation(contact *Contact, limit int) ([]*ArchivedMessage, error) {
+	return a.store.Query(ArchiveQuery{Conversation: ArchiveID(contact), Limit: limit})
+}
+
+// Between returns messages archived in [since, until).
+func (a *Archive) Between(since, until time.Time) ([]*ArchivedMessage, error) {
+	return a.store.Query(ArchiveQuery{Since: since, Until: until})
+}
+
+// BySender returns the latest limit messages sent by contact, 0 means all.
+func (a *Archive) BySender(contact *Contact, limit int) ([]*ArchivedMessage, error) {
+	return a.store.Query(ArchiveQuery{Sender: ArchiveID(contact), Limit: limit})
+}
+
+// Close close the store.
+func (a *Archive) Close() error {
+	return a.store.Close()
+}
+
+// ArchiveID is the ContactID contact is archived by, for ArchiveQuery. It is
+// the ID assigned to a group member not identified yet instead of `un:<UserName>`.
+func ArchiveID(contact *Contact) ContactID {
+	id, confidence := contact.ID()
+	if confidence == 0 && len(contact.StableID) > 0 {
+		return contact.StableID
+	}
+	return id
+}
+
+// identify returns the ArchiveID and name of contact, the id is
+// `un:<UserName>` of this session only if contact is not in cache.
+func (wechat *WeChat) identify(un string) (ContactID, string) {
+	c := wechat.cache.snapshot(un)
+	if un == wechat.MySelf.UserName {
+		c = wechat.myselfCopy()
+	}
+	if c == nil {
+		id, _ := (&Contact{UserName: un}).ID()
+		return id, ``
+	}
+	id := ArchiveID(c)
+	name := c.RemarkName
+	if len(name) == 0 {
+		name = c.NickName
+	}
+	return id, name
+}
+
+// recordInbound archive msg, a revoke msg mark the revoked one instead.
+func (wechat *WeChat) recordInbound(msg EventMsgData) {
+
+	a := wechat.archive
+	if a == nil || msg.MsgType == msgTypeStatusNotify {
+		return
+	}
+
+	if msg.MsgType == msgTypeRevoke {
+		wechat.recordRevoke(msg)
+		return
+	}
+
+	m := &ArchivedMessage{
+		MsgID:      msg.MsgID,
+		Outbound:   msg.IsSendedByMySelf,
+		MsgType:    msg.MsgType,
+		IsGroupMsg: msg.IsGroupMsg,
+		Time:       time.Now(),
+		Content:    msg.Content,
+		RawContent: msg.RawContent,
+		Mentions:   msg.Mentions,
+		MediaURL:   msg.MediaURL,
+	}
+
+	if t, ok := msg.OriginalMsg[`CreateTime`].(float64); ok && t > 0 {
+		m.Time = time.Unix(int64(t), 0)
+	}
+	m.AppMsgType = int64(floatOf(msg.OriginalMsg[`AppMsgType`]))
+	if m.MsgType == 49 {
+		m.Title = normalizeText(stringOf(msg.OriginalMsg[`FileName`]))
+		m.URL = html.UnescapeString(stringOf(msg.OriginalMsg[`Url`]))
+		if m.AppMsgType == appMsgTypeAttach {
+			m.FileName = m.Title
+			m.FileSize, _ = strconv.ParseInt(stringOf(msg.OriginalMsg[`FileSize`]), 10, 64)
+		}
+	}
+
+	conversation := msg.FromUserName
+	if msg.IsSendedByMySelf {
+		conversation = msg.ToUserName
+	}
+	m.ConversationUserName = conversation
+	m.Conversation, m.ConversationName = wechat.identify(conversation)
+
+	// Sender 取不到时只有 UserName, 再从缓存里找一次
+	m.SenderUserName = msg.SenderUserName
+	m.Sender, m.SenderName = wechat.identify(msg.SenderUserName)
+	if msg.Sender != nil {
+		if id := ArchiveID(msg.Sender); !strings.HasPrefix(string(id), `un:`) {
+			m.Sender = id
+		}
+		if len(msg.SenderDisplayName) > 0 {
+			m.SenderName = msg.SenderDisplayName
+		} else if len(msg.Sender.NickName) > 0 {
+			m.SenderName = msg.Sender.NickName
+		}
+	}
+
+	// 自己发的消息可能已经存过了
+	err := a.update(m.MsgID, func(old *ArchivedMessage) *ArchivedMessage {
+		if old != nil {
+			m.LocalID, m.MediaID = old.LocalID, old.MediaID
+			m.Revoked, m.RevokedAt = old.Revoked, old.RevokedAt
+		}
+		return m
+	})
+	if err != nil {
+		logger.Warnf(`archive message [%s] failed: %v`, m.MsgID, err)
+	}
+}
+
+// recordRevoke mark the message in `<revokemsg>` as revoked.
+func (wechat *WeChat) recordRevoke(msg EventMsgData) {
+
+	match := revokedMsgIDReg.FindStringSubmatch(html.UnescapeString(msg.RawContent))
+	if match == nil {
+		logger.Debugf(`no msgid in revoke message [%s]`, msg.MsgID)
+		return
+	}
+
+	err := wechat.archive.update(match[1], func(m *ArchivedMessage) *ArchivedMessage {
+		if m == nil {
+			logger.Debugf(`revoked message [%s] is not archived`, match[1])
+			return nil
+		}
+		m.Revoked = true
+		m.RevokedAt = time.Now()
+		return m
+	})
+	if err != nil {
+		logger.Warnf(`archive revoke of [%s] failed: %v`, match[1], err)
+	}
+}
+
+// recordOutbound archive a message accepted by wx server.
+func (wechat *WeChat) recordOutbound(sent *SentMessage) {
+
+	a := wechat.archive
+	if a == nil || sent == nil {
+		return
+	}
+
+	content := sent.Msg.Content()
+
+	m := &ArchivedMessage{
+		MsgID:                sent.MsgID,
+		LocalID:              sent.LocalID,
+		Outbound:             true,
+		MsgType:              int64(floatOf(content[`Type`])),
+		IsGroupMsg:           strings.HasPrefix(sent.To, `@@`),
+		Time:                 time.Unix(sent.Time, 0),
+		ConversationUserName: sent.To,
+		SenderUserName:       wechat.MySelf.UserName,
+		SenderName:           wechat.MySelf.NickName,
+		MediaID:              stringOf(content[`MediaId`]),
+	}
+	m.Conversation, m.ConversationName = wechat.identify(sent.To)
+	m.Sender, _ = wechat.MySelf.ID()
+
+	raw := stringOf(content[`Content`])
+	m.RawContent = raw
+	if strings.HasPrefix(raw, `<appmsg`) {
+		// 发出去的 app msg 只有 xml
+		m.AppMsgType = m.MsgType
+		m.MsgType = 49
+		m.Title, _ = search(raw, `<title>`, `</title>`)
+		m.Title = html.UnescapeString(m.Title)
+		m.URL, _ = search(raw, `<url>`, `</url>`)
+		m.URL = html.UnescapeString(m.URL)
+		if m.AppMsgType == appMsgTypeAttach {
+			m.FileName = m.Title
+			m.MediaID, _ = search(raw, `<attachid>`, `</attachid>`)
+		}
+		m.Content = m.Title
+	} else {
+		m.Content = raw
+	}
+
+	if err := a.put(m); err != nil {
+		logger.Warnf(`archive sent message [%s] failed: %v`, m.MsgID, err)
+	}
+}
+
+// floatOf returns numbers in json as float64, they may be int if set by us.
+func floatOf(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	}
+	return 0
+}
+
+func stringOf(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
@@ -0,0 +1,269 @@
+package wechat
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// a log is compacted on open if it has this many lines more than live messages
+var archiveCompactLines = 1000
+
+// fileArchiveStore is an embedded key-value store of archived messages, every
+// Put append a json line keyed by MsgID to a log file and the latest line of a
+// key wins. All messages are kept in memory and the whole log is read when it
+// is opened, it suits an archive of up to some hundred thousand messages;
+// set Configure.ArchiveStore to a database for more.
+type fileArchiveStore struct {
+	sync.Mutex
+	path  string
+	file  *os.File
+	lines int
+
+	msgs           map[string]*ArchivedMessage
+	ordered        []*ArchivedMessage // by Time then MsgID
+	byConversation map[ContactID][]*ArchivedMessage
+	bySender       map[ContactID][]*ArchivedMessage
+}
+
+// OpenFileArchiveStore open or create the log file at path, a line broken by
+// crash at the end of log is dropped.
+func OpenFileArchiveStore(path string) (ArchiveStore, error) {
+
+	s := &fileArchiveStore{
+		path:           path,
+		msgs:           make(map[string]*ArchivedMessage),
+		byConversation: make(map[ContactID][]*ArchivedMessage),
+		bySender:       make(map[ContactID][]*ArchivedMessage),
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	valid, err := s.replay(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err = file.Truncate(valid); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err = file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.file = file
+
+	logger.Infof(`loaded %d archived message(s)`, len(s.msgs))
+
+	if s.lines-len(s.msgs) > archiveCompactLines {
+		if err = s.compact(); err != nil {
+			logger.Warnf(`compact archive failed: %v`, err)
+		}
+	}
+
+	return s, nil
+}
+
+// replay index every line of log, returns offset after the last valid line.
+func (s *fileArchiveStore) replay(r io.Reader) (int64, error) {
+
+	br := bufio.NewReader(r)
+	valid := int64(0)
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				logger.Warnf(`drop incomplete line at the end of archive`)
+			}
+			return valid, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		m := new(ArchivedMessage)
+		if err = json.Unmarshal(line, m); err != nil {
+			logger.Warnf(`skip broken line of archive: %v`, err)
+		} else {
+			s.index(m)
+			s.lines++
+		}
+		valid += int64(len(line))
+	}
+}
+
+// compact rewrite the log with live messages only, must be called before
+// the store is shared or with lock held.
+func (s *fileArchiveStore) compact() error {
+
+	tmp := s.path + `.tmp`
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(file)
+	for _, m := range s.ordered {
+		data, err := json.Marshal(m)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		bw.Write(data)
+		bw.WriteByte('\n')
+	}
+	if err = bw.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if err = os.Rename(tmp, s.path); err != nil {
+		file.Close()
+		return err
+	}
+
+	logger.Infof(`archive compacted from %d to %d line(s)`, s.lines, len(s.ordered))
+
+	s.file.Close()
+	s.file = file
+	s.lines = len(s.ordered)
+	return nil
+}
+
+func (s *fileArchiveStore) Put(m *ArchivedMessage) error {
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, err = s.file.Write(data); err != nil {
+		return err
+	}
+	s.lines++
+	s.index(copyArchived(m))
+
+	return nil
+}
+
+func (s *fileArchiveStore) Get(msgID string) (*ArchivedMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	m, found := s.msgs[msgID]
+	if !found {
+		return nil, ErrNotArchived
+	}
+	return copyArchived(m), nil
+}
+
+func (s *fileArchiveStore) Query(q ArchiveQuery) ([]*ArchivedMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	list := s.ordered
+	if len(q.Conversation) > 0 {
+		list = s.byConversation[q.Conversation]
+	}
+	if len(q.Sender) > 0 && len(s.bySender[q.Sender]) < len(list) {
+		list = s.bySender[q.Sender]
+	}
+
+	start := 0
+	if !q.Since.IsZero() {
+		start = sort.Search(len(list), func(i int) bool {
+			return !list[i].Time.Before(q.Since)
+		})
+	}
+
+	var result []*ArchivedMessage
+	for _, m := range list[start:] {
+		if !q.Until.IsZero() && !m.Time.Before(q.Until) {
+			break
+		}
+		if q.matches(m) {
+			result = append(result, m)
+		}
+	}
+
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+	for i, m := range result {
+		result[i] = copyArchived(m)
+	}
+
+	return result, nil
+}
+
+func (s *fileArchiveStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// index replace the message of same MsgID, must be called with lock held.
+func (s *fileArchiveStore) index(m *ArchivedMessage) {
+
+	if old, found := s.msgs[m.MsgID]; found {
+		s.ordered = removeArchived(s.ordered, old)
+		s.byConversation[old.Conversation] = removeArchived(s.byConversation[old.Conversation], old)
+		s.bySender[old.Sender] = removeArchived(s.bySender[old.Sender], old)
+	}
+
+	s.msgs[m.MsgID] = m
+	s.ordered = insertArchived(s.ordered, m)
+	s.byConversation[m.Conversation] = insertArchived(s.byConversation[m.Conversation], m)
+	s.bySender[m.Sender] = insertArchived(s.bySender[m.Sender], m)
+}
+
+func archivedBefore(a, b *ArchivedMessage) bool {
+	if !a.Time.Equal(b.Time) {
+		return a.Time.Before(b.Time)
+	}
+	return a.MsgID < b.MsgID
+}
+
+func insertArchived(list []*ArchivedMessage, m *ArchivedMessage) []*ArchivedMessage {
+	i := sort.Search(len(list), func(i int) bool { return !archivedBefore(list[i], m) })
+	list = append(list, nil)
+	copy(list[i+1:], list[i:])
+	list[i] = m
+	return list
+}
+
+func removeArchived(list []*ArchivedMessage, m *ArchivedMessage) []*ArchivedMessage {
+	i := sort.Search(len(list), func(i int) bool { return !archivedBefore(list[i], m) })
+	for ; i < len(list); i++ {
+		if list[i] == m {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+func copyArchived(m *ArchivedMessage) *ArchivedMessage {
+	cp := *m
+	cp.Mentions = append([]string(nil), m.Mentions...)
+	return &cp
+}
@@ -0,0 +1,229 @@
+package wechat
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestArchiveStore(t *testing.T, path string) *fileArchiveStore {
+	s, err := OpenFileArchiveStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*fileArchiveStore)
+}
+
+func TestFileArchiveStoreRoundTrip(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `archive`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, `archive.log`)
+
+	base := time.Unix(1500000000, 0)
+	msgs := []*ArchivedMessage{
+		{MsgID: `1`, Time: base, Conversation: `uin:1`, Sender: `uin:1`, Content: `你好`, Mentions: []string{`@a`}},
+		{MsgID: `2`, Time: base.Add(time.Minute), Conversation: `id:g`, Sender: `uin:1`, Content: `发票`},
+		{MsgID: `3`, Time: base.Add(2 * time.Minute), Conversation: `id:g`, Sender: `alias:b`, Content: `收到`},
+	}
+
+	s := openTestArchiveStore(t, path)
+	for _, m := range msgs {
+		if err = s.Put(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	revoked := copyArchived(msgs[1])
+	revoked.Revoked = true
+	if err = s.Put(revoked); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestArchiveStore(t, path)
+	defer s.Close()
+
+	if m, err := s.Get(`1`); err != nil || m.Content != `你好` || len(m.Mentions) != 1 || !m.Time.Equal(base) {
+		t.Fatalf(`get 1 after reopen: %+v, %v`, m, err)
+	}
+	if m, err := s.Get(`2`); err != nil || !m.Revoked {
+		t.Fatalf(`revoke is lost after reopen: %+v, %v`, m, err)
+	}
+	if _, err := s.Get(`4`); err != ErrNotArchived {
+		t.Fatalf(`get unknown returns %v`, err)
+	}
+
+	cases := []struct {
+		q   ArchiveQuery
+		ids string
+	}{
+		{ArchiveQuery{}, `123`},
+		{ArchiveQuery{Conversation: `id:g`}, `23`},
+		{ArchiveQuery{Sender: `uin:1`}, `12`},
+		{ArchiveQuery{Conversation: `id:g`, Sender: `uin:1`}, `2`},
+		{ArchiveQuery{Since: base.Add(time.Minute)}, `23`},
+		{ArchiveQuery{Until: base.Add(time.Minute)}, `1`},
+		{ArchiveQuery{Limit: 2}, `23`},
+	}
+	for _, c := range cases {
+		result, err := s.Query(c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := ``
+		for _, m := range result {
+			ids += m.MsgID
+		}
+		if ids != c.ids {
+			t.Errorf(`query %+v returns %s, want %s`, c.q, ids, c.ids)
+		}
+	}
+}
+
+func TestFileArchiveStoreDropIncompleteLine(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `archive`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, `archive.log`)
+
+	s := openTestArchiveStore(t, path)
+	s.Put(&ArchivedMessage{MsgID: `1`, Time: time.Unix(1, 0)})
+	s.Close()
+
+	// 写到一半崩溃了
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"MsgID":"2","Con`)
+	f.Close()
+
+	s = openTestArchiveStore(t, path)
+	if len(s.msgs) != 1 {
+		t.Fatalf(`%d message(s) after crash`, len(s.msgs))
+	}
+	// the broken line is cut, so the next line is not appended to it
+	s.Put(&ArchivedMessage{MsgID: `3`, Time: time.Unix(3, 0)})
+	s.Close()
+
+	s = openTestArchiveStore(t, path)
+	defer s.Close()
+	if _, err := s.Get(`3`); err != nil || len(s.msgs) != 2 {
+		t.Fatalf(`put after crash: %d message(s), %v`, len(s.msgs), err)
+	}
+}
+
+func TestFileArchiveStoreCompact(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `archive`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, `archive.log`)
+
+	defer func(n int) { archiveCompactLines = n }(archiveCompactLines)
+	archiveCompactLines = 2
+
+	s := openTestArchiveStore(t, path)
+	for i := 0; i < 5; i++ {
+		s.Put(&ArchivedMessage{MsgID: `1`, Time: time.Unix(1, 0), Content: string(rune('a' + i))})
+	}
+	s.Put(&ArchivedMessage{MsgID: `2`, Time: time.Unix(2, 0)})
+	s.Close()
+
+	s = openTestArchiveStore(t, path)
+	defer s.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte{'\n'}); n != 2 || s.lines != 2 {
+		t.Fatalf(`%d line(s) after compact`, n)
+	}
+	if m, err := s.Get(`1`); err != nil || m.Content != `e` {
+		t.Fatalf(`latest put is lost by compact: %+v, %v`, m, err)
+	}
+
+	// still writable after compact
+	if err = s.Put(&ArchivedMessage{MsgID: `3`, Time: time.Unix(3, 0)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveKeyedByStableID(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `archive`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := openTestArchiveStore(t, filepath.Join(dir, `archive.log`))
+	defer store.Close()
+
+	wechat := &WeChat{
+		cache:   newCache(),
+		MySelf:  Contact{UserName: `@me`, Uin: 100},
+		archive: &Archive{store: store, index: newSearchIndex()},
+	}
+	wechat.cache.contacts[`@a`] = &Contact{UserName: `@a`, NickName: `甲`, StableID: `id:a`, IDConfidence: 1}
+
+	wechat.recordInbound(EventMsgData{
+		MsgID:          `1`,
+		MsgType:        1,
+		Content:        `你好`,
+		FromUserName:   `@a`,
+		SenderUserName: `@a`,
+		ToUserName:     `@me`,
+		OriginalMsg:    map[string]interface{}{`CreateTime`: float64(1500000000)},
+	})
+
+	// 重新登录后 UserName 变了
+	again := &Contact{UserName: `@a2`, NickName: `甲`, StableID: `id:a`, IDConfidence: 0.8}
+	msgs, err := wechat.Archive().Conversation(again, 0)
+	if err != nil || len(msgs) != 1 || msgs[0].ConversationUserName != `@a` {
+		t.Fatalf(`conversation after re-login: %v, %v`, msgs, err)
+	}
+	if msgs, _ = wechat.Archive().BySender(again, 0); len(msgs) != 1 || msgs[0].SenderName != `甲` {
+		t.Fatalf(`by sender after re-login: %v`, msgs)
+	}
+
+	// 不在缓存里的只能用这次会话的 UserName
+	if id, _ := wechat.identify(`@x`); id != `un:@x` {
+		t.Fatalf(`id of unknown contact is %s`, id)
+	}
+
+	// 还没认出来的群成员, 下次会话对上之后还能找到
+	wechat.cache.contacts[`@@g`] = &Contact{UserName: `@@g`, NickName: `群`, StableID: `id:g`, IDConfidence: 1}
+	member := &Contact{UserName: `@m`, NickName: `乙`, StableID: `id:m`, Type: Member}
+	wechat.recordInbound(EventMsgData{
+		MsgID:          `2`,
+		MsgType:        1,
+		IsGroupMsg:     true,
+		Content:        `收到`,
+		FromUserName:   `@@g`,
+		SenderUserName: `@m`,
+		Sender:         member,
+		ToUserName:     `@me`,
+	})
+	if msgs, _ = wechat.Archive().BySender(member, 0); len(msgs) != 1 || msgs[0].Sender != `id:m` {
+		t.Fatalf(`by unidentified member: %v`, msgs)
+	}
+	matched := &Contact{UserName: `@m2`, NickName: `乙`, StableID: `id:m`, IDConfidence: 0.75, Type: Member}
+	if msgs, _ = wechat.Archive().BySender(matched, 0); len(msgs) != 1 {
+		t.Fatalf(`by member matched in next session: %v`, msgs)
+	}
+}
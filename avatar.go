@@ -0,0 +1,408 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // decoders of avatars
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrEmptyAvatar is returned when wx server returns no image, e.g. skey expired.
+var ErrEmptyAvatar = errors.New(`empty avatar`)
+
+// maxAvatarSize limit bytes read of one avatar
+var maxAvatarSize int64 = 5 * 1024 * 1024
+
+// avatars whose dHash differ more than this many bits are different images,
+// a re-compressed avatar differ only a few.
+var avatarChangeThreshold = 10
+
+// avatars which HeadHash and seq tell nothing about are downloaded again after this long
+var avatarMaxAge = 24 * time.Hour
+
+// avatarCacheSize is the most avatars kept on disk, least recently used ones are evicted.
+var avatarCacheSize = 5000
+
+// maxAvatarPixels limit size of image decoded for dHash, avatars are a few hundred pixels wide.
+var maxAvatarPixels = 2048 * 2048
+
+// avatarIndexSaveDelay is how long changes of index are collected before it is written.
+var avatarIndexSaveDelay = 2 * time.Second
+
+type avatarEntry struct {
+	ID          ContactID
+	Confidence  float64 // confidence of ID when cached
+	UserName    string
+	Name        string // RemarkName or NickName when cached
+	HeadHash    string
+	HeadImgFlag float64
+	Seq         string
+	DHash       uint64
+	ContentType string
+	Updated     time.Time
+	Accessed    time.Time
+}
+
+// avatarCache store avatars on disk by ContactID, so they survive re-login.
+// Avatars of contacts identified by UserName can't be found after re-login,
+// they are dropped on load.
+type avatarCache struct {
+	sync.Mutex
+	dir     string
+	entries map[ContactID]*avatarEntry
+	saving  bool // saveIndex is scheduled
+}
+
+func newAvatarCache(dir string) *avatarCache {
+
+	ac := &avatarCache{
+		dir:     dir,
+		entries: make(map[ContactID]*avatarEntry),
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		logger.Errorf(`create avatar cache dir failed: %v`, err)
+	}
+
+	if data, err := ioutil.ReadFile(ac.indexPath()); err == nil {
+		var entries []*avatarEntry
+		if err = json.Unmarshal(data, &entries); err != nil {
+			logger.Warnf(`avatar cache index is broken: %v`, err)
+		}
+		for _, e := range entries {
+			if e.Confidence == 0 {
+				os.Remove(ac.contentPath(e.ID))
+				continue
+			}
+			if _, err := os.Stat(ac.contentPath(e.ID)); err == nil {
+				ac.entries[e.ID] = e
+			}
+		}
+	}
+
+	return ac
+}
+
+func (ac *avatarCache) indexPath() string {
+	return filepath.Join(ac.dir, `index.json`)
+}
+
+// ContactID contains `:`, file name is a hash of it
+func (ac *avatarCache) contentPath(id ContactID) string {
+	sum := sha1.Sum([]byte(id))
+	return filepath.Join(ac.dir, hex.EncodeToString(sum[:]))
+}
+
+// scheduleSave write index a moment later, changes in between are written
+// once. Must be called with lock held.
+func (ac *avatarCache) scheduleSave() {
+	if ac.saving {
+		return
+	}
+	ac.saving = true
+	time.AfterFunc(avatarIndexSaveDelay, ac.saveIndex)
+}
+
+func (ac *avatarCache) saveIndex() {
+	ac.Lock()
+	ac.saving = false
+	entries := make([]*avatarEntry, 0, len(ac.entries))
+	for _, e := range ac.entries {
+		entries = append(entries, e)
+	}
+	data, err := json.Marshal(entries)
+	ac.Unlock()
+
+	if err != nil {
+		logger.Warnf(`marshal avatar cache index failed: %v`, err)
+		return
+	}
+	createFile(ac.indexPath(), data, false)
+}
+
+// put add e and evict least recently used avatars over avatarCacheSize,
+// must be called with lock held.
+func (ac *avatarCache) put(e *avatarEntry) {
+	ac.entries[e.ID] = e
+	for len(ac.entries) > avatarCacheSize {
+		var oldest *avatarEntry
+		for _, o := range ac.entries {
+			if o != e && (oldest == nil || o.Accessed.Before(oldest.Accessed)) {
+				oldest = o
+			}
+		}
+		delete(ac.entries, oldest.ID)
+		os.Remove(ac.contentPath(oldest.ID))
+	}
+	ac.scheduleSave()
+}
+
+// touch record access of cached avatar.
+func (ac *avatarCache) touch(e *avatarEntry) {
+	ac.Lock()
+	e.Accessed = time.Now()
+	ac.scheduleSave()
+	ac.Unlock()
+}
+
+// fresh reports whether cached avatar is still the one of contact,
+// HeadHash is used if known, then HeadImgFlag and seq of HeadImgUrl.
+func (e *avatarEntry) fresh(contact *Contact) bool {
+	if len(contact.HeadHash) > 0 || len(e.HeadHash) > 0 {
+		return contact.HeadHash == e.HeadHash
+	}
+	seq := headImgSeq(contact.HeadImgURL)
+	if contact.HeadImgFlag != e.HeadImgFlag || seq != e.Seq {
+		return false
+	}
+	// 群成员的 seq 都是 0, 说明不了什么, 过一段时间重新下载
+	if len(seq) == 0 || seq == `0` {
+		return time.Since(e.Updated) < avatarMaxAge
+	}
+	return true
+}
+
+// owns reports whether entry is of contact. An ID matched by profile may
+// be given to another contact later, its avatar is not served or compared then.
+func (e *avatarEntry) owns(contact *Contact, confidence float64) bool {
+	if confidence >= 1 && e.Confidence >= 1 {
+		return true
+	}
+	return e.UserName == contact.UserName || (len(e.Name) > 0 && e.Name == avatarName(contact))
+}
+
+func avatarName(contact *Contact) string {
+	if len(contact.RemarkName) > 0 {
+		return contact.RemarkName
+	}
+	return contact.NickName
+}
+
+// Avatar returns the avatar of contact, group or member, it is served from
+// disk cache unless HeadHash, HeadImgFlag or seq tell it changed.
+// `/contact/mod/avatar` is emitted if the new one looks different from the cached one.
+// Avatars are keyed by ID of contact, which doesn't include anything of the avatar.
+func (wechat *WeChat) Avatar(ctx context.Context, contact *Contact) ([]byte, error) {
+
+	ac := wechat.avatars
+	id, confidence := contact.ID()
+
+	ac.Lock()
+	entry, found := ac.entries[id]
+	ac.Unlock()
+
+	if found && !entry.owns(contact, confidence) {
+		logger.Debugf(`cached avatar of [%s] is of another contact`, id)
+		found = false
+	}
+
+	if found && entry.fresh(contact) {
+		data, err := ioutil.ReadFile(ac.contentPath(id))
+		if err == nil {
+			ac.touch(entry)
+			return data, nil
+		}
+		logger.Warnf(`read cached avatar of [%s] failed: %v`, contact.UserName, err)
+	}
+
+	data, contentType, err := wechat.downloadAvatar(ctx, contact)
+	if err != nil {
+		return nil, err
+	}
+
+	ne := &avatarEntry{
+		ID:          id,
+		Confidence:  confidence,
+		UserName:    contact.UserName,
+		Name:        avatarName(contact),
+		HeadHash:    contact.HeadHash,
+		HeadImgFlag: contact.HeadImgFlag,
+		Seq:         headImgSeq(contact.HeadImgURL),
+		ContentType: contentType,
+		Updated:     time.Now(),
+		Accessed:    time.Now(),
+	}
+	if ne.DHash, err = avatarHash(data); err != nil {
+		logger.Debugf(`hash avatar of [%s] failed: %v`, contact.UserName, err)
+	}
+
+	if err = createFile(ac.contentPath(id), data, false); err == nil {
+		ac.Lock()
+		ac.put(ne)
+		ac.Unlock()
+	}
+
+	if found && entry.DHash != 0 && ne.DHash != 0 &&
+		bits.OnesCount64(entry.DHash^ne.DHash) > avatarChangeThreshold {
+		logger.Debugf(`avatar of [%s] changed`, contact.NickName)
+		go wechat.evtStream.emitContactEvent(`/mod/`+ContactAvatarChanged, EventContactData{
+			ChangeType: Modify,
+			Contact:    *contact,
+			Changes:    []string{ContactAvatarChanged},
+		})
+	}
+
+	return data, nil
+}
+
+func (wechat *WeChat) downloadAvatar(ctx context.Context, contact *Contact) ([]byte, string, error) {
+
+	urlPath, err := wechat.avatarURL(contact)
+	if err != nil {
+		return nil, ``, err
+	}
+
+	req, err := http.NewRequest(`GET`, urlPath, nil)
+	if err != nil {
+		return nil, ``, err
+	}
+
+	resp, err := wechat.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, ``, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, ``, fmt.Errorf(`get avatar failed: %s`, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAvatarSize))
+	if err != nil {
+		return nil, ``, err
+	}
+	if len(data) == 0 {
+		return nil, ``, ErrEmptyAvatar
+	}
+
+	return data, http.DetectContentType(data), nil
+}
+
+// avatarURL returns full url of avatar with current skey,
+// groups use webwxgetheadimg, others webwxgeticon.
+func (wechat *WeChat) avatarURL(contact *Contact) (string, error) {
+
+	base, err := url.Parse(wechat.BaseURL)
+	if err != nil {
+		return ``, err
+	}
+
+	headImgURL := contact.HeadImgURL
+	if len(headImgURL) == 0 {
+		api := `webwxgeticon`
+		if contact.IsGroup() {
+			api = `webwxgetheadimg`
+		}
+		headImgURL = fmt.Sprintf(`/cgi-bin/mmwebwx-bin/%s?seq=0&username=%s`, api, url.QueryEscape(contact.UserName))
+	}
+
+	u, err := url.Parse(headImgURL)
+	if err != nil {
+		return ``, err
+	}
+	u.Scheme, u.Host = base.Scheme, base.Host
+
+	// skey in cached url may be empty or expired
+	query := u.Query()
+	query.Set(`skey`, wechat.BaseRequest.Skey)
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// memberHeadImgURL is HeadImgUrl of group member who is not a friend.
+func (wechat *WeChat) memberHeadImgURL(un, groupUserName string) string {
+	return fmt.Sprintf(`/cgi-bin/mmwebwx-bin/webwxgeticon?seq=0&username=%s&chatroomid=%s&%s`,
+		url.QueryEscape(un), url.QueryEscape(groupUserName), wechat.skeyQuery())
+}
+
+func (wechat *WeChat) skeyQuery() string {
+	if wechat.BaseRequest == nil {
+		return `skey=`
+	}
+	return `skey=` + url.QueryEscape(wechat.BaseRequest.Skey)
+}
+
+// avatarHash returns dHash of image data, the size is checked before decoding.
+func avatarHash(data []byte) (uint64, error) {
+	conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	if conf.Width <= 0 || conf.Height <= 0 || conf.Width > maxAvatarPixels/conf.Height {
+		return 0, fmt.Errorf(`avatar of %dx%d is too large`, conf.Width, conf.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	return dHash(img), nil
+}
+
+// dHash is a 64 bits difference hash, images look alike have hashes differ
+// in a few bits regardless of size and compression.
+func dHash(img image.Image) uint64 {
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return 0
+	}
+
+	// average luminance of 9x8 cells
+	var cells [8][9]float64
+	for y := 0; y < 8; y++ {
+		y0, y1 := b.Min.Y+y*h/8, b.Min.Y+(y+1)*h/8
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < 9; x++ {
+			x0, x1 := b.Min.X+x*w/9, b.Min.X+(x+1)*w/9
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			sum, n := 0.0, 0
+			for yy := y0; yy < y1 && yy < b.Max.Y; yy++ {
+				for xx := x0; xx < x1 && xx < b.Max.X; xx++ {
+					r, g, bl, _ := img.At(xx, yy).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+					n++
+				}
+			}
+			if n > 0 {
+				cells[y][x] = sum / float64(n)
+			}
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return hash
+}
+
+// GetContactHeadImg ...
+func (wechat *WeChat) GetContactHeadImg(c *Contact) ([]byte, error) {
+	return wechat.Avatar(context.Background(), c)
+}
@@ -0,0 +1,256 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gradientPNG returns a png whose upper half gets brighter to right and lower
+// half to left, the other way round if reversed.
+func gradientPNG(t *testing.T, reversed bool) []byte {
+	img := image.NewGray(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			v := uint8(x * 8)
+			if reversed != (y < 16) {
+				v = 255 - v
+			}
+			img.SetGray(x, y, color.Gray{Y: v})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type avatarServer struct {
+	sync.Mutex
+	images   map[string][]byte // by username
+	requests int
+}
+
+func (s *avatarServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests++
+	w.Write(s.images[r.URL.Query().Get(`username`)])
+}
+
+func (s *avatarServer) set(un string, data []byte) {
+	s.Lock()
+	s.images[un] = data
+	s.Unlock()
+}
+
+func (s *avatarServer) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.requests
+}
+
+func newAvatarTestBot(t *testing.T) (*WeChat, *avatarServer, func()) {
+
+	dir, err := ioutil.TempDir(``, `avatar`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := &avatarServer{images: make(map[string][]byte)}
+	server := httptest.NewServer(as)
+
+	wechat := &WeChat{
+		BaseURL:     server.URL + `/cgi-bin/mmwebwx-bin`,
+		BaseRequest: &BaseRequest{Skey: `skey`},
+		Client:      server.Client(),
+		avatars:     newAvatarCache(dir),
+		evtStream:   newEvtStream(),
+	}
+	return wechat, as, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAvatarIDCollision(t *testing.T) {
+
+	wechat, as, done := newAvatarTestBot(t)
+	defer done()
+
+	right, left := gradientPNG(t, false), gradientPNG(t, true)
+	as.set(`@a`, right)
+	as.set(`@b`, left)
+
+	// 两个联系人按资料匹配到了同一个 ID
+	a := &Contact{UserName: `@a`, NickName: `甲`, StableID: `id:1`, IDConfidence: 0.6}
+	b := &Contact{UserName: `@b`, NickName: `乙`, StableID: `id:1`, IDConfidence: 0.6}
+
+	if data, err := wechat.Avatar(context.Background(), a); err != nil || !bytes.Equal(data, right) {
+		t.Fatalf(`avatar of a: %v`, err)
+	}
+	if data, err := wechat.Avatar(context.Background(), b); err != nil || !bytes.Equal(data, left) {
+		t.Fatalf(`avatar of b is the one of a: %v`, err)
+	}
+	if paths := drainGroupEvents(wechat.evtStream); len(paths) != 0 {
+		t.Fatalf(`avatar of another contact emits %v`, paths)
+	}
+}
+
+func TestAvatarChangeDetection(t *testing.T) {
+
+	wechat, as, done := newAvatarTestBot(t)
+	defer done()
+
+	right, left := gradientPNG(t, false), gradientPNG(t, true)
+	as.set(`@a`, right)
+
+	c := &Contact{UserName: `@a`, NickName: `甲`, Uin: 1, HeadHash: `h1`}
+	if _, err := wechat.Avatar(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+
+	// 新会话, UserName 变了, 头像没变
+	c = &Contact{UserName: `@a2`, NickName: `甲`, Uin: 1, HeadHash: `h1`}
+	if data, err := wechat.Avatar(context.Background(), c); err != nil || !bytes.Equal(data, right) || as.count() != 1 {
+		t.Fatalf(`unchanged avatar is not served from cache: %v, %d request(s)`, err, as.count())
+	}
+
+	// 换了头像
+	as.set(`@a2`, left)
+	c.HeadHash = `h2`
+	if data, err := wechat.Avatar(context.Background(), c); err != nil || !bytes.Equal(data, left) {
+		t.Fatalf(`changed avatar: %v`, err)
+	}
+	if paths := drainGroupEvents(wechat.evtStream); len(paths) != 1 || paths[0] != `/contact/mod/`+ContactAvatarChanged {
+		t.Fatalf(`changed avatar emits %v`, paths)
+	}
+
+	// 重新压缩过的同一张图不算变化
+	c.HeadHash = `h3`
+	if _, err := wechat.Avatar(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	if paths := drainGroupEvents(wechat.evtStream); len(paths) != 0 {
+		t.Fatalf(`same image emits %v`, paths)
+	}
+}
+
+func TestAvatarFreshWithoutSeq(t *testing.T) {
+
+	e := &avatarEntry{Seq: `0`, Updated: time.Now()}
+	c := &Contact{HeadImgURL: `/cgi-bin/mmwebwx-bin/webwxgeticon?seq=0&username=@a`}
+
+	if !e.fresh(c) {
+		t.Fatal(`just cached avatar is not fresh`)
+	}
+	e.Updated = time.Now().Add(-avatarMaxAge - time.Minute)
+	if e.fresh(c) {
+		t.Fatal(`avatar without seq is fresh forever`)
+	}
+
+	e = &avatarEntry{Seq: `123`, Updated: e.Updated}
+	c.HeadImgURL = `/cgi-bin/mmwebwx-bin/webwxgeticon?seq=123&username=@a`
+	if !e.fresh(c) {
+		t.Fatal(`avatar with same seq is not fresh`)
+	}
+	c.HeadImgURL = `/cgi-bin/mmwebwx-bin/webwxgeticon?seq=124&username=@a`
+	if e.fresh(c) {
+		t.Fatal(`avatar with new seq is fresh`)
+	}
+}
+
+func TestAvatarEviction(t *testing.T) {
+
+	wechat, as, done := newAvatarTestBot(t)
+	defer done()
+
+	defer func(n int) { avatarCacheSize = n }(avatarCacheSize)
+	avatarCacheSize = 2
+
+	contact := func(un string) *Contact {
+		as.set(un, gradientPNG(t, false))
+		return &Contact{UserName: un, NickName: un, StableID: ContactID(`id:` + un), IDConfidence: 1, HeadHash: `h`}
+	}
+	a, b, c := contact(`@a`), contact(`@b`), contact(`@c`)
+
+	for _, ct := range []*Contact{a, b, a, c} {
+		if _, err := wechat.Avatar(context.Background(), ct); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ac := wechat.avatars
+	if _, found := ac.entries[`id:@b`]; found || len(ac.entries) != 2 {
+		t.Fatalf(`least recently used avatar is not evicted: %d entries`, len(ac.entries))
+	}
+	if _, err := os.Stat(ac.contentPath(`id:@b`)); !os.IsNotExist(err) {
+		t.Errorf(`file of evicted avatar is kept: %v`, err)
+	}
+	// a is read from cache, not downloaded again
+	if n := as.count(); n != 3 {
+		t.Errorf(`%d download(s)`, n)
+	}
+}
+
+func TestAvatarCacheReload(t *testing.T) {
+
+	wechat, as, done := newAvatarTestBot(t)
+	defer done()
+
+	as.set(`@m`, gradientPNG(t, false))
+	as.set(`@s`, gradientPNG(t, true))
+
+	// 匹配过的群成员, 和只在这次会话里认识的
+	member := &Contact{UserName: `@m`, NickName: `张三`, StableID: `id:m`, IDConfidence: 0.75, Type: Member,
+		HeadImgURL: `/cgi-bin/mmwebwx-bin/webwxgeticon?seq=0&username=@m`}
+	stranger := &Contact{UserName: `@s`, NickName: `李四`, Type: Member}
+	for _, c := range []*Contact{member, stranger} {
+		if _, err := wechat.Avatar(context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wechat.avatars.saveIndex()
+
+	wechat.avatars = newAvatarCache(wechat.avatars.dir)
+	if len(wechat.avatars.entries) != 1 {
+		t.Fatalf(`%d avatar(s) after reload`, len(wechat.avatars.entries))
+	}
+	if _, err := os.Stat(wechat.avatars.contentPath(`un:@s`)); !os.IsNotExist(err) {
+		t.Errorf(`avatar of stranger is kept: %v`, err)
+	}
+
+	// next session, the member matched again
+	again := &Contact{UserName: `@m2`, NickName: `张三`, StableID: `id:m`, IDConfidence: 0.75, Type: Member,
+		HeadImgURL: `/cgi-bin/mmwebwx-bin/webwxgeticon?seq=0&username=@m2`}
+	if _, err := wechat.Avatar(context.Background(), again); err != nil || as.count() != 2 {
+		t.Fatalf(`avatar of matched member is downloaded again: %v, %d download(s)`, err, as.count())
+	}
+}
+
+func TestAvatarHashLimit(t *testing.T) {
+
+	data := gradientPNG(t, false)
+	if h, err := avatarHash(data); err != nil || h == 0 {
+		t.Fatalf(`hash of avatar: %x, %v`, h, err)
+	}
+
+	defer func(n int) { maxAvatarPixels = n }(maxAvatarPixels)
+	maxAvatarPixels = 16 * 16
+	if _, err := avatarHash(data); err == nil {
+		t.Fatal(`large image is decoded`)
+	}
+	if _, err := avatarHash([]byte(`not an image`)); err == nil {
+		t.Fatal(`broken image is decoded`)
+	}
+}
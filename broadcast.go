@@ -0,0 +1,223 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/KevinGong2013/wechat/messages"
+)
+
+// BroadcastSpec describes who receive the broadcast and what is sent.
+// Recipients are the union of UserNames, Groups and contacts matched by Filter,
+// they are copies taken when the broadcast starts.
+type BroadcastSpec struct {
+	UserNames []string
+	Groups    []string // UserName of groups, the group itself receive the message
+	Filter    func(*Contact) bool
+
+	// Template is a text/template executed with the recipient *Contact,
+	// e.g. `{{if .RemarkName}}{{.RemarkName}}{{else}}{{.NickName}}{{end}}, 周末愉快`
+	Template string
+	Priority Priority
+}
+
+// BroadcastResult is the result of one recipient.
+type BroadcastResult struct {
+	Contact *Contact
+	Sent    *SentMessage
+	Err     error
+}
+
+// BroadcastReport summarize a broadcast.
+type BroadcastReport struct {
+	Total     int
+	Succeeded int
+	Failed    int
+	Results   []*BroadcastResult
+	Started   time.Time
+	Finished  time.Time
+}
+
+// BroadcastJob is a running broadcast which can be paused and resumed.
+// It pauses itself when logged out, call Resume after login.
+type BroadcastJob struct {
+	sync.Mutex
+	paused  chan struct{} // not nil while paused, closed by Resume
+	report  *BroadcastReport
+	done    chan struct{}
+	wechat  *WeChat
+	tmpl    *template.Template
+	targets []*Contact
+	spec    BroadcastSpec
+}
+
+// Broadcast send spec.Template to every recipient and wait until all are done,
+// messages go through the outbound queue, so rate limits are respected.
+func (wechat *WeChat) Broadcast(ctx context.Context, spec BroadcastSpec) (*BroadcastReport, error) {
+	job, err := wechat.StartBroadcast(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	return job.Wait(), nil
+}
+
+// StartBroadcast is Broadcast without waiting, use the returned job to pause, resume or wait.
+func (wechat *WeChat) StartBroadcast(ctx context.Context, spec BroadcastSpec) (*BroadcastJob, error) {
+
+	tmpl, err := template.New(`broadcast`).Parse(spec.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := wechat.broadcastTargets(spec)
+	if len(targets) == 0 {
+		return nil, errors.New(`no recipient matched`)
+	}
+
+	job := &BroadcastJob{
+		report: &BroadcastReport{
+			Total:   len(targets),
+			Started: time.Now(),
+		},
+		done:    make(chan struct{}),
+		wechat:  wechat,
+		tmpl:    tmpl,
+		targets: targets,
+		spec:    spec,
+	}
+
+	go job.run(ctx)
+
+	return job, nil
+}
+
+func (wechat *WeChat) broadcastTargets(spec BroadcastSpec) []*Contact {
+
+	var targets []*Contact
+	seen := make(map[string]bool)
+
+	add := func(c *Contact) {
+		if c == nil || seen[c.UserName] {
+			return
+		}
+		seen[c.UserName] = true
+		targets = append(targets, c)
+	}
+
+	for _, un := range append(append([]string{}, spec.UserNames...), spec.Groups...) {
+		c := wechat.cache.snapshot(un)
+		if c == nil {
+			c = &Contact{UserName: un}
+		}
+		add(c)
+	}
+
+	if spec.Filter != nil {
+		for _, c := range wechat.Query().Where(spec.Filter).All() {
+			add(c)
+		}
+	}
+
+	return targets
+}
+
+func (job *BroadcastJob) run(ctx context.Context) {
+
+	defer close(job.done)
+
+	for i := 0; i < len(job.targets); {
+
+		c := job.targets[i]
+		result := &BroadcastResult{Contact: c}
+
+		if result.Err = job.waitIfPaused(ctx); result.Err == nil {
+			var buffer bytes.Buffer
+			if result.Err = job.tmpl.Execute(&buffer, c); result.Err == nil {
+				msg := messages.NewTextMsg(buffer.String(), c.UserName)
+				result.Sent, result.Err = job.wechat.SendMsgWithPriority(ctx, msg, job.spec.Priority)
+			}
+		}
+
+		// 掉线了, 暂停, 恢复后重发这一条
+		if result.Err == ErrNotLogin {
+			logger.Warnf(`logged out, broadcast is paused at %d/%d`, i, len(job.targets))
+			job.Pause()
+			continue
+		}
+		i++
+
+		job.Lock()
+		job.report.Results = append(job.report.Results, result)
+		if result.Err == nil {
+			job.report.Succeeded++
+		} else {
+			job.report.Failed++
+			logger.Warnf(`broadcast to [%s] failed: %v`, c.UserName, result.Err)
+		}
+		job.Unlock()
+	}
+
+	job.Lock()
+	job.report.Finished = time.Now()
+	job.Unlock()
+}
+
+func (job *BroadcastJob) waitIfPaused(ctx context.Context) error {
+	job.Lock()
+	paused := job.paused
+	job.Unlock()
+
+	if paused == nil {
+		return ctx.Err()
+	}
+
+	select {
+	case <-paused:
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pause stop sending after the current message.
+func (job *BroadcastJob) Pause() {
+	job.Lock()
+	defer job.Unlock()
+	if job.paused == nil {
+		job.paused = make(chan struct{})
+	}
+}
+
+// Resume continue a paused broadcast.
+func (job *BroadcastJob) Resume() {
+	job.Lock()
+	defer job.Unlock()
+	if job.paused != nil {
+		close(job.paused)
+		job.paused = nil
+	}
+}
+
+// Paused reports whether the broadcast is paused.
+func (job *BroadcastJob) Paused() bool {
+	job.Lock()
+	defer job.Unlock()
+	return job.paused != nil
+}
+
+// Progress returns count of finished and all recipients.
+func (job *BroadcastJob) Progress() (finished, total int) {
+	job.Lock()
+	defer job.Unlock()
+	return len(job.report.Results), job.report.Total
+}
+
+// Wait block until all recipients are done and returns the report.
+func (job *BroadcastJob) Wait() *BroadcastReport {
+	<-job.done
+	return job.report
+}
@@ -0,0 +1,179 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// broadcastServer accept sent messages, before answers it calls hook with
+// the count of received ones.
+type broadcastServer struct {
+	sync.Mutex
+	contents []string
+	hook     func(n int)
+}
+
+func (s *broadcastServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct{ Msg map[string]interface{} }
+	json.NewDecoder(r.Body).Decode(&body)
+
+	s.Lock()
+	s.contents = append(s.contents, body.Msg[`ToUserName`].(string)+`:`+body.Msg[`Content`].(string))
+	n := len(s.contents)
+	s.Unlock()
+
+	if s.hook != nil {
+		s.hook(n)
+	}
+	w.Write([]byte(`{"BaseResponse":{"Ret":0},"MsgID":"1","LocalID":"1"}`))
+}
+
+func (s *broadcastServer) received() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.contents...)
+}
+
+func newBroadcastTestBot(t *testing.T, s *broadcastServer) (*WeChat, func()) {
+	wechat, done := newServerTestBot(t, s)
+	for _, v := range []map[string]interface{}{
+		{`UserName`: `@a`, `NickName`: `甲`, `Type`: Friend},
+		{`UserName`: `@b`, `NickName`: `乙`, `RemarkName`: `老乙`, `Type`: Friend},
+		{`UserName`: `@c`, `NickName`: `丙`, `Type`: Friend},
+		{`UserName`: `@m`, `NickName`: `成员`, `Type`: Member},
+	} {
+		wechat.cache.updateContact(v)
+	}
+	wechat.sendQueue = newSendQueue(wechat.conf)
+	wechat.setLogin(true)
+	go wechat.runSendQueue()
+	return wechat, func() {
+		wechat.setLogin(false)
+		done()
+	}
+}
+
+var testBroadcastSpec = BroadcastSpec{
+	Filter:   func(c *Contact) bool { return c.IsFriend() },
+	Template: `{{if .RemarkName}}{{.RemarkName}}{{else}}{{.NickName}}{{end}}, 你好`,
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(`timeout waiting for %s`, what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBroadcastReport(t *testing.T) {
+
+	s := &broadcastServer{}
+	wechat, done := newBroadcastTestBot(t, s)
+	defer done()
+
+	spec := testBroadcastSpec
+	spec.UserNames = []string{`@a`, `@x`}
+	spec.Template = `{{.NickName}}{{.Province}}`
+	report, err := wechat.Broadcast(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Total != 4 || report.Succeeded != 4 || report.Failed != 0 || len(report.Results) != 4 {
+		t.Fatalf(`report = %+v`, report)
+	}
+	want := []string{`@a:甲`, `@x:`, `@b:乙`, `@c:丙`}
+	got := s.received()
+	for i := range want {
+		if i >= len(got) || got[i] != want[i] {
+			t.Fatalf(`sent %v, want %v`, got, want)
+		}
+	}
+	if report.Finished.Before(report.Started) {
+		t.Errorf(`finished %v before started %v`, report.Finished, report.Started)
+	}
+
+	// 结果里是发送时的副本
+	report.Results[0].Contact.NickName = `改了`
+	if c := wechat.ContactByUserName(`@a`); c.NickName != `甲` {
+		t.Errorf(`contact in cache is shared with report: %s`, c.NickName)
+	}
+
+	if _, err = wechat.Broadcast(context.Background(), BroadcastSpec{Filter: func(*Contact) bool { return false }}); err == nil {
+		t.Error(`broadcast to nobody`)
+	}
+}
+
+func TestBroadcastPauseResume(t *testing.T) {
+
+	proceed := make(chan struct{})
+	s := &broadcastServer{}
+	s.hook = func(n int) {
+		if n == 1 {
+			<-proceed
+		}
+	}
+	wechat, done := newBroadcastTestBot(t, s)
+	defer done()
+
+	job, err := wechat.StartBroadcast(context.Background(), testBroadcastSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitUntil(t, `first message`, func() bool { return len(s.received()) == 1 })
+	job.Pause()
+	close(proceed)
+
+	waitUntil(t, `first result`, func() bool { finished, _ := job.Progress(); return finished == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if finished, total := job.Progress(); finished != 1 || total != 3 || !job.Paused() {
+		t.Fatalf(`paused job sent %d/%d`, finished, total)
+	}
+
+	job.Resume()
+	report := job.Wait()
+	if report.Succeeded != 3 || len(s.received()) != 3 {
+		t.Fatalf(`resumed job: %+v, sent %v`, report, s.received())
+	}
+}
+
+func TestBroadcastPausedByLogout(t *testing.T) {
+
+	var wechat *WeChat
+	s := &broadcastServer{}
+	s.hook = func(n int) {
+		if n == 1 {
+			wechat.setLogin(false)
+		}
+	}
+	wechat, done := newBroadcastTestBot(t, s)
+	defer done()
+
+	job, err := wechat.StartBroadcast(context.Background(), testBroadcastSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitUntil(t, `pause on logout`, job.Paused)
+	if finished, _ := job.Progress(); finished != 1 {
+		t.Fatalf(`%d result(s) after logout`, finished)
+	}
+
+	wechat.setLogin(true)
+	job.Resume()
+	report := job.Wait()
+	if report.Succeeded != 3 || report.Failed != 0 {
+		t.Fatalf(`report after re-login = %+v`, report)
+	}
+	if got := s.received(); len(got) != 3 || got[1] != `@b:老乙, 你好` {
+		t.Fatalf(`sent %v`, got)
+	}
+}
@@ -5,7 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
 	"sync"
+	"time"
 )
 
 type cache contactCache
@@ -13,10 +17,17 @@ type cache contactCache
 type contactCache struct {
 	sync.Mutex
 	contacts map[string]*Contact
+	index    contactIndex
+	ids      map[ContactID]string // ContactID => UserName
+	dirty    bool                 // changed since last flush
 }
 
+// contactSaveInterval is how often the contact cache is written if it changed.
+var contactSaveInterval = 2 * time.Second
+
 // Contact is wx Account struct
 type Contact struct {
+	Uin             int64
 	UserName        string
 	NickName        string
 	HeadImgURL      string `json:"HeadImgUrl"`
@@ -34,7 +45,17 @@ type Contact struct {
 	Alias           string
 	EncryChatRoomID string `json:"EncryChatRoomId"`
 	Type            int
+	MemberCount     int
 	MemberList      []*Contact
+
+	// name fields as wx server send, above ones are normalized
+	RawNickName    string `json:",omitempty"`
+	RawDisplayName string `json:",omitempty"`
+	RawRemarkName  string `json:",omitempty"`
+
+	// assigned identity if Uin and Alias are unknown, see ID()
+	StableID     ContactID `json:",omitempty"`
+	IDConfidence float64   `json:",omitempty"`
 }
 
 const (
@@ -48,11 +69,32 @@ const (
 	Member = 3
 	// FriendAndMember 即是好友也是群成员 ...
 	FriendAndMember = 4
+	// Special 文件传输助手 微信团队 这样的系统账号 ...
+	Special = 5
+	// Self 自己 ...
+	Self = 6
 )
 
 func newCache() *cache {
 	return &cache{
 		contacts: make(map[string]*Contact),
+		index:    newContactIndex(),
+		ids:      make(map[ContactID]string),
+	}
+}
+
+// indexContact must be called with lock held.
+func (c *cache) indexContact(ct *Contact) {
+	c.index.add(ct)
+	id, _ := ct.ID()
+	c.ids[id] = ct.UserName
+}
+
+// unindexContact must be called with lock held.
+func (c *cache) unindexContact(ct *Contact) {
+	c.index.remove(ct)
+	if id, _ := ct.ID(); c.ids[id] == ct.UserName {
+		delete(c.ids, id)
 	}
 }
 
@@ -62,23 +104,97 @@ func (c *cache) updateContact(v map[string]interface{}) {
 		logger.Errorf(`create contact failed error: %v`, err)
 	} else {
 		if len(nc.UserName) > 0 {
-			oc := c.contacts[nc.NickName]
-			if oc != nil {
-				logger.Info(`old contact: %v will be replaced by %v`, oc, nc)
-			}
-			c.contacts[nc.UserName] = nc
+			c.replaceContact(nc)
 		} else {
 			logger.Warningf(`bad contact %v`, v)
 		}
 	}
 }
 
+// replaceContact put nc into cache, it keeps ID of the one it replaces.
+func (c *cache) replaceContact(nc *Contact) {
+	if oc := c.contacts[nc.UserName]; oc != nil {
+		logger.Debugf(`old contact: %v will be replaced by %v`, oc.NickName, nc.NickName)
+		c.unindexContact(oc)
+		if len(nc.StableID) == 0 {
+			nc.StableID, nc.IDConfidence = oc.StableID, oc.IDConfidence
+		}
+	}
+	nc.assignID()
+	c.contacts[nc.UserName] = nc
+	c.indexContact(nc)
+	c.dirty = true
+}
+
+// mergeMember update cache with details of a group member. wx server returns
+// less of a friend fetched as member, so a friend only gets what it lacks.
+// Nothing is changed if the member is the same as the cached one.
+func (c *cache) mergeMember(v map[string]interface{}) {
+	nc, err := newContact(v)
+	if err != nil || len(nc.UserName) == 0 {
+		logger.Warningf(`bad member %v: %v`, v, err)
+		return
+	}
+
+	oc, found := c.contacts[nc.UserName]
+	if !found {
+		c.replaceContact(nc)
+		return
+	}
+
+	if oc.IsFriend() {
+		merged := oc.clone()
+		merged.Type = nc.Type
+		fillContact(merged, nc)
+		nc = merged
+	}
+	if len(nc.StableID) == 0 {
+		nc.StableID, nc.IDConfidence = oc.StableID, oc.IDConfidence
+	}
+	if reflect.DeepEqual(oc, nc) {
+		return
+	}
+	c.replaceContact(nc)
+}
+
+// fillContact copy fields of from which c lacks.
+func fillContact(c, from *Contact) {
+	fill := func(to *string, raw *string, v, rawV string) {
+		if len(*to) == 0 {
+			*to = v
+			if raw != nil {
+				*raw = rawV
+			}
+		}
+	}
+	fill(&c.NickName, &c.RawNickName, from.NickName, from.RawNickName)
+	fill(&c.DisplayName, &c.RawDisplayName, from.DisplayName, from.RawDisplayName)
+	fill(&c.HeadImgURL, nil, from.HeadImgURL, ``)
+	fill(&c.HeadHash, nil, from.HeadHash, ``)
+	fill(&c.Signature, nil, from.Signature, ``)
+	fill(&c.Province, nil, from.Province, ``)
+	fill(&c.City, nil, from.City, ``)
+	fill(&c.Alias, nil, from.Alias, ``)
+	if c.Uin == 0 {
+		c.Uin = from.Uin
+	}
+	if c.Sex == 0 {
+		c.Sex = from.Sex
+	}
+}
+
 func (c *cache) clearContactBy(username string) {
+	if oc, found := c.contacts[username]; found {
+		c.unindexContact(oc)
+	}
 	delete(c.contacts, username)
+	c.dirty = true
 }
 
 func (c *cache) clear() {
 	c.contacts = make(map[string]*Contact)
+	c.index = newContactIndex()
+	c.ids = make(map[ContactID]string)
 }
 
 func (wechat *WeChat) syncContacts(cts []map[string]interface{}) {
@@ -87,10 +203,19 @@ func (wechat *WeChat) syncContacts(cts []map[string]interface{}) {
 
 	logger.Debugf(`count of contact [contain group member]: [%d]`, len(cts))
 
+	olds := wechat.cache.contacts
+	wechat.cache.clear()
+
 	for _, v := range cts {
 		wechat.cache.updateContact(v)
 	}
 
+	// 和上次缓存的通讯录对比, 重新登录后 UserName 会变, 按 ContactID 对应
+	if len(olds) > 0 {
+		mapping := wechat.remapContacts(olds, wechat.cache.contacts)
+		wechat.emitContactDiff(olds, wechat.cache.contacts, mapping)
+	}
+
 	var buffer bytes.Buffer
 	for _, c := range wechat.cache.contacts {
 		des := "[群成员]"
@@ -100,9 +225,13 @@ func (wechat *WeChat) syncContacts(cts []map[string]interface{}) {
 			des = "[好友]"
 		} else if c.Type == Offical {
 			des = "[公众号]"
+		} else if c.Type == Special {
+			des = "[系统账号]"
+		} else if c.Type == Group {
+			des = "[群]"
 		}
 		buffer.WriteString(des)
-		buffer.WriteString(fmt.Sprintf(" %v", replaceEmoji(c.NickName)))
+		buffer.WriteString(fmt.Sprintf(" %v", c.NickName))
 		buffer.WriteString(fmt.Sprintf(" [Sex: %v", c.Sex))
 		buffer.WriteString(fmt.Sprintf(" City: %v]", c.City))
 		buffer.WriteString("\n")
@@ -110,6 +239,147 @@ func (wechat *WeChat) syncContacts(cts []map[string]interface{}) {
 	logger.Debug(buffer.String())
 }
 
+// emitContactDiff emit add, mod and del events between two snapshots,
+// mapping pair old UserName to new UserName. Group members are not compared,
+// they are many and only identified once matched, join and leave events of
+// groups tell about them.
+func (wechat *WeChat) emitContactDiff(olds, news map[string]*Contact, mapping map[string]string) {
+
+	var emits []func()
+	matched := make(map[string]bool)
+	for un, oc := range olds {
+		if oc.Type == Member {
+			continue
+		}
+		nun, found := mapping[un]
+		if !found {
+			nun = un
+		}
+		oc := *oc
+		nc, found := news[nun]
+		if !found || nc.Type == Member {
+			emits = append(emits, func() { wechat.evtStream.emitContactChangeEvent(oc, Delete) })
+			continue
+		}
+		matched[nun] = true
+		if !sameContact(&oc, nc) {
+			nc := *nc
+			emits = append(emits, func() { wechat.evtStream.emitContactModEvent(oc, nc) })
+		}
+	}
+	for un, nc := range news {
+		if !matched[un] && nc.Type != Member {
+			nc := *nc
+			emits = append(emits, func() { wechat.evtStream.emitContactChangeEvent(nc, Add) })
+		}
+	}
+
+	// 一个 goroutine 依次发出, 不要每个事件一个
+	if len(emits) > 0 {
+		go func() {
+			for _, emit := range emits {
+				emit()
+			}
+		}()
+	}
+}
+
+func sameContact(a, b *Contact) bool {
+	return a.NickName == b.NickName &&
+		a.RemarkName == b.RemarkName &&
+		a.DisplayName == b.DisplayName &&
+		a.Signature == b.Signature &&
+		!avatarChanged(a, b) &&
+		a.StarFriend == b.StarFriend &&
+		a.ContactFlag == b.ContactFlag &&
+		a.Type == b.Type &&
+		a.MemberCount == b.MemberCount
+}
+
+// kinds of contact change in the order of diffContact, `/contact/mod/<kind>` is
+// emitted for the first one, see emitContactModEvent
+const (
+	ContactRenamed          = `renamed`
+	ContactRemarkChanged    = `remark`
+	ContactAvatarChanged    = `avatar`
+	ContactSignatureChanged = `signature`
+	ContactStarred          = `starred`
+	ContactUnstarred        = `unstarred`
+	ContactPinned           = `pinned`
+	ContactUnpinned         = `unpinned`
+	// DisplayName of a member in group
+	ContactDisplayNameChanged = `displayname`
+	// a friend deleted, emitted as `/contact/del/unfriended` instead
+	ContactUnfriended = `unfriended`
+)
+
+// diffContact returns kinds of change from a to b.
+func diffContact(a, b *Contact) []string {
+	var changes []string
+	if a.NickName != b.NickName {
+		changes = append(changes, ContactRenamed)
+	}
+	if a.RemarkName != b.RemarkName {
+		changes = append(changes, ContactRemarkChanged)
+	}
+	if a.DisplayName != b.DisplayName {
+		changes = append(changes, ContactDisplayNameChanged)
+	}
+	if avatarChanged(a, b) {
+		changes = append(changes, ContactAvatarChanged)
+	}
+	if a.Signature != b.Signature {
+		changes = append(changes, ContactSignatureChanged)
+	}
+	if a.StarFriend == 0 && b.StarFriend != 0 {
+		changes = append(changes, ContactStarred)
+	} else if a.StarFriend != 0 && b.StarFriend == 0 {
+		changes = append(changes, ContactUnstarred)
+	}
+	if top := int(a.ContactFlag) & contactFlagTop; top != int(b.ContactFlag)&contactFlagTop {
+		if top == 0 {
+			changes = append(changes, ContactPinned)
+		} else {
+			changes = append(changes, ContactUnpinned)
+		}
+	}
+	return changes
+}
+
+// HeadImgUrl contains UserName and skey which change every session,
+// only HeadHash and seq tell whether avatar is changed.
+func avatarChanged(a, b *Contact) bool {
+	if len(a.HeadHash) > 0 || len(b.HeadHash) > 0 {
+		return a.HeadHash != b.HeadHash
+	}
+	return headImgSeq(a.HeadImgURL) != headImgSeq(b.HeadImgURL)
+}
+
+func headImgSeq(headImgURL string) string {
+	u, err := url.Parse(headImgURL)
+	if err != nil {
+		return headImgURL
+	}
+	return u.Query().Get(`seq`)
+}
+
+// clone returns a copy of contact, MemberList is copied too but not its members.
+func (c *Contact) clone() *Contact {
+	cp := *c
+	cp.MemberList = append([]*Contact(nil), c.MemberList...)
+	return &cp
+}
+
+// snapshot returns a copy of cached contact or nil.
+func (c *cache) snapshot(un string) *Contact {
+	c.Lock()
+	defer c.Unlock()
+	if contact, found := c.contacts[un]; found {
+		return contact.clone()
+	}
+	return nil
+}
+
 // 修改在这里处理
 func (wechat *WeChat) appendContacts(cts []map[string]interface{}) {
 	wechat.cache.Lock()
@@ -120,6 +390,16 @@ func (wechat *WeChat) appendContacts(cts []map[string]interface{}) {
 	}
 }
 
+// mergeMembers put details of group members into cache, see mergeMember.
+func (wechat *WeChat) mergeMembers(cts []map[string]interface{}) {
+	wechat.cache.Lock()
+	defer wechat.cache.Unlock()
+
+	for _, v := range cts {
+		wechat.cache.mergeMember(v)
+	}
+}
+
 func (wechat *WeChat) removeContact(username string) {
 	wechat.cache.Lock()
 	wechat.cache.clearContactBy(username)
@@ -142,5 +422,172 @@ func newContact(m map[string]interface{}) (*Contact, error) {
 	}
 	var c *Contact
 	err = json.Unmarshal(data, &c)
+	if err == nil && c != nil {
+		c.normalize()
+	}
 	return c, err
 }
+
+// normalize convert html in names to plain text, keep the raw ones.
+// a contact restored from cache is already normalized.
+func (c *Contact) normalize() {
+	if len(c.RawNickName) == 0 {
+		c.RawNickName, c.NickName = c.NickName, normalizeText(c.NickName)
+		c.Signature = normalizeText(c.Signature)
+	}
+	if len(c.RawDisplayName) == 0 {
+		c.RawDisplayName, c.DisplayName = c.DisplayName, normalizeText(c.DisplayName)
+	}
+	if len(c.RawRemarkName) == 0 {
+		c.RawRemarkName, c.RemarkName = c.RemarkName, normalizeText(c.RemarkName)
+	}
+	for _, m := range c.MemberList {
+		m.normalize()
+	}
+}
+
+// sessionMapping pair contacts cached by last session with cts just fetched,
+// old UserName => new UserName.
+func (c *cache) sessionMapping(cts []map[string]interface{}) map[string]string {
+
+	news := make(map[string]*Contact, len(cts))
+	for _, v := range cts {
+		if nc, err := newContact(v); err == nil && nc != nil && len(nc.UserName) > 0 {
+			news[nc.UserName] = nc
+		}
+	}
+
+	c.Lock()
+	matches, _ := matchContacts(c.contacts, news)
+	c.Unlock()
+
+	mapping := make(map[string]string, len(matches))
+	for _, m := range matches {
+		mapping[m.old.UserName] = m.new.UserName
+	}
+	return mapping
+}
+
+// unchangedGroup returns cached group as raw map if its member count is not changed.
+// The cache may be saved by last session, old is the UserName of group then,
+// UserNames of members are rewritten by mapping, members can't be mapped,
+// e.g. strangers, are dropped and their count is returned, the group should
+// be fetched later for them. Fields of v, the group just fetched, are kept.
+func (c *cache) unchangedGroup(v map[string]interface{}, old string, mapping map[string]string, self string) (map[string]interface{}, int) {
+	c.Lock()
+	defer c.Unlock()
+
+	un, _ := v[`UserName`].(string)
+	mc, _ := v[`MemberCount`].(float64)
+	memberCount := int(mc)
+
+	group, found := c.contacts[old]
+	if !found || memberCount == 0 || group.MemberCount != memberCount || len(group.MemberList) != memberCount {
+		return nil, 0
+	}
+
+	cached := contactToMap(group)
+	if cached == nil {
+		return nil, 0
+	}
+
+	dropped := 0
+	if un != old {
+		members, _ := cached[`MemberList`].([]interface{})
+		kept := make([]interface{}, 0, len(members))
+		for _, m := range members {
+			member, _ := m.(map[string]interface{})
+			mun, _ := member[`UserName`].(string)
+			nun, found := mapping[mun]
+			if oc := c.contacts[mun]; !found && oc != nil && oc.Type == Self {
+				nun, found = self, true
+			}
+			if !found {
+				dropped++
+				continue
+			}
+			member[`UserName`] = nun
+			kept = append(kept, member)
+		}
+		cached[`MemberList`] = kept
+		if dropped > 0 {
+			logger.Debugf(`%d member(s) of group [%s] are unknown in this session`, dropped, group.NickName)
+		}
+	}
+
+	// 服务器给的名字是原始的, 要重新转换
+	for k, raw := range map[string]string{`NickName`: `RawNickName`, `DisplayName`: `RawDisplayName`, `RemarkName`: `RawRemarkName`} {
+		if _, found := v[k]; found {
+			delete(cached, raw)
+		}
+	}
+	for k, fv := range v {
+		if k != `MemberList` {
+			cached[k] = fv
+		}
+	}
+
+	return cached, dropped
+}
+
+// contactToMap convert contact to the raw form wx server send, nil if failed.
+func contactToMap(c *Contact) map[string]interface{} {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	return m
+}
+
+// flush write all contacts to path if they changed, the file is written
+// without lock held.
+func (c *cache) flush(path string) {
+	c.Lock()
+	if !c.dirty {
+		c.Unlock()
+		return
+	}
+	c.dirty = false
+	data, err := json.Marshal(c.contacts)
+	c.Unlock()
+
+	if err != nil {
+		logger.Warnf(`save contact cache failed: %v`, err)
+		return
+	}
+	createFile(path, data, false)
+}
+
+// runCacheSaver save contacts periodically instead of on every change.
+func (wechat *WeChat) runCacheSaver() {
+	for range time.Tick(contactSaveInterval) {
+		wechat.cache.flush(wechat.conf.contactCachePath())
+	}
+}
+
+// load restore contacts saved by last run.
+func (c *cache) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	contacts := make(map[string]*Contact)
+	if err = json.Unmarshal(data, &contacts); err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.clear()
+	for _, ct := range contacts {
+		c.contacts[ct.UserName] = ct
+		c.indexContact(ct)
+	}
+	c.Unlock()
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package wechat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnchangedGroupAfterRelogin(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `cache`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, `contact-cache.json`)
+
+	// saved by last session
+	last := newCache()
+	for _, v := range []map[string]interface{}{
+		{`UserName`: `@oa`, `NickName`: `Alice`, `RemarkName`: `阿丽`, `Type`: Friend},
+		{`UserName`: `@ome`, `NickName`: `me`, `Type`: Self},
+		{`UserName`: `@@og`, `NickName`: `爬山`, `MemberCount`: 2, `Type`: Group, `MemberList`: []interface{}{
+			map[string]interface{}{`UserName`: `@oa`, `NickName`: `Alice`},
+			map[string]interface{}{`UserName`: `@ome`, `NickName`: `me`},
+		}},
+		{`UserName`: `@@ox`, `NickName`: `陌生人`, `MemberCount`: 2, `Type`: Group, `MemberList`: []interface{}{
+			map[string]interface{}{`UserName`: `@oa`, `NickName`: `Alice`},
+			map[string]interface{}{`UserName`: `@ostranger`, `NickName`: `stranger`},
+		}},
+	} {
+		last.updateContact(v)
+	}
+	last.flush(path)
+
+	c := newCache()
+	if err = c.load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// this session, webwxgetcontact returns groups without members
+	cts := []map[string]interface{}{
+		{`UserName`: `@na`, `NickName`: `Alice`, `RemarkName`: `阿丽`},
+		{`UserName`: `@@ng`, `NickName`: `爬山`, `MemberCount`: 2.0, `HeadImgUrl`: `/cgi-bin/mmwebwx-bin/webwxgetheadimg?username=@@ng`},
+		{`UserName`: `@@nx`, `NickName`: `陌生人`, `MemberCount`: 2.0},
+	}
+
+	mapping := c.sessionMapping(cts)
+	previous := make(map[string]string)
+	for o, n := range mapping {
+		previous[n] = o
+	}
+	if previous[`@@ng`] != `@@og` || previous[`@na`] != `@oa` {
+		t.Fatalf(`mapping = %v`, mapping)
+	}
+
+	group, dropped := c.unchangedGroup(cts[1], previous[`@@ng`], mapping, `@nme`)
+	if group == nil || dropped != 0 {
+		t.Fatal(`group of last session is not reused`)
+	}
+	if group[`UserName`] != `@@ng` || group[`HeadImgUrl`] != cts[1][`HeadImgUrl`] {
+		t.Errorf(`reused group is not updated: %v %v`, group[`UserName`], group[`HeadImgUrl`])
+	}
+	var members []string
+	for _, m := range group[`MemberList`].([]interface{}) {
+		members = append(members, m.(map[string]interface{})[`UserName`].(string))
+	}
+	if len(members) != 2 || members[0] != `@na` || members[1] != `@nme` {
+		t.Errorf(`members of reused group = %v`, members)
+	}
+
+	// stranger is unknown until the group is fetched, the others are kept
+	group, dropped = c.unchangedGroup(cts[2], previous[`@@nx`], mapping, `@nme`)
+	if group == nil || dropped != 1 {
+		t.Fatalf(`group with a stranger: %v, %d dropped`, group, dropped)
+	}
+	if members := group[`MemberList`].([]interface{}); len(members) != 1 || members[0].(map[string]interface{})[`UserName`] != `@na` {
+		t.Errorf(`members of group with a stranger = %v`, members)
+	}
+
+	// same session
+	if group, _ := c.unchangedGroup(map[string]interface{}{`UserName`: `@@og`, `MemberCount`: 2.0}, `@@og`, nil, `@ome`); group == nil {
+		t.Error(`group of same session is not reused`)
+	}
+
+	// renamed with an emoji, the name from server is converted again
+	renamed := map[string]interface{}{`UserName`: `@@ng`, `NickName`: `爬山<span class="emoji emoji1f3d4"></span>`, `MemberCount`: 2.0}
+	group, _ = c.unchangedGroup(renamed, previous[`@@ng`], mapping, `@nme`)
+	nc, err := newContact(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nc.NickName != `爬山🏔` || nc.RawNickName != renamed[`NickName`] {
+		t.Errorf(`renamed group: NickName %q, RawNickName %q`, nc.NickName, nc.RawNickName)
+	}
+}
+
+func TestDiffContact(t *testing.T) {
+	old := &Contact{UserName: `@a`, NickName: `Tom`, DisplayName: `汤姆`}
+	nc := old.clone()
+	nc.DisplayName = `老汤`
+	if changes := diffContact(old, nc); len(changes) != 1 || changes[0] != ContactDisplayNameChanged {
+		t.Errorf(`DisplayName change = %v`, changes)
+	}
+	nc.NickName = `Tommy`
+	if changes := diffContact(old, nc); len(changes) != 2 || changes[0] != ContactRenamed {
+		t.Errorf(`NickName and DisplayName change = %v`, changes)
+	}
+}
+
+func TestUnfriendedEvent(t *testing.T) {
+	es := newEvtStream()
+
+	es.emitContactChangeEvent(Contact{UserName: `@a`, Type: FriendAndMember}, Delete)
+	evt := <-es.serverEvt
+	data := evt.Data.(EventContactData)
+	if evt.Path != `/contact/del/unfriended` || len(data.Changes) != 1 || data.Changes[0] != ContactUnfriended || data.Old == nil {
+		t.Errorf(`delete friend emits %s %v`, evt.Path, data.Changes)
+	}
+
+	es.emitContactChangeEvent(Contact{UserName: `@@g`, Type: Group}, Delete)
+	if evt = <-es.serverEvt; evt.Path != `/contact/del` {
+		t.Errorf(`delete group emits %s`, evt.Path)
+	}
+}
+
+func TestContactDiffSkipsMembers(t *testing.T) {
+
+	wechat := &WeChat{evtStream: newEvtStream()}
+	olds := map[string]*Contact{
+		`@a`: {UserName: `@a`, NickName: `甲`, Type: Friend},
+		`@m`: {UserName: `@m`, NickName: `成员`, Type: Member},
+	}
+	news := map[string]*Contact{
+		`@a2`: {UserName: `@a2`, NickName: `甲`, Type: Friend},
+		`@m2`: {UserName: `@m2`, NickName: `成员`, Type: Member},
+	}
+	wechat.emitContactDiff(olds, news, map[string]string{`@a`: `@a2`})
+
+	if paths := drainGroupEvents(wechat.evtStream); len(paths) != 0 {
+		t.Fatalf(`unmatched members emit %v`, paths)
+	}
+}
+
+func TestContactModEvent(t *testing.T) {
+
+	es := newEvtStream()
+	old := Contact{UserName: `@a`, NickName: `甲`, MemberCount: 2}
+
+	events := func() []Event {
+		var evts []Event
+		for {
+			select {
+			case evt := <-es.serverEvt:
+				evts = append(evts, evt)
+			case <-time.After(50 * time.Millisecond):
+				return evts
+			}
+		}
+	}
+
+	c := old
+	c.NickName, c.RemarkName = `乙`, `老乙`
+	go es.emitContactModEvent(old, c)
+	if evts := events(); len(evts) != 1 || evts[0].Path != `/contact/mod/`+ContactRenamed ||
+		len(evts[0].Data.(EventContactData).Changes) != 2 {
+		t.Errorf(`rename and remark emit %v`, evts)
+	}
+
+	// 自己改名后同步回来的
+	go es.emitContactModEvent(old, old)
+	if evts := events(); len(evts) != 0 {
+		t.Errorf(`no change emits %v`, evts)
+	}
+
+	c = old
+	c.MemberCount = 3
+	go es.emitContactModEvent(old, c)
+	if evts := events(); len(evts) != 1 || evts[0].Path != `/contact/mod` {
+		t.Errorf(`unknown change emits %v`, evts)
+	}
+}
@@ -0,0 +1,199 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// GroupInvited is the route of `/group/<group UserName>/invited`, emitted for
+// members who are sent an invitation but not joined yet.
+const GroupInvited = `/invited`
+
+type createChatRoomRequest struct {
+	BaseRequest *BaseRequest
+	MemberCount int
+	MemberList  []map[string]string
+	Topic       string
+}
+
+type createChatRoomResponse struct {
+	Response
+	ChatRoomName string
+	MemberCount  int
+	MemberList   []struct {
+		UserName     string
+		MemberStatus int
+	}
+}
+
+// CreateGroup create a group with members, members are UserName of friends,
+// wx server requires at least 2 of them.
+func (wechat *WeChat) CreateGroup(ctx context.Context, topic string, members []string) (*Contact, error) {
+
+	if len(members) < 2 {
+		return nil, errors.New(`at least 2 members are required to create group`)
+	}
+
+	req := createChatRoomRequest{
+		BaseRequest: wechat.BaseRequest,
+		MemberCount: len(members),
+		Topic:       topic,
+	}
+	for _, un := range members {
+		req.MemberList = append(req.MemberList, map[string]string{`UserName`: un})
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	urlPath := fmt.Sprintf(`%s/webwxcreatechatroom?r=%s&%s`, wechat.BaseURL, now(), wechat.PassTicketKV())
+	resp := new(createChatRoomResponse)
+
+	if err = wechat.ExecuteContext(ctx, urlPath, bytes.NewReader(data), resp); err != nil {
+		return nil, err
+	}
+	if len(resp.ChatRoomName) == 0 {
+		return nil, errors.New(`create group failed, no ChatRoomName returned`)
+	}
+
+	for _, m := range resp.MemberList {
+		// 非 0 是被拉黑或者已经删除了自己的好友, 不会进群
+		if m.MemberStatus != 0 {
+			logger.Warnf(`[%s] is not added to group [%s], member status: %d`, m.UserName, topic, m.MemberStatus)
+		}
+	}
+
+	if err = wechat.refreshGroup(ctx, resp.ChatRoomName); err != nil {
+		return nil, fmt.Errorf(`group [%s] is created but can't be loaded: %v`, resp.ChatRoomName, err)
+	}
+
+	group := wechat.cache.snapshot(resp.ChatRoomName)
+	if group == nil {
+		return nil, fmt.Errorf(`group [%s] is created but can't be loaded`, resp.ChatRoomName)
+	}
+	go wechat.evtStream.emitContactChangeEvent(*group, Add)
+
+	return group, nil
+}
+
+// AddGroupMembers add friends to group directly, only works for small groups,
+// large ones need InviteGroupMembers.
+func (wechat *WeChat) AddGroupMembers(ctx context.Context, groupUserName string, members []string) error {
+	return wechat.updateGroupMembers(ctx, groupUserName, `addmember`, `AddMemberList`, members, GroupJoinInvite, true)
+}
+
+// InviteGroupMembers send group invitation to friends, they join after accepting it,
+// `/group/<group UserName>/invited` is emitted for each of them.
+func (wechat *WeChat) InviteGroupMembers(ctx context.Context, groupUserName string, members []string) error {
+
+	if err := wechat.updateGroupMembers(ctx, groupUserName, `invitemember`, `InviteMemberList`, members, ``, true); err != nil {
+		return err
+	}
+
+	group := wechat.cache.snapshot(groupUserName)
+	if group == nil {
+		group = &Contact{UserName: groupUserName}
+	}
+	for _, un := range members {
+		member := wechat.ContactByUserName(un)
+		if member == nil {
+			member = &Contact{UserName: un}
+		}
+		wechat.emitGroupEvent(group, GroupInvited, EventGroupMemberData{
+			Group:   *group,
+			Member:  *member,
+			Inviter: wechat.myselfCopy(),
+			Method:  GroupJoinInvite,
+		})
+	}
+
+	return nil
+}
+
+// RemoveGroupMembers remove members from group, only group owner can do this.
+func (wechat *WeChat) RemoveGroupMembers(ctx context.Context, groupUserName string, members []string) error {
+	return wechat.updateGroupMembers(ctx, groupUserName, `delmember`, `DelMemberList`, members, GroupLeaveRemoved, false)
+}
+
+// RenameGroup change topic of group, `/contact/mod/renamed` is emitted.
+// An error is returned if the topic is changed but the group can't be reloaded.
+func (wechat *WeChat) RenameGroup(ctx context.Context, groupUserName, topic string) error {
+
+	old := wechat.cache.snapshot(groupUserName)
+
+	if err := wechat.updateChatRoom(ctx, `modtopic`, map[string]interface{}{
+		`ChatRoomName`: groupUserName,
+		`NewTopic`:     topic,
+	}); err != nil {
+		return err
+	}
+
+	if err := wechat.refreshGroup(ctx, groupUserName); err != nil {
+		return fmt.Errorf(`group [%s] is renamed but can't be reloaded: %v`, groupUserName, err)
+	}
+
+	if group := wechat.cache.snapshot(groupUserName); old != nil && group != nil {
+		go wechat.evtStream.emitContactModEvent(*old, *group)
+	}
+
+	return nil
+}
+
+// updateGroupMembers post member changes, then refresh group so the cache is updated
+// and join or leave events are emitted with method, inviter is myself.
+// An error is returned if members are changed but the group can't be reloaded.
+func (wechat *WeChat) updateGroupMembers(ctx context.Context, groupUserName, fun, field string, members []string, method string, join bool) error {
+
+	if len(members) == 0 {
+		return errors.New(`no member given`)
+	}
+
+	if err := wechat.updateChatRoom(ctx, fun, map[string]interface{}{
+		`ChatRoomName`: groupUserName,
+		field:          strings.Join(members, `,`),
+	}); err != nil {
+		return err
+	}
+
+	if len(method) > 0 {
+		var hints []*groupMemberHint
+		for _, un := range members {
+			hints = append(hints, &groupMemberHint{userName: un, method: method, join: join})
+		}
+		wechat.addGroupHints(groupUserName, hints)
+	}
+
+	// 没刷新成功的, 提示留给下次刷新群时用
+	if err := wechat.refreshGroup(ctx, groupUserName); err != nil {
+		return fmt.Errorf(`members of group [%s] are changed but can't be reloaded: %v`, groupUserName, err)
+	}
+	wechat.flushGroupHints(groupUserName)
+
+	return nil
+}
+
+func (wechat *WeChat) updateChatRoom(ctx context.Context, fun string, body map[string]interface{}) error {
+
+	body[`BaseRequest`] = wechat.BaseRequest
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	urlPath := fmt.Sprintf(`%s/webwxupdatechatroom?fun=%s&%s`, wechat.BaseURL, fun, wechat.PassTicketKV())
+	resp := new(Response)
+
+	return wechat.ExecuteContext(ctx, urlPath, bytes.NewReader(data), resp)
+}
+
+func (wechat *WeChat) myselfCopy() *Contact {
+	me := wechat.MySelf
+	return &me
+}
@@ -0,0 +1,163 @@
+package wechat
+
+import "strings"
+
+// ContactKind is a finer classification of contact than Type.
+type ContactKind int
+
+const (
+	// KindFriend 好友
+	KindFriend ContactKind = iota
+	// KindGroup 群
+	KindGroup
+	// KindMember 群成员, 不是好友
+	KindMember
+	// KindOfficial 订阅号
+	KindOfficial
+	// KindService 服务号
+	KindService
+	// KindEnterprise 企业号
+	KindEnterprise
+	// KindSpecial 文件传输助手, 微信团队 这样的系统账号
+	KindSpecial
+	// KindSelf 自己
+	KindSelf
+	// KindBlocked 黑名单中的联系人
+	KindBlocked
+)
+
+func (k ContactKind) String() string {
+	switch k {
+	case KindFriend:
+		return `friend`
+	case KindGroup:
+		return `group`
+	case KindMember:
+		return `member`
+	case KindOfficial:
+		return `official`
+	case KindService:
+		return `service`
+	case KindEnterprise:
+		return `enterprise`
+	case KindSpecial:
+		return `special`
+	case KindSelf:
+		return `self`
+	case KindBlocked:
+		return `blocked`
+	}
+	return `unknow`
+}
+
+// VerifyFlag bits
+const (
+	verifyFlagBizBrand    = 8  // 公众号
+	verifyFlagBizVerified = 16 // 认证过的, 服务号
+	verifyFlagEnterprise  = 32 // 企业号
+)
+
+// ContactFlag bit of blocked contacts, see also contactFlagStar and contactFlagTop
+const contactFlagBlackList = 8
+
+// UserName of system accounts, they are not friends even in the contact list
+var specialUserNames = map[string]bool{
+	`newsapp`: true, `fmessage`: true, `filehelper`: true, `weibo`: true, `qqmail`: true,
+	`tmessage`: true, `qmessage`: true, `qqsync`: true, `floatbottle`: true, `lbsapp`: true,
+	`shakeapp`: true, `medianote`: true, `qqfriend`: true, `readerapp`: true, `blogapp`: true,
+	`facebookapp`: true, `masssendapp`: true, `meishiapp`: true, `feedsapp`: true, `voip`: true,
+	`blogappweixin`: true, `weixin`: true, `brandsessionholder`: true, `weixinreminder`: true,
+	`officialaccounts`: true, `notification_messages`: true, `wxitil`: true, `userexperience_alarm`: true,
+}
+
+func hasFlag(flags float64, flag int) bool {
+	return int(flags)&flag != 0
+}
+
+// contactType returns Type of a contact from webwxgetcontact or a sync,
+// members of groups are marked by the caller.
+func contactType(v map[string]interface{}, self string) int {
+
+	un, _ := v[`UserName`].(string)
+	vf, _ := v[`VerifyFlag`].(float64)
+
+	switch {
+	case un == self:
+		return Self
+	case strings.HasPrefix(un, `@@`):
+		return Group
+	case specialUserNames[un]:
+		return Special
+	case hasFlag(vf, verifyFlagBizBrand):
+		return Offical
+	}
+	return Friend
+}
+
+// Kind classify contact by Type, UserName, VerifyFlag and ContactFlag.
+func (contact *Contact) Kind() ContactKind {
+	switch {
+	case contact.IsSelf():
+		return KindSelf
+	case contact.IsBlocked():
+		return KindBlocked
+	case contact.IsGroup():
+		return KindGroup
+	case contact.IsSpecial():
+		return KindSpecial
+	case contact.IsEnterprise():
+		return KindEnterprise
+	case contact.IsService():
+		return KindService
+	case contact.IsOfficial():
+		return KindOfficial
+	case contact.Type == Member:
+		return KindMember
+	}
+	return KindFriend
+}
+
+// IsSelf 是自己
+func (contact *Contact) IsSelf() bool {
+	return contact.Type == Self
+}
+
+// IsFriend 是好友, 包括同时是群成员的
+func (contact *Contact) IsFriend() bool {
+	return (contact.Type == Friend || contact.Type == FriendAndMember) && !contact.IsBlocked()
+}
+
+// IsGroup 是群
+func (contact *Contact) IsGroup() bool {
+	return strings.HasPrefix(contact.UserName, `@@`)
+}
+
+// IsMember 是群成员, 包括同时是好友的
+func (contact *Contact) IsMember() bool {
+	return contact.Type == Member || contact.Type == FriendAndMember
+}
+
+// IsOfficial 是公众号, 包括服务号和企业号
+func (contact *Contact) IsOfficial() bool {
+	return hasFlag(contact.VerifyFlag, verifyFlagBizBrand)
+}
+
+// IsService 是服务号
+func (contact *Contact) IsService() bool {
+	return contact.IsOfficial() && hasFlag(contact.VerifyFlag, verifyFlagBizVerified)
+}
+
+// IsEnterprise 是企业号
+func (contact *Contact) IsEnterprise() bool {
+	return contact.IsOfficial() && hasFlag(contact.VerifyFlag, verifyFlagEnterprise)
+}
+
+// IsSpecial 是文件传输助手这样的系统账号
+func (contact *Contact) IsSpecial() bool {
+	return specialUserNames[contact.UserName]
+}
+
+// IsBlocked 在黑名单中
+func (contact *Contact) IsBlocked() bool {
+	return hasFlag(contact.ContactFlag, contactFlagBlackList)
+}
@@ -0,0 +1,72 @@
+package wechat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func loadFixture(t *testing.T, name string, v interface{}) {
+	data, err := ioutil.ReadFile(`testdata/` + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		t.Fatalf(`%s: %v`, name, err)
+	}
+}
+
+func TestContactKind(t *testing.T) {
+
+	var list getContactResponse
+	loadFixture(t, `webwxgetcontact.json`, &list)
+	var batch batchGetContactResponse
+	loadFixture(t, `webwxbatchgetcontact.json`, &batch)
+
+	self := `@0a9d4c7e2f5b1a83d6e0c9f4b2a7d5e1`
+	wechat := &WeChat{MySelf: Contact{UserName: self}}
+
+	cts := list.MemberList
+	for _, v := range cts {
+		v[`Type`] = contactType(v, self)
+	}
+	cts = wechat.mergeGroups(cts, batch.ContactList)
+
+	kinds := make(map[string]ContactKind)
+	for _, v := range cts {
+		c, err := newContact(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kinds[c.UserName] = c.Kind()
+	}
+
+	cases := []struct {
+		userName string
+		nickName string
+		kind     ContactKind
+	}{
+		{`@8f2c1e4a9b7d3f60a1c5e2b8d4f7a903`, `陈曦`, KindFriend}, // also a member
+		{`@5d0b7a3e91c4f2d86b3e0a7c5f1d9e24`, `拉黑的人`, KindBlocked},
+		{`@@3e9f0c2b7a5d4e18f6b2c9a0d3e7f1b58c4a6d2e0f9b3c7a1e5d8f2b4c6a0e9d`, `周末爬山`, KindGroup},
+		{`@b1e7c3a95f2d8e40c6a1b9d3f7e2c5a8`, `某某日报`, KindOfficial},
+		{`@e4a2d8f61b3c9e07a5d2f8b4c1e6a93d`, `某某银行`, KindService},
+		{`@7c5e1a3d9f2b8c46e0a7d3b1f5c9e2a4`, `某某公司`, KindEnterprise},
+		{`filehelper`, `文件传输助手`, KindSpecial},
+		{`weixin`, `微信团队`, KindSpecial},
+		{self, `我`, KindSelf},
+		{`@2f6b9d1e4a7c3f05b8e2d6a9c1f4b7e3`, `路人甲`, KindMember},
+	}
+
+	if len(kinds) != len(cases) {
+		t.Errorf(`%d contact(s) classified, want %d`, len(kinds), len(cases))
+	}
+	for _, c := range cases {
+		kind, found := kinds[c.userName]
+		if !found {
+			t.Errorf(`%s is missing`, c.nickName)
+		} else if kind != c.kind {
+			t.Errorf(`%s is %v, want %v`, c.nickName, kind, c.kind)
+		}
+	}
+}
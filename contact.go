@@ -1,14 +1,11 @@
 package wechat
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/url"
-	"strings"
-	"time"
+
+	"github.com/KevinGong2013/wechat/messages"
 )
 
 const (
@@ -16,6 +13,8 @@ const (
 	Delete = 0
 	// Modify 有人修改了自己的信息
 	Modify = 1
+	// Add 新增联系人
+	Add = 2
 )
 
 const (
@@ -29,18 +28,6 @@ const (
 	Any
 )
 
-//noinspection ALL
-type updateGroupRequest struct {
-	BaseRequest
-	Count int
-	List  []string
-}
-
-//noinspection ALL
-type updateGroupMemberRequest struct {
-	BaseRequest
-}
-
 type getContactResponse struct {
 	Response
 	MemberCount int
@@ -61,6 +48,11 @@ func (contact *Contact) To() string {
 	return contact.UserName
 }
 
+// Card create a name card msg of contact, send it to share this contact with others.
+func (contact *Contact) Card(to string) *messages.CardMsg {
+	return messages.NewCardMsg(contact.UserName, contact.NickName, contact.Alias, contact.Province, contact.City, contact.Signature, int(contact.Sex), to)
+}
+
 func (wechat *WeChat) getContacts(seq float64) ([]map[string]interface{}, float64, error) {
 
 	urlPath := fmt.Sprintf(`%s/webwxgetcontact?%s&%s&r=%s&seq=%v`, wechat.BaseURL, wechat.PassTicketKV(), wechat.SkeyKV(), now(), seq)
@@ -96,26 +88,78 @@ func (wechat *WeChat) SyncContact() error {
 	}
 
 	var groupUserNames []string
+	var groups []map[string]interface{}
+	var partial []string // reused without members unknown in this session
+
+	// 本地缓存可能是上次会话的, UserName 都变了
+	mapping := wechat.cache.sessionMapping(cts)
+	previous := make(map[string]string, len(mapping))
+	for o, n := range mapping {
+		previous[n] = o
+	}
 
-	var tempIdxMap = make(map[string]int)
-
-	for idx, v := range cts {
+	for _, v := range cts {
 
-		vf, _ := v[`VerifyFlag`].(float64)
 		un, _ := v[`UserName`].(string)
 
-		if vf/8 != 0 {
-			v[`Type`] = Offical
-		} else if strings.HasPrefix(un, `@@`) {
-			v[`Type`] = Group
-			groupUserNames = append(groupUserNames, un)
-		} else {
-			v[`Type`] = Friend
+		v[`Type`] = contactType(v, wechat.MySelf.UserName)
+		if v[`Type`] == Group {
+			// 成员数没变的群直接用本地缓存
+			old, found := previous[un]
+			if !found {
+				old = un
+			}
+			if cached, dropped := wechat.cache.unchangedGroup(v, old, mapping, wechat.MySelf.UserName); cached != nil {
+				groups = append(groups, cached)
+				if dropped > 0 {
+					partial = append(partial, un)
+				}
+			} else {
+				groupUserNames = append(groupUserNames, un)
+			}
+		}
+	}
+
+	logger.Debugf(`%d group(s) reused from cache, %d group(s) will be fetched`, len(groups), len(groupUserNames))
+	logger.Debugf(`%d reused group(s) will be refreshed later for unknown members`, len(partial))
+
+	var fetched []map[string]interface{}
+	if len(groupUserNames) > 0 {
+		var err error
+		if fetched, err = wechat.fetchGroups(groupUserNames); err != nil {
+			logger.Errorf(`fetch groups failed: %v, %d of %d group(s) fetched`, err, len(fetched), len(groupUserNames))
 		}
-		tempIdxMap[un] = idx
+		groups = append(groups, fetched...)
 	}
 
-	groups, _ := wechat.fetchGroups(groupUserNames)
+	cts = wechat.mergeGroups(cts, groups)
+
+	wechat.syncContacts(cts)
+
+	// 成员详情在第一次用到时加载, 或者在后台按群的活跃程度加载
+	for _, group := range groups {
+		un, _ := group[`UserName`].(string)
+		wechat.memberLoader.enqueue(un)
+	}
+
+	// 不认识的成员删掉了, 刷新时不算新入群
+	for _, un := range partial {
+		wechat.groupLocks.markPartial(un)
+		wechat.refreshGroupLater(un)
+	}
+
+	return nil
+}
+
+// mergeGroups replace groups in cts by the fetched ones and append their members,
+// friends in groups become FriendAndMember.
+func (wechat *WeChat) mergeGroups(cts, groups []map[string]interface{}) []map[string]interface{} {
+
+	idx := make(map[string]int, len(cts))
+	for i, v := range cts {
+		un, _ := v[`UserName`].(string)
+		idx[un] = i
+	}
 
 	for _, group := range groups {
 
@@ -125,45 +169,25 @@ func (wechat *WeChat) SyncContact() error {
 		for _, c := range contacts {
 			ct := c.(map[string]interface{})
 			un := ct[`UserName`].(string)
-			if idx, found := tempIdxMap[un]; found {
-				cts[idx][`Type`] = FriendAndMember
+			if i, found := idx[un]; found {
+				if cts[i][`Type`] == Friend {
+					cts[i][`Type`] = FriendAndMember
+				}
+			} else if un == wechat.MySelf.UserName {
+				ct[`Type`] = Self
+				cts = append(cts, ct)
 			} else {
-				ct[`HeadImgUrl`] = fmt.Sprintf(`/cgi-bin/mmwebwx-bin/webwxgeticon?seq=0&username=%s&chatroomid=%s&skey=`, un, groupUserName)
+				ct[`HeadImgUrl`] = wechat.memberHeadImgURL(un, groupUserName)
 				ct[`Type`] = Member
 				cts = append(cts, ct)
 			}
 		}
 
 		group[`Type`] = Group
-		idx := tempIdxMap[groupUserName]
-		cts[idx] = group
-	}
-
-	wechat.syncContacts(cts)
-
-	return nil
-}
-
-// GetContactHeadImg ...
-func (wechat *WeChat) GetContactHeadImg(c *Contact) ([]byte, error) {
-
-	urlOBJ, err := url.Parse(wechat.BaseURL)
-
-	if err != nil {
-		return nil, err
+		cts[idx[groupUserName]] = group
 	}
 
-	host := urlOBJ.Host
-
-	urlPath := fmt.Sprintf(`https://%s%s`, host, c.HeadImgURL)
-
-	resp, err := wechat.Client.Get(urlPath)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	return ioutil.ReadAll(resp.Body)
+	return cts
 }
 
 func (wechat *WeChat) fetchGroups(usernames []string) ([]map[string]interface{}, error) {
@@ -176,74 +200,43 @@ func (wechat *WeChat) fetchGroups(usernames []string) ([]map[string]interface{},
 		})
 	}
 
-	data, err := json.Marshal(map[string]interface{}{
-		`BaseRequest`: wechat.BaseRequest,
-		`Count`:       len(list),
-		`List`:        list,
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	urlPath := fmt.Sprintf(`%s/webwxbatchgetcontact?type=ex&r=%v`, wechat.BaseURL, time.Now().Unix()*1000)
-	resp := new(batchGetContactResponse)
-
-	wechat.Execute(urlPath, bytes.NewReader(data), resp)
-
-	if resp.IsSuccess() {
-		return resp.ContactList, nil
-	}
-
-	return nil, errors.New(`fetchGroups error`)
+	return wechat.batchGetContact(context.Background(), list)
 }
 
-func (wechat *WeChat) fetchGroupsMembers(groups []map[string]interface{}) ([]map[string]interface{}, error) {
-
-	list := make([]map[string]string, 0)
+// memberStubs returns contacts of members with the brief info in group,
+// cached contacts are kept, details are loaded by loadMembers.
+func (wechat *WeChat) memberStubs(group map[string]interface{}) []map[string]interface{} {
 
-	logger.Debugf(`groups %s`, groups)
-	for _, group := range groups {
+	groupUserName, _ := group[`UserName`].(string)
+	members, _ := group[`MemberList`].([]interface{})
 
-		encryChatRoomID, _ := group[`EncryChatRoomId`].(string)
-		members, _ := group[`MemberList`].([]interface{})
+	wechat.cache.Lock()
+	defer wechat.cache.Unlock()
 
-		for _, m := range members {
-			mmap, _ := m.(map[string]interface{})
-			u, _ := mmap[`UserName`].(string)
-			list = append(list, map[string]string{
-				`UserName`:        u,
-				`EncryChatRoomId`: encryChatRoomID,
-			})
+	var cts []map[string]interface{}
+	for _, m := range members {
+		ct, ok := m.(map[string]interface{})
+		if !ok {
+			continue
 		}
+		un, _ := ct[`UserName`].(string)
+		if c, found := wechat.cache.contacts[un]; found && c.Type != Group {
+			cached := contactToMap(c)
+			if c.Type == Friend {
+				cached[`Type`] = FriendAndMember
+			}
+			cts = append(cts, cached)
+			continue
+		}
+		ct[`HeadImgUrl`] = wechat.memberHeadImgURL(un, groupUserName)
+		if un == wechat.MySelf.UserName {
+			ct[`Type`] = Self
+		} else {
+			ct[`Type`] = Member
+		}
+		cts = append(cts, ct)
 	}
-
-	logger.Debugf(`will load members: %s`, list)
-	return wechat.fetchMembers(list), nil
-}
-
-func (wechat *WeChat) fetchMembers(list []map[string]string) []map[string]interface{} {
-
-	if len(list) > maxCountOnceLoadGroupMember {
-		return append(wechat.fetchMembers(list[:maxCountOnceLoadGroupMember]), wechat.fetchMembers(list[maxCountOnceLoadGroupMember:])...)
-	}
-
-	data, _ := json.Marshal(map[string]interface{}{
-		`BaseRequest`: wechat.BaseRequest,
-		`Count`:       len(list),
-		`List`:        list,
-	})
-
-	urlPath := fmt.Sprintf(`%s/webwxbatchgetcontact?type=ex&r=%v`, wechat.BaseURL, time.Now().Unix()*1000)
-	resp := new(batchGetContactResponse)
-
-	wechat.Execute(urlPath, bytes.NewReader(data), resp)
-
-	if !resp.IsSuccess() {
-		err := fmt.Errorf(`list: %s`, list)
-		logger.Errorf(`fetchMembers error %s`, err)
-	}
-
-	return resp.ContactList
+	return cts
 }
 
 // UpdateGroupIfNeeded ...
@@ -256,37 +249,53 @@ func (wechat *WeChat) UpdateGroupIfNeeded(groupID string) {
 
 // ForceUpdateGroup update group information
 func (wechat *WeChat) ForceUpdateGroup(groupUserName string) {
+	if err := wechat.refreshGroup(context.Background(), groupUserName); err != nil {
+		logger.Errorf(`sync group [%s] failed: %v`, groupUserName, err)
+	}
+}
 
-	logger.Debugf(`will force updating group username: %s`, groupUserName)
+// refreshGroup fetch group, replace the cached one and emit join and leave events.
+func (wechat *WeChat) refreshGroup(ctx context.Context, groupUserName string) error {
 
-	groups, err := wechat.fetchGroups([]string{groupUserName})
-	if err != nil || len(groups) != 1 {
-		logger.Error(`sync group failed`)
-		return
-	}
+	l := wechat.groupLocks.get(groupUserName)
+	l.Lock()
+	defer l.Unlock()
 
-	group := groups[0]
-	group[`Type`] = Group
+	return wechat.refreshGroupLocked(ctx, groupUserName)
+}
 
-	var cts []map[string]interface{}
+// refreshGroupLocked must be called with lock of group held.
+func (wechat *WeChat) refreshGroupLocked(ctx context.Context, groupUserName string) error {
 
-	cts = append(cts, groups[0])
+	logger.Debugf(`will force updating group username: %s`, groupUserName)
+
+	old := wechat.cache.snapshot(groupUserName)
 
-	memberList, err := wechat.fetchGroupsMembers(groups)
+	groups, err := wechat.batchGetContact(ctx, []map[string]string{{
+		`UserName`:   groupUserName,
+		`ChatRoomId`: ``,
+	}})
 	if err != nil {
-		logger.Error(`sync group failed`)
-		return
+		return err
+	}
+	if len(groups) != 1 {
+		return fmt.Errorf(`%d group(s) returned`, len(groups))
 	}
 
-	for _, v := range memberList {
-		if _, found := wechat.cache.contacts[v[`UserName`].(string)]; found {
-			v[`Type`] = FriendAndMember
-		} else {
-			v[`Type`] = Group
-		}
+	group := groups[0]
+	group[`Type`] = Group
+
+	// 成员详情在第一次用到时加载, 或者在后台按群的活跃程度加载
+	wechat.appendContacts(append([]map[string]interface{}{group}, wechat.memberStubs(group)...))
+	wechat.memberLoader.enqueue(groupUserName)
+
+	// 第一次加载的群, 或者缓存里缺了成员的群不发出入群事件
+	partial := wechat.groupLocks.takePartial(groupUserName)
+	if group := wechat.cache.snapshot(groupUserName); old != nil && group != nil && !partial {
+		wechat.diffGroupMembers(old, group)
 	}
 
-	wechat.appendContacts(append(cts, memberList...))
+	return nil
 }
 
 // ContactByUserName ...
@@ -296,28 +305,24 @@ func (wechat *WeChat) ContactByUserName(un string) *Contact {
 	return wechat.cache.contacts[un]
 }
 
-// ContactsByNickName search contact with nick name
+// SearchContact search contact whose NickName is nickName, see Query for
+// fuzzy names and more conditions. sex is compared as wx server sends it,
+// 1 for Male and 2 for Female, it was 0 and 1 before which matched nobody.
 func (wechat *WeChat) SearchContact(nickName string, city string, sex int, contactType int) ([]*Contact, error) {
-	wechat.cache.Lock()
-	wechat.cache.Unlock()
 
-	var cs []*Contact
-	for _, c := range wechat.cache.contacts {
-		if c.NickName == nickName {
-			if len(city) > 0 && c.City != city {
-				continue
-			}
-			if contactType != Any && c.Type != contactType {
-				continue
-			}
-			if sex == Any {
-				cs = append(cs, c)
-			} else if (sex == Male && c.Sex == 0) || (sex == Female && c.Sex == 1) || (sex == Unknow && c.Sex == 3) {
-				cs = append(cs, c)
-			}
-		}
+	// 和以前一样只按 NickName 精确查找, 索引只用来缩小范围
+	q := wechat.Query().Name(nickName).Where(func(c *Contact) bool { return c.NickName == nickName })
+	if len(city) > 0 {
+		q.City(city)
 	}
-	if len(cs) > 0 {
+	if sex != Any {
+		q.Sex(sex)
+	}
+	if contactType != Any {
+		q.Where(func(c *Contact) bool { return c.Type == contactType })
+	}
+
+	if cs := q.All(); len(cs) > 0 {
 		return cs, nil
 	}
 	return nil, errors.New(`not found`)
@@ -326,15 +331,15 @@ func (wechat *WeChat) SearchContact(nickName string, city string, sex int, conta
 // AllContacts ...
 func (wechat *WeChat) AllContacts() []*Contact {
 	wechat.cache.Lock()
-	wechat.cache.Unlock()
-	var values []*Contact
+	defer wechat.cache.Unlock()
+	values := make([]*Contact, 0, len(wechat.cache.contacts))
 	for _, value := range wechat.cache.contacts {
 		values = append(values, value)
 	}
 	return values
 }
 
-// MembersOfGroup ..返回群中所有的成员
+// MembersOfGroup ..返回群中所有的成员, 只有群里带的简要信息, 详情用 GroupMembers
 func (wechat *WeChat) MembersOfGroup(groupUserName string) ([]*Contact, error) {
 	group, err := wechat.cache.contactByUserName(groupUserName)
 	if err != nil {
@@ -343,57 +348,86 @@ func (wechat *WeChat) MembersOfGroup(groupUserName string) ([]*Contact, error) {
 	return group.MemberList, nil
 }
 
-// TODO
-func (wechat *WeChat) modifyRemarkName(un string) (string, error) {
-
-	data, _ := json.Marshal(map[string]interface{}{
-		`BaseRequest`: wechat.BaseRequest,
-		`UserName`:    un,
-		`CmdId`:       2,
-		`NickName`:    `Test`,
-	})
-
-	urlPath := fmt.Sprintf(`%s/webwxoplog?lang=zh_CN&%v`, wechat.BaseURL, wechat.PassTicketKV())
-	resp := new(Response)
-
-	wechat.Execute(urlPath, bytes.NewReader(data), resp)
+func (wechat *WeChat) contactDidChange(cts []map[string]interface{}, changeType int) {
+	logger.Info(`contact did change, will update local contact`)
 
-	if !resp.IsSuccess() {
-		logger.Error(resp.Error())
+	// 更新缓存前记下旧的, 用于对比变化
+	olds := make(map[string]*Contact)
+	for _, v := range cts {
+		un, _ := v[`UserName`].(string)
+		if old := wechat.cache.snapshot(un); old != nil {
+			olds[un] = old
+		}
 	}
 
-	return `Test`, nil
-}
+	es := wechat.evtStream
 
-func (wechat *WeChat) contactDidChange(cts []map[string]interface{}, changeType int) {
-	logger.Info(`contact did change, will update local contact`)
 	if changeType == Modify { // 修改
 		var mcts []map[string]interface{}
 		for _, v := range cts {
-			vf, _ := v[`VerifyFlag`].(float64)
 			un, _ := v[`UserName`].(string)
 
-			if vf/8 != 0 {
-				v[`Type`] = Offical
-				mcts = append(mcts, v)
-			} else if strings.HasPrefix(un, `@@`) {
+			v[`Type`] = contactType(v, wechat.MySelf.UserName)
+			if v[`Type`] == Group {
 				wechat.ForceUpdateGroup(un)
-			} else {
-				v[`Type`] = Friend
-				mcts = append(mcts, v)
+				continue
+			}
+			// 已经在群里的好友
+			if old, found := olds[un]; found && old.IsMember() && v[`Type`] == Friend {
+				v[`Type`] = FriendAndMember
 			}
+			mcts = append(mcts, v)
 		}
 		wechat.appendContacts(mcts)
+
+		for _, v := range cts {
+			un, _ := v[`UserName`].(string)
+			nc := wechat.cache.snapshot(un)
+			if nc == nil {
+				continue
+			}
+			if old, found := olds[un]; found {
+				go es.emitContactModEvent(*old, *nc)
+			} else {
+				go es.emitContactChangeEvent(*nc, Add)
+			}
+		}
 	} else {
 		for _, v := range cts {
-			wechat.removeContact(v[`UserName`].(string))
+			un, _ := v[`UserName`].(string)
+			wechat.removeContact(un)
+			old, found := olds[un]
+			if !found {
+				old = &Contact{UserName: un} // 不在缓存里的联系人这里构造一个
+			}
+			go es.emitContactChangeEvent(*old, Delete)
 		}
 	}
 }
 
-func (wechat *WeChat) groupMemberDidChange(groups []map[string]interface{}) {
+// groupMemberDidChange refresh changed groups and groups mentioned by system messages,
+// then emit join and leave events.
+func (wechat *WeChat) groupMemberDidChange(groups []map[string]interface{}, hinted []string) {
 	logger.Info(`group member has changed will update local group members`)
+
+	uns := make([]string, 0, len(groups)+len(hinted))
+	seen := make(map[string]bool)
 	for _, group := range groups {
-		wechat.ForceUpdateGroup(group[`UserName`].(string))
+		un, _ := group[`UserName`].(string)
+		if !seen[un] {
+			seen[un] = true
+			uns = append(uns, un)
+		}
+	}
+	for _, un := range hinted {
+		if !seen[un] {
+			seen[un] = true
+			uns = append(uns, un)
+		}
+	}
+
+	for _, un := range uns {
+		wechat.ForceUpdateGroup(un)
+		wechat.flushGroupHints(un)
 	}
 }
@@ -0,0 +1,257 @@
+package wechat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/h2non/filetype.v1"
+)
+
+// ErrNotMediaMsg is returned when a message carry nothing to download.
+var ErrNotMediaMsg = errors.New(`message has no media`)
+
+// appMsgTypeAttach is the AppMsgType of a file attachment
+const appMsgTypeAttach = 6
+
+// MediaReader is the content of a media message, caller must close it.
+type MediaReader struct {
+	io.ReadCloser
+	ContentType string
+	Length      int64 // -1 if server does not tell
+	FileName    string
+}
+
+// mediaURL build the download url of a raw AddMsgList entry,
+// thumb is only valid for image and video messages.
+func (wechat *WeChat) mediaURL(m map[string]interface{}, thumb bool) (string, error) {
+
+	msgType, _ := m[`MsgType`].(float64)
+	mid, _ := m[`MsgId`].(string)
+
+	route := ``
+
+	switch msgType {
+	case 3:
+		route = `webwxgetmsgimg`
+	case 47:
+		pid, _ := m[`HasProductId`].(float64)
+		if pid == 0 {
+			route = `webwxgetmsgimg`
+		}
+	case 34:
+		route = `webwxgetvoice`
+	case 43:
+		route = `webwxgetvideo`
+		if thumb {
+			route = `webwxgetmsgimg`
+		}
+	case 49:
+		appMsgType, _ := m[`AppMsgType`].(float64)
+		if appMsgType == appMsgTypeAttach && !thumb {
+			return wechat.attachURL(m)
+		}
+	}
+
+	if len(route) == 0 {
+		return ``, ErrNotMediaMsg
+	}
+
+	urlPath := fmt.Sprintf(`%v/%s?msgid=%v&%v`, wechat.BaseURL, route, mid, wechat.SkeyKV())
+	if thumb {
+		if route != `webwxgetmsgimg` {
+			return ``, ErrNotMediaMsg
+		}
+		urlPath += `&type=slave`
+	}
+
+	return urlPath, nil
+}
+
+func (wechat *WeChat) attachURL(m map[string]interface{}) (string, error) {
+
+	urlOBJ, err := url.Parse(wechat.BaseURL)
+	if err != nil {
+		return ``, err
+	}
+
+	sender, _ := m[`FromUserName`].(string)
+	mediaID, _ := m[`MediaId`].(string)
+	encryFileName, _ := m[`EncryFileName`].(string)
+
+	params := url.Values{}
+	params.Set(`sender`, sender)
+	params.Set(`mediaid`, mediaID)
+	params.Set(`encryfilename`, encryFileName)
+	params.Set(`fromuser`, str(wechat.BaseRequest.Wxuin))
+	params.Set(`pass_ticket`, wechat.BaseRequest.PassTicket)
+	params.Set(`webwx_data_ticket`, wechat.CookieDataTicket())
+
+	return fmt.Sprintf(`https://file.%s/cgi-bin/mmwebwx-bin/webwxgetmedia?%s`, urlOBJ.Host, params.Encode()), nil
+}
+
+// OpenMedia open the full size content of an image, voice, video or attachment message.
+func (wechat *WeChat) OpenMedia(ctx context.Context, msg EventMsgData) (*MediaReader, error) {
+	return wechat.openMedia(ctx, msg, false)
+}
+
+// OpenThumbnail open the thumbnail of an image or video message.
+func (wechat *WeChat) OpenThumbnail(ctx context.Context, msg EventMsgData) (*MediaReader, error) {
+	return wechat.openMedia(ctx, msg, true)
+}
+
+func (wechat *WeChat) openMedia(ctx context.Context, msg EventMsgData, thumb bool) (*MediaReader, error) {
+
+	urlPath, err := wechat.mediaURL(msg.OriginalMsg, thumb)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(`GET`, urlPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	if msg.MsgType == 43 && !thumb {
+		req.Header.Set(`Range`, `bytes=0-`) // 只有小视频才需要加这个headers
+	}
+
+	resp, err := wechat.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf(`download media [%s] failed: %s`, msg.MsgID, resp.Status)
+	}
+
+	contentType := resp.Header.Get(`Content-Type`)
+	if i := strings.Index(contentType, `;`); i > 0 {
+		contentType = contentType[:i]
+	}
+
+	mr := &MediaReader{
+		ReadCloser:  resp.Body,
+		ContentType: contentType,
+		Length:      resp.ContentLength,
+		FileName:    mediaFileName(msg, contentType, thumb),
+	}
+
+	return mr, nil
+}
+
+// mediaFileName suggest a file name, attachment keep its original name.
+func mediaFileName(msg EventMsgData, contentType string, thumb bool) string {
+
+	if name, _ := msg.OriginalMsg[`FileName`].(string); len(name) > 0 && msg.MsgType == 49 {
+		// 文件名来自对方, 不能跳出保存目录
+		name = filepath.Base(strings.Replace(name, `\`, `/`, -1))
+		if name != `.` && name != `..` && name != `/` {
+			return name
+		}
+	}
+
+	ext := ``
+	switch contentType {
+	case `image/jpeg`, `image/jpg`:
+		ext = `.jpg`
+	case `image/png`:
+		ext = `.png`
+	case `image/gif`:
+		ext = `.gif`
+	case `audio/mp3`, `audio/mpeg`:
+		ext = `.mp3`
+	case `video/mp4`:
+		ext = `.mp4`
+	default:
+		if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+
+	name := msg.MsgID
+	if thumb {
+		name += `_thumb`
+	}
+
+	return name + ext
+}
+
+// SaveMedia download the media of msg into dir, returns the saved file path.
+func (wechat *WeChat) SaveMedia(ctx context.Context, msg EventMsgData, dir string) (string, error) {
+
+	mr, err := wechat.OpenMedia(ctx, msg)
+	if err != nil {
+		return ``, err
+	}
+	defer mr.Close()
+
+	path := filepath.Join(dir, mr.FileName)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return ``, err
+	}
+	defer file.Close()
+
+	n, err := io.Copy(file, mr)
+	if err == nil && mr.Length >= 0 && n != mr.Length {
+		err = fmt.Errorf(`media truncated, got %d of %d bytes`, n, mr.Length)
+	}
+	if err != nil {
+		os.Remove(path)
+		return ``, err
+	}
+
+	return path, nil
+}
+
+// DownloadMedia use to download a voice or immage msg
+func (wechat *WeChat) DownloadMedia(url string, localPath string) (string, error) {
+
+	req, err := http.NewRequest(`GET`, url, nil)
+	if err != nil {
+		return ``, err
+	}
+
+	req.Header.Set(`Range`, `bytes=0-`) // 只有小视频才需要加这个headers
+
+	resp, err := wechat.Client.Do(req)
+	if err != nil {
+		return ``, err
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReaderSize(resp.Body, sniffLen)
+	head, _ := reader.Peek(sniffLen)
+
+	t, err := filetype.Match(head)
+	if err != nil {
+		return ``, err
+	}
+
+	path := filepath.Join(localPath + `.` + t.Extension)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return ``, err
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(file, reader); err != nil {
+		os.Remove(path)
+		return ``, err
+	}
+
+	return path, nil
+}
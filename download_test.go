@@ -0,0 +1,25 @@
+package wechat
+
+import "testing"
+
+func TestMediaFileName(t *testing.T) {
+	cases := []struct {
+		fileName string
+		want     string
+	}{
+		{`报告.pdf`, `报告.pdf`},
+		{`../../.ssh/authorized_keys`, `authorized_keys`},
+		{`..\..\boot.ini`, `boot.ini`},
+		{`..`, `123.pdf`},
+		{`.`, `123.pdf`},
+		{`/`, `123.pdf`},
+		{``, `123.pdf`},
+	}
+
+	for _, c := range cases {
+		msg := EventMsgData{MsgID: `123`, MsgType: 49, OriginalMsg: map[string]interface{}{`FileName`: c.fileName}}
+		if got := mediaFileName(msg, `application/pdf`, false); got != c.want {
+			t.Errorf(`mediaFileName(%q) = %q, want %q`, c.fileName, got, c.want)
+		}
+	}
+}
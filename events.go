@@ -1,7 +1,7 @@
 package wechat
 
 import (
-	"fmt"
+	"context"
 	"path"
 	"strconv"
 	"strings"
@@ -9,6 +9,10 @@ import (
 	"time"
 )
 
+// time to wait for fetching an uncached sender of group message, the message
+// is delayed at most this long
+const senderFetchTimeout = 3 * time.Second
+
 // Event ...
 type Event struct {
 	Type string
@@ -22,22 +26,29 @@ type Event struct {
 // EventContactData 通讯录中删人 或者有人修改资料的时候
 type EventContactData struct {
 	ChangeType int
-	Contact    Contact
+	Contact    Contact  // 变化后的联系人, 删除时是删除前的
+	Old        *Contact // 变化前的联系人, 新增时为 nil
+	Changes    []string // ContactRenamed, ContactRemarkChanged ...
 }
 
 // EventMsgData 新消息
 type EventMsgData struct {
-	IsGroupMsg       bool
-	IsMediaMsg       bool
-	IsSendedByMySelf bool
-	MsgType          int64
-	AtMe             bool
-	MediaURL         string
-	Content          string
-	FromUserName     string
-	SenderUserName   string
-	ToUserName       string
-	OriginalMsg      map[string]interface{}
+	MsgID             string
+	IsGroupMsg        bool
+	IsMediaMsg        bool
+	IsSendedByMySelf  bool
+	MsgType           int64
+	AtMe              bool
+	Mentions          []string // UserName of mentioned members, MentionAll for @所有人
+	MediaURL          string
+	Content           string // plain text, emoji and html entities are converted
+	RawContent        string // content as wx server send
+	FromUserName      string
+	SenderUserName    string
+	Sender            *Contact // copy of sender, UserName only if it can't be fetched
+	SenderDisplayName string   // name of sender shown in group: DisplayName in group or NickName
+	ToUserName        string
+	OriginalMsg       map[string]interface{}
 }
 
 // EventTimerData ...
@@ -264,12 +275,44 @@ func (wechat *WeChat) AddTiming(hm string) {
 func (es *evtStream) emitContactChangeEvent(c Contact, ct int) {
 	data := EventContactData{
 		ChangeType: ct,
-		Contact:   c,
+		Contact:    c,
+	}
+	route := `/mod`
+	if ct == Delete {
+		route = `/del`
+		data.Old = &c
+		if c.Type == Friend || c.Type == FriendAndMember {
+			route += `/` + ContactUnfriended
+			data.Changes = []string{ContactUnfriended}
+		}
+	} else if ct == Add {
+		route = `/add`
+	}
+	es.emitContactEvent(route, data)
+}
+
+// emitContactModEvent emit one event for a modification of contact, on
+// `/contact/mod/<change>` of the first kind of change, all of them are in
+// Changes, or on `/contact/mod` if none of them is known. Nothing is emitted
+// if old and c are the same, e.g. the sync after our own change.
+func (es *evtStream) emitContactModEvent(old, c Contact) {
+	data := EventContactData{
+		ChangeType: Modify,
+		Contact:    c,
+		Old:        &old,
+		Changes:    diffContact(&old, &c),
 	}
-	route := `/del`
-	if ct != Delete {
-		route = `/mod`
+	if len(data.Changes) == 0 {
+		if sameContact(&old, &c) {
+			return
+		}
+		es.emitContactEvent(`/mod`, data)
+		return
 	}
+	es.emitContactEvent(`/mod/`+data.Changes[0], data)
+}
+
+func (es *evtStream) emitContactEvent(route string, data EventContactData) {
 	event := Event{
 		Type: `ContactChange`,
 		From: `Server`,
@@ -298,70 +341,76 @@ func (wechat *WeChat) emitNewMessageEvent(m map[string]interface{}) {
 	if len(groupUserName) > 0 {
 		isGroupMsg = true
 		wechat.UpdateGroupIfNeeded(groupUserName)
+		wechat.memberLoader.touch(groupUserName)
 	}
 	msgType := m[`MsgType`].(float64)
 	mid := m[`MsgId`].(string)
 
 	isMediaMsg := false
-	mediaURL := ``
-	route := ``
-
-	switch msgType {
-	case 3:
-		route = `webwxgetmsgimg`
-	case 47:
-		pid, _ := m[`HasProductId`].(float64)
-		if pid == 0 {
-			route = `webwxgetmsgimg`
-		}
-	case 34:
-		route = `webwxgetvoice`
-	case 43:
-		route = `webwxgetvideo`
-	}
-	if len(route) > 0 {
+	mediaURL, err := wechat.mediaURL(m, false)
+	if err == nil {
 		isMediaMsg = true
-		mediaURL = fmt.Sprintf(`%v/%s?msgid=%v&%v`, wechat.BaseURL, route, mid, wechat.SkeyKV())
 	}
 	isAtMe := false
+	var mentions []string
+	var sender *Contact
+	var senderDisplayName string
+	if isSendedByMySelf {
+		sender = wechat.myselfCopy()
+	} else if !isGroupMsg {
+		sender = wechat.cache.snapshot(fromUserName)
+	}
 	if isGroupMsg && !isSendedByMySelf {
-		atme := `@`
-		if len(wechat.MySelf.DisplayName) > 0 {
-			atme += wechat.MySelf.DisplayName
-		} else {
-			atme += wechat.MySelf.NickName
-		}
-		isAtMe = strings.Contains(content, atme)
+		// 系统消息没有发送者前缀
+		infos := strings.SplitN(content, `:<br/>`, 2)
+		if len(infos) == 2 {
+			// 不在缓存里的发送者从服务器取, 取不到也照样发出消息
+			ctx, cancel := context.WithTimeout(context.Background(), senderFetchTimeout)
+			sender, err = wechat.memberOf(ctx, groupUserName, infos[0])
+			cancel()
+			if err != nil {
+				logger.Warnf(`can't find sender [%s] of group [%s]: %v`, infos[0], groupUserName, err)
+				sender = &Contact{UserName: infos[0]}
+			}
 
-		infos := strings.Split(content, `:<br/>`)
-		if len(infos) != 2 {
-			return
-		}
+			var inGroup bool
+			if senderDisplayName, inGroup = wechat.displayNameInGroup(groupUserName, sender); !inGroup {
+				// 刚进群的, 刷新一下群成员
+				wechat.refreshGroupLater(groupUserName)
+			}
 
-		contact := wechat.ContactByUserName(infos[0])
-		if contact == nil {
-			wechat.ForceUpdateGroup(groupUserName)
-			logger.Errorf(`can't find contact info, so ignore this message %s`, m)
-			return
+			senderUserName = sender.UserName
+			content = infos[1]
 		}
 
-		senderUserName = contact.UserName
-		content = infos[1]
+		mentions = wechat.parseMentions(groupUserName, normalizeText(content))
+		isAtMe = isMentioned(mentions, wechat.MySelf.UserName)
 	}
 
 	data := EventMsgData{
-		IsGroupMsg:       isGroupMsg,
-		IsMediaMsg:       isMediaMsg,
-		IsSendedByMySelf: isSendedByMySelf,
-		MsgType:          int64(msgType),
-		AtMe:             isAtMe,
-		MediaURL:         mediaURL,
-		Content:          content,
-		FromUserName:     fromUserName,
-		SenderUserName:   senderUserName,
-		ToUserName:       toUserName,
-		OriginalMsg:      m,
+		MsgID:             mid,
+		IsGroupMsg:        isGroupMsg,
+		IsMediaMsg:        isMediaMsg,
+		IsSendedByMySelf:  isSendedByMySelf,
+		MsgType:           int64(msgType),
+		AtMe:              isAtMe,
+		Mentions:          mentions,
+		MediaURL:          mediaURL,
+		Content:           normalizeText(content),
+		RawContent:        content,
+		FromUserName:      fromUserName,
+		SenderUserName:    senderUserName,
+		Sender:            sender,
+		SenderDisplayName: senderDisplayName,
+		ToUserName:        toUserName,
+		OriginalMsg:       m,
 	}
+	if isMediaMsg {
+		wechat.mediaCache.remember(data)
+		go wechat.prefetchMediaIfNeeded(data)
+	}
+	wechat.recordInbound(data)
+
 	evtPath := `/solo`
 	if isGroupMsg {
 		evtPath = `/group`
@@ -379,23 +428,7 @@ func (wechat *WeChat) emitNewMessageEvent(m map[string]interface{}) {
 
 func (wechat *WeChat) handleServerEvent(resp *syncMessageResponse) {
 
-	es := wechat.evtStream
-
-	if resp.DelContactCount > 0 {
-		for _, v := range resp.DelContactList {
-			go es.emitContactChangeEvent(Contact{UserName: v[`UserName`].(string)}, Delete) // 已经删除的联系人这里构造一个
-		}
-	}
-
-	if resp.ModContactCount > 0 {
-		for _, v := range resp.ModContactList {
-			contact := wechat.ContactByUserName(v[`UserName`].(string))
-			if contact != nil {
-				go es.emitContactChangeEvent(*contact, Modify)
-			}
-		}
-	}
-
+	// contact events are emitted by contactDidChange, which knows the old ones
 	if resp.AddMsgCount > 0 {
 		for _, v := range resp.AddMsgList {
 			go wechat.emitNewMessageEvent(v)
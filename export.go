@@ -0,0 +1,402 @@
+package wechat
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ExportFormat is the file format of ExportContacts and ExportMemberships
+type ExportFormat int
+
+const (
+	// ExportCSV with a header line
+	ExportCSV ExportFormat = iota
+	// ExportJSONLines one json object per line
+	ExportJSONLines
+	// ExportVCard vCard 3.0, only for contacts
+	ExportVCard
+)
+
+// ErrUnsupportedExport is returned when format can't hold what is exported.
+var ErrUnsupportedExport = errors.New(`unsupported export format`)
+
+// ExportOptions select what and how to export, zero value exports friends,
+// official accounts and groups as CSV with default columns.
+type ExportOptions struct {
+	Format  ExportFormat
+	Columns []string      // ExportColumns or MembershipColumns by default
+	Kinds   []ContactKind // contacts of these kinds are exported
+}
+
+// ExportColumns are the default columns of contacts, `user_name`, `display_name`
+// and `uin` can be selected too. UserName changes every session so it is not
+// in default, `id` is the stable ContactID, empty for members not identified
+// across sessions yet. `groups` are names separated by `, `, a comma or backslash
+// in a name is escaped by backslash; it is an array in JSON Lines.
+var ExportColumns = []string{
+	`id`, `kind`, `nick_name`, `remark_name`, `alias`, `sex`,
+	`province`, `city`, `signature`, `starred`, `member_count`, `groups`,
+}
+
+// MembershipColumns are the columns of group memberships, one row per member of group.
+var MembershipColumns = []string{
+	`group_id`, `group_name`, `member_id`, `member_name`, `display_name`, `member_kind`,
+}
+
+var defaultExportKinds = []ContactKind{KindFriend, KindOfficial, KindService, KindEnterprise, KindGroup}
+
+// exportRow is a contact with groups it is in, or a member with its group.
+type exportRow struct {
+	contact *Contact
+	group   *Contact
+	groups  []string
+}
+
+var exportValues = map[string]func(r *exportRow) string{
+	`id`:           func(r *exportRow) string { return exportID(r.contact) },
+	`kind`:         func(r *exportRow) string { return r.contact.Kind().String() },
+	`user_name`:    func(r *exportRow) string { return r.contact.UserName },
+	`nick_name`:    func(r *exportRow) string { return r.contact.NickName },
+	`remark_name`:  func(r *exportRow) string { return r.contact.RemarkName },
+	`display_name`: func(r *exportRow) string { return r.contact.DisplayName },
+	`alias`:        func(r *exportRow) string { return r.contact.Alias },
+	`sex`:          func(r *exportRow) string { return sexName(r.contact.Sex) },
+	`province`:     func(r *exportRow) string { return r.contact.Province },
+	`city`:         func(r *exportRow) string { return r.contact.City },
+	`signature`:    func(r *exportRow) string { return r.contact.Signature },
+	`starred`:      func(r *exportRow) string { return strconv.FormatBool(r.contact.StarFriend != 0) },
+	`member_count`: func(r *exportRow) string { return memberCountOf(r.contact) },
+	`groups`:       func(r *exportRow) string { return joinGroups(r.groups) },
+	`uin`:          func(r *exportRow) string { return uinOf(r.contact) },
+
+	`group_id`:    func(r *exportRow) string { return exportID(r.group) },
+	`group_name`:  func(r *exportRow) string { return r.group.NickName },
+	`member_id`:   func(r *exportRow) string { return exportID(r.contact) },
+	`member_name`: func(r *exportRow) string { return r.contact.NickName },
+	`member_kind`: func(r *exportRow) string { return r.contact.Kind().String() },
+}
+
+// exportID is ContactID of c, empty if it is only for this session.
+func exportID(c *Contact) string {
+	id, confidence := c.ID()
+	if confidence == 0 {
+		return ``
+	}
+	return string(id)
+}
+
+var groupNameEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`)
+
+func joinGroups(groups []string) string {
+	escaped := make([]string, len(groups))
+	for i, g := range groups {
+		escaped[i] = groupNameEscaper.Replace(g)
+	}
+	return strings.Join(escaped, `, `)
+}
+
+func sexName(sex float64) string {
+	switch sex {
+	case 1:
+		return `male`
+	case 2:
+		return `female`
+	}
+	return ``
+}
+
+func memberCountOf(c *Contact) string {
+	if !c.IsGroup() {
+		return ``
+	}
+	return strconv.Itoa(len(c.MemberList))
+}
+
+func uinOf(c *Contact) string {
+	if c.Uin == 0 {
+		return ``
+	}
+	return strconv.FormatInt(c.Uin, 10)
+}
+
+// exportText remove emoji variation selectors and line breaks,
+// so the same name is always exported the same.
+func exportText(s string) string {
+	s = strings.NewReplacer("\ufe0f", ``, "\ufe0e", ``, "\r\n", ` `, "\n", ` `, "\r", ` `).Replace(s)
+	return strings.TrimSpace(s)
+}
+
+// ExportContacts write contacts in cache to w, rows are ordered by kind and
+// ContactID so two exports can be diffed.
+func (wechat *WeChat) ExportContacts(w io.Writer, opts ExportOptions) error {
+
+	kinds := opts.Kinds
+	if len(kinds) == 0 {
+		kinds = defaultExportKinds
+	}
+	wanted := make(map[ContactKind]bool)
+	for _, k := range kinds {
+		wanted[k] = true
+	}
+
+	var rows []*exportRow
+	for _, row := range wechat.exportSnapshot() {
+		if wanted[row.contact.Kind()] {
+			rows = append(rows, row)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return exportLess(rows[i].contact, rows[j].contact)
+	})
+
+	columns := opts.Columns
+	if len(columns) == 0 {
+		columns = ExportColumns
+	}
+
+	return writeExport(w, opts.Format, columns, rows)
+}
+
+// ExportMemberships write one row per member of every group, ordered by
+// group and member ContactID, members without one by name.
+func (wechat *WeChat) ExportMemberships(w io.Writer, opts ExportOptions) error {
+
+	if opts.Format == ExportVCard {
+		return ErrUnsupportedExport
+	}
+
+	var rows []*exportRow
+	for _, row := range wechat.exportSnapshot() {
+		if !row.contact.IsGroup() {
+			continue
+		}
+		for _, m := range row.contact.MemberList {
+			rows = append(rows, &exportRow{contact: m, group: row.contact})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if gi, gj := rows[i].group, rows[j].group; gi != gj {
+			return exportLess(gi, gj)
+		}
+		return exportLess(rows[i].contact, rows[j].contact)
+	})
+
+	columns := opts.Columns
+	if len(columns) == 0 {
+		columns = MembershipColumns
+	}
+
+	return writeExport(w, opts.Format, columns, rows)
+}
+
+func exportLess(a, b *Contact) bool {
+	if ka, kb := a.Kind(), b.Kind(); ka != kb {
+		return ka < kb
+	}
+	// 没认出来的成员排在后面, 按名字排
+	if ia, ib := exportID(a), exportID(b); ia != ib {
+		if len(ia) == 0 || len(ib) == 0 {
+			return len(ib) == 0
+		}
+		return ia < ib
+	}
+	if na, nb := exportText(a.NickName), exportText(b.NickName); na != nb {
+		return na < nb
+	}
+	return exportText(a.DisplayName) < exportText(b.DisplayName)
+}
+
+// exportSnapshot copy all contacts with names of groups they are in, members
+// of groups are replaced by their cached contacts with DisplayName in group.
+func (wechat *WeChat) exportSnapshot() []*exportRow {
+
+	wechat.cache.Lock()
+	defer wechat.cache.Unlock()
+
+	groupsOf := make(map[string][]string)
+	rows := make([]*exportRow, 0, len(wechat.cache.contacts))
+
+	for _, c := range wechat.cache.contacts {
+		cp := c.clone()
+		if cp.IsGroup() {
+			for i, m := range cp.MemberList {
+				member := m.clone()
+				if cached, found := wechat.cache.contacts[m.UserName]; found {
+					member = cached.clone()
+					member.DisplayName = m.DisplayName
+				}
+				cp.MemberList[i] = member
+				groupsOf[m.UserName] = append(groupsOf[m.UserName], exportText(cp.NickName))
+			}
+		}
+		rows = append(rows, &exportRow{contact: cp})
+	}
+
+	for _, row := range rows {
+		groups := groupsOf[row.contact.UserName]
+		sort.Strings(groups)
+		row.groups = groups
+	}
+
+	return rows
+}
+
+func writeExport(w io.Writer, format ExportFormat, columns []string, rows []*exportRow) error {
+
+	for _, col := range columns {
+		if _, found := exportValues[col]; !found {
+			return fmt.Errorf(`unknown export column [%s]`, col)
+		}
+	}
+
+	switch format {
+	case ExportCSV:
+		return writeCSV(w, columns, rows)
+	case ExportJSONLines:
+		return writeJSONLines(w, columns, rows)
+	case ExportVCard:
+		return writeVCards(w, columns, rows)
+	}
+	return ErrUnsupportedExport
+}
+
+func writeCSV(w io.Writer, columns []string, rows []*exportRow) error {
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, col := range columns {
+			record[i] = exportText(exportValues[col](row))
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSONLines keep keys in order of columns, encoding/json would sort them.
+func writeJSONLines(w io.Writer, columns []string, rows []*exportRow) error {
+
+	bw := bufio.NewWriter(w)
+	for _, row := range rows {
+		bw.WriteByte('{')
+		for i, col := range columns {
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+			k, _ := json.Marshal(col)
+			var v []byte
+			var err error
+			if col == `groups` {
+				groups := row.groups
+				if groups == nil {
+					groups = []string{}
+				}
+				v, err = json.Marshal(groups)
+			} else {
+				v, err = json.Marshal(exportText(exportValues[col](row)))
+			}
+			if err != nil {
+				return err
+			}
+			bw.Write(k)
+			bw.WriteByte(':')
+			bw.Write(v)
+		}
+		bw.WriteString("}\n")
+	}
+	return bw.Flush()
+}
+
+// vCard properties of columns, FN is always written
+var vCardProperties = map[string]string{
+	`id`:          `UID`,
+	`kind`:        `X-WECHAT-KIND`,
+	`user_name`:   `X-WECHAT-USERNAME`,
+	`nick_name`:   `NICKNAME`,
+	`remark_name`: `X-WECHAT-REMARK`,
+	`alias`:       `X-WECHAT-ALIAS`,
+	`sex`:         `X-WECHAT-SEX`,
+	`signature`:   `NOTE`,
+	`groups`:      `CATEGORIES`,
+	`uin`:         `X-WECHAT-UIN`,
+}
+
+func writeVCards(w io.Writer, columns []string, rows []*exportRow) error {
+
+	selected := make(map[string]bool)
+	for _, col := range columns {
+		selected[col] = true
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, row := range rows {
+		c := row.contact
+
+		fn := c.RemarkName
+		if len(fn) == 0 {
+			fn = c.NickName
+		}
+
+		writeVCardLine(bw, `BEGIN:VCARD`)
+		writeVCardLine(bw, `VERSION:3.0`)
+		writeVCardLine(bw, `FN:`+vCardEscape(exportText(fn)))
+		for _, col := range columns {
+			prop, found := vCardProperties[col]
+			if !found {
+				continue
+			}
+			v := exportText(exportValues[col](row))
+			if len(v) == 0 {
+				continue
+			}
+			if col == `groups` {
+				// CATEGORIES is a list, commas between groups are not escaped
+				escaped := make([]string, len(row.groups))
+				for i, g := range row.groups {
+					escaped[i] = vCardEscape(g)
+				}
+				writeVCardLine(bw, prop+`:`+strings.Join(escaped, `,`))
+				continue
+			}
+			writeVCardLine(bw, prop+`:`+vCardEscape(v))
+		}
+		if (selected[`province`] || selected[`city`]) && len(c.Province+c.City) > 0 {
+			writeVCardLine(bw, fmt.Sprintf(`ADR;TYPE=home:;;;%s;%s;;`,
+				vCardEscape(exportText(c.City)), vCardEscape(exportText(c.Province))))
+		}
+		writeVCardLine(bw, `END:VCARD`)
+	}
+	return bw.Flush()
+}
+
+func vCardEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `,`, `\,`, `;`, `\;`, "\n", `\n`).Replace(s)
+}
+
+// writeVCardLine fold lines longer than 75 octets without splitting a rune.
+func writeVCardLine(w *bufio.Writer, line string) {
+	n := 0
+	for _, r := range line {
+		size := len(string(r))
+		if n+size > 75 {
+			w.WriteString("\r\n ")
+			n = 1
+		}
+		w.WriteRune(r)
+		n += size
+	}
+	w.WriteString("\r\n")
+}
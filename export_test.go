@@ -0,0 +1,133 @@
+package wechat
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func newExportTestBot(contacts ...map[string]interface{}) *WeChat {
+	wechat := &WeChat{cache: newCache()}
+	for _, v := range contacts {
+		wechat.cache.updateContact(v)
+	}
+	return wechat
+}
+
+func TestExportEscaping(t *testing.T) {
+
+	wechat := newExportTestBot(
+		map[string]interface{}{`UserName`: `@a`, `NickName`: "A, \"B\"\nC", `Signature`: `x;y\z`, `Alias`: `a1`, `Type`: Friend},
+		map[string]interface{}{`UserName`: `@@g1`, `NickName`: `山, 水`, `Type`: Group, `MemberList`: []interface{}{
+			map[string]interface{}{`UserName`: `@a`, `NickName`: `A`},
+		}},
+		map[string]interface{}{`UserName`: `@@g2`, `NickName`: `a\b`, `Type`: Group, `MemberList`: []interface{}{
+			map[string]interface{}{`UserName`: `@a`, `NickName`: `A`},
+		}},
+	)
+	opts := ExportOptions{Columns: []string{`id`, `nick_name`, `signature`, `groups`}, Kinds: []ContactKind{KindFriend}}
+
+	var buf bytes.Buffer
+	if err := wechat.ExportContacts(&buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`alias:a1`, `A, "B" C`, `x;y\z`, `a\\b, 山\, 水`}
+	if len(records) != 2 || strings.Join(records[1], `|`) != strings.Join(want, `|`) {
+		t.Errorf(`csv = %q, want %q`, records, want)
+	}
+
+	buf.Reset()
+	opts.Format = ExportJSONLines
+	if err = wechat.ExportContacts(&buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	var row struct {
+		NickName string   `json:"nick_name"`
+		Groups   []string `json:"groups"`
+	}
+	if err = json.Unmarshal(buf.Bytes(), &row); err != nil {
+		t.Fatalf(`json lines %s: %v`, buf.String(), err)
+	}
+	if row.NickName != want[1] || len(row.Groups) != 2 || row.Groups[0] != `a\b` || row.Groups[1] != `山, 水` {
+		t.Errorf(`json lines = %+v`, row)
+	}
+
+	buf.Reset()
+	opts.Format = ExportVCard
+	if err = wechat.ExportContacts(&buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`FN:A\, "B" C`,
+		`NICKNAME:A\, "B" C`,
+		`NOTE:x\;y\\z`,
+		`CATEGORIES:a\\b,山\, 水`,
+	} {
+		if !strings.Contains(buf.String(), line+"\r\n") {
+			t.Errorf(`vcard has no %q:\n%s`, line, buf.String())
+		}
+	}
+}
+
+func TestVCardFolding(t *testing.T) {
+	wechat := newExportTestBot(
+		map[string]interface{}{`UserName`: `@a`, `NickName`: strings.Repeat(`微信`, 20), `Type`: Friend},
+	)
+	var buf bytes.Buffer
+	if err := wechat.ExportContacts(&buf, ExportOptions{Format: ExportVCard, Columns: []string{`nick_name`}}); err != nil {
+		t.Fatal(err)
+	}
+	unfolded := strings.Replace(buf.String(), "\r\n ", ``, -1)
+	if !strings.Contains(unfolded, `NICKNAME:`+strings.Repeat(`微信`, 20)+"\r\n") {
+		t.Fatalf(`folded line is broken:\n%s`, buf.String())
+	}
+	for _, line := range strings.Split(buf.String(), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf(`line of %d octets: %s`, len(line), line)
+		}
+	}
+}
+
+func TestExportMembershipsAcrossSessions(t *testing.T) {
+
+	session := func(suffix string) string {
+		group := map[string]interface{}{`UserName`: `@@g` + suffix, `NickName`: `爬山`, `Type`: Group,
+			`StableID`: `id:g`, `IDConfidence`: 1.0, `MemberList`: []interface{}{
+				map[string]interface{}{`UserName`: `@m1` + suffix, `NickName`: `张三`, `Type`: Member},
+				map[string]interface{}{`UserName`: `@m2` + suffix, `NickName`: `李四`, `DisplayName`: `老李`, `Type`: Member},
+				map[string]interface{}{`UserName`: `@a` + suffix, `NickName`: `Alice`},
+			}}
+		// 后一次会话里顺序不同
+		if len(suffix) > 0 {
+			ms := group[`MemberList`].([]interface{})
+			ms[0], ms[2] = ms[2], ms[0]
+		}
+		wechat := newExportTestBot(
+			map[string]interface{}{`UserName`: `@a` + suffix, `NickName`: `Alice`, `Alias`: `alice`, `Type`: Friend},
+			group,
+		)
+		var buf bytes.Buffer
+		if err := wechat.ExportMemberships(&buf, ExportOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	first, second := session(``), session(`x`)
+	if first != second {
+		t.Errorf("memberships differ between sessions:\n%s\n%s", first, second)
+	}
+	want := "group_id,group_name,member_id,member_name,display_name,member_kind\n" +
+		"id:g,爬山,alias:alice,Alice,,friend\n" +
+		"id:g,爬山,,张三,,member\n" +
+		"id:g,爬山,,李四,老李,member\n"
+	if first != want {
+		t.Errorf("memberships =\n%s\nwant\n%s", first, want)
+	}
+}
@@ -0,0 +1,130 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"html"
+	"io"
+	"strings"
+
+	"github.com/KevinGong2013/wechat/messages"
+)
+
+// ErrNotForwardable is returned when the type of msg can't be forwarded.
+var ErrNotForwardable = errors.New(`message can't be forwarded`)
+
+// ForwardReceipt is the result of forwarding a message to one target.
+type ForwardReceipt struct {
+	To         string
+	Sent       *SentMessage
+	Err        error
+	Reuploaded bool // media was downloaded and uploaded again
+}
+
+// Forward send a received text, image, video, emoticon, file or link to other chats.
+// The server side MediaId or app message xml of the original msg is reused,
+// if server refuse it the media will be downloaded and uploaded again.
+// One receipt per target is returned, err is only for msg can't be forwarded at all.
+func (wechat *WeChat) Forward(ctx context.Context, msg EventMsgData, to ...string) ([]*ForwardReceipt, error) {
+
+	msgType, appMsgType, content, mediaID, err := forwardContent(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	kind, canReupload := reuploadKind(msg)
+	if canReupload {
+		wechat.mediaCache.remember(msg)
+	}
+
+	var receipts []*ForwardReceipt
+
+	for _, t := range to {
+		r := &ForwardReceipt{To: t}
+		r.Sent, r.Err = wechat.SendMsgContext(ctx, messages.NewForwardMsg(msgType, appMsgType, content, mediaID, t))
+		if r.Err != nil && canReupload && ctx.Err() == nil && !isRetryable(r.Err) {
+			logger.Warnf(`forward [%s] by reference failed: %v, will upload again`, msg.MsgID, r.Err)
+			r.Reuploaded = true
+			r.Sent, r.Err = wechat.reupload(ctx, msg, kind, t)
+		}
+		receipts = append(receipts, r)
+	}
+
+	return receipts, nil
+}
+
+// forwardContent pick the types, content and media id used to forward msg.
+func forwardContent(msg EventMsgData) (int, int, string, string, error) {
+
+	m := msg.OriginalMsg
+	mediaID, _ := m[`MediaId`].(string)
+
+	switch msg.MsgType {
+	case 1:
+		return 1, 0, msg.Content, ``, nil
+	case 3, 43, 47:
+		return int(msg.MsgType), 0, rawXMLContent(msg), mediaID, nil
+	case 49:
+		appMsgType, _ := m[`AppMsgType`].(float64)
+		if appMsgType == 0 {
+			return 0, 0, ``, ``, ErrNotForwardable
+		}
+		return 49, int(appMsgType), rawXMLContent(msg), mediaID, nil
+	}
+
+	return 0, 0, ``, ``, ErrNotForwardable
+}
+
+// rawXMLContent is the original xml content without group sender prefix.
+func rawXMLContent(msg EventMsgData) string {
+	content, _ := msg.OriginalMsg[`Content`].(string)
+	if msg.IsGroupMsg {
+		if i := strings.Index(content, `:<br/>`); i >= 0 {
+			content = content[i+len(`:<br/>`):]
+		}
+	}
+	content = strings.Replace(content, `<br/>`, ``, -1)
+	return html.UnescapeString(content)
+}
+
+func reuploadKind(msg EventMsgData) (AttachmentKind, bool) {
+	switch msg.MsgType {
+	case 3:
+		return ImageAttachment, true
+	case 43:
+		return VideoAttachment, true
+	case 47:
+		return EmoticonAttachment, msg.IsMediaMsg
+	case 49:
+		appMsgType, _ := msg.OriginalMsg[`AppMsgType`].(float64)
+		return DocumentAttachment, appMsgType == appMsgTypeAttach
+	}
+	return AutoAttachment, false
+}
+
+// reupload download media of msg through media cache and send it as a new attachment.
+func (wechat *WeChat) reupload(ctx context.Context, msg EventMsgData, kind AttachmentKind, to string) (*SentMessage, error) {
+
+	mr, err := wechat.MediaContext(ctx, msg.MsgID)
+	if err != nil {
+		return nil, err
+	}
+	defer mr.Close()
+
+	// cached media is a file, seek it instead of spooling again
+	var r io.Reader = mr
+	if rs, ok := mr.ReadCloser.(io.ReadSeeker); ok {
+		r = rs
+	}
+
+	m, err := wechat.newAttachmentMsg(ctx, to, Attachment{
+		Name:   mr.FileName,
+		Kind:   kind,
+		Reader: r,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return wechat.SendMsgContext(ctx, m)
+}
@@ -0,0 +1,49 @@
+package wechat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/KevinGong2013/wechat/messages"
+)
+
+func TestForwardPath(t *testing.T) {
+	cases := []struct {
+		msgType    int64
+		appMsgType float64
+		path       string
+		typ        int
+	}{
+		{1, 0, `webwxsendmsg`, 1},
+		{3, 0, `webwxsendmsgimg`, 3},
+		{43, 0, `webwxsendvideomsg`, 43},
+		{47, 0, `webwxsendemoticon`, 47},
+		{49, 5, `webwxsendappmsg`, 5},   // link
+		{49, 3, `webwxsendappmsg`, 3},   // music, same number as image
+		{49, 6, `webwxsendappmsg`, 6},   // file
+		{49, 47, `webwxsendappmsg`, 47}, // same number as emoticon
+	}
+
+	for _, c := range cases {
+		msg := EventMsgData{MsgType: c.msgType, OriginalMsg: map[string]interface{}{
+			`AppMsgType`: c.appMsgType,
+			`Content`:    `<msg/>`,
+		}}
+		msgType, appMsgType, content, mediaID, err := forwardContent(msg)
+		if err != nil {
+			t.Fatalf(`forwardContent(%d/%v): %v`, c.msgType, c.appMsgType, err)
+		}
+		m := messages.NewForwardMsg(msgType, appMsgType, content, mediaID, `filehelper`)
+		if !strings.HasPrefix(m.Path(), c.path) {
+			t.Errorf(`%d/%v is sent by %s, want %s`, c.msgType, c.appMsgType, m.Path(), c.path)
+		}
+		if typ := m.Content()[`Type`]; typ != c.typ {
+			t.Errorf(`%d/%v is sent as Type %v, want %d`, c.msgType, c.appMsgType, typ, c.typ)
+		}
+	}
+
+	msg := EventMsgData{MsgType: 49, OriginalMsg: map[string]interface{}{}}
+	if _, _, _, _, err := forwardContent(msg); err != ErrNotForwardable {
+		t.Errorf(`app msg without AppMsgType: %v`, err)
+	}
+}
@@ -0,0 +1,410 @@
+package wechat
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how a member joined or left a group
+const (
+	GroupJoinInvite   = `invite`
+	GroupJoinQRCode   = `qrcode`
+	GroupLeaveRemoved = `removed`
+	GroupMethodUnknow = `unknow` // found by member list diff, no system message tells why
+)
+
+// EventGroupMemberData is the data of `/group/<group UserName>/join` and `/group/<group UserName>/leave`
+type EventGroupMemberData struct {
+	Group   Contact
+	Member  Contact  // only names are known if Member is not in MemberList
+	Inviter *Contact // who invited, shared the qrcode or removed Member, nil if unknown
+	Method  string   // GroupJoinInvite, GroupJoinQRCode, GroupLeaveRemoved or GroupMethodUnknow
+}
+
+// groupMemberHint is who joined or left told by a system message (MsgType 10000)
+type groupMemberHint struct {
+	userName string // known when the change is made by myself
+	member   string
+	inviter  string // name of inviter, empty means myself
+	method   string
+	join     bool
+}
+
+type groupHints struct {
+	sync.Mutex
+	hints   map[string][]*groupMemberHint // group UserName => hints
+	emitted map[string]time.Time          // see firstEmit
+}
+
+// groupEventDedupWindow is how long an emitted join or leave suppress the same
+// one, a change can be found by member list diff and by a system message later.
+var groupEventDedupWindow = 10 * time.Minute
+
+// groupLocks serialize refreshing of each group, so two refreshes won't diff
+// the same snapshot.
+type groupLocks struct {
+	sync.Mutex
+	locks   map[string]*sync.Mutex
+	pending map[string]bool // refreshGroupLater is waiting
+	partial map[string]bool // reused from cache without some members
+}
+
+// markPartial record that members of group are missing until next refresh,
+// so the refresh won't take them as new members.
+func (gl *groupLocks) markPartial(groupUserName string) {
+	gl.Lock()
+	defer gl.Unlock()
+	if gl.partial == nil {
+		gl.partial = make(map[string]bool)
+	}
+	gl.partial[groupUserName] = true
+}
+
+// takePartial reports and clears whether group is partial.
+func (gl *groupLocks) takePartial(groupUserName string) bool {
+	gl.Lock()
+	defer gl.Unlock()
+	partial := gl.partial[groupUserName]
+	delete(gl.partial, groupUserName)
+	return partial
+}
+
+// refreshGroupLater refresh group in background, requests made before the
+// refresh starts share it, so a burst of messages from new members cause
+// at most one refresh running and one waiting.
+func (wechat *WeChat) refreshGroupLater(groupUserName string) {
+
+	gl := &wechat.groupLocks
+	gl.Lock()
+	if gl.pending == nil {
+		gl.pending = make(map[string]bool)
+	}
+	if gl.pending[groupUserName] {
+		gl.Unlock()
+		return
+	}
+	gl.pending[groupUserName] = true
+	gl.Unlock()
+
+	go func() {
+		l := gl.get(groupUserName)
+		l.Lock()
+		gl.Lock()
+		delete(gl.pending, groupUserName)
+		gl.Unlock()
+		err := wechat.refreshGroupLocked(context.Background(), groupUserName)
+		l.Unlock()
+		if err != nil {
+			logger.Errorf(`sync group [%s] failed: %v`, groupUserName, err)
+		}
+	}()
+}
+
+func (gl *groupLocks) get(groupUserName string) *sync.Mutex {
+	gl.Lock()
+	defer gl.Unlock()
+	if gl.locks == nil {
+		gl.locks = make(map[string]*sync.Mutex)
+	}
+	l, found := gl.locks[groupUserName]
+	if !found {
+		l = new(sync.Mutex)
+		gl.locks[groupUserName] = l
+	}
+	return l
+}
+
+var groupSystemMsgs = []struct {
+	reg    *regexp.Regexp
+	method string
+	join   bool
+}{
+	{regexp.MustCompile(`^(?:你|"(?P<inviter>.+?)")邀请"(?P<members>.+)"加入了群聊`), GroupJoinInvite, true},
+	{regexp.MustCompile(`^"(?P<members>.+?)"通过扫描(?:你|"(?P<inviter>.+?)")分享的二维码加入群聊`), GroupJoinQRCode, true},
+	{regexp.MustCompile(`^(?:你|"(?P<inviter>.+?)")将"(?P<members>.+)"移出了群聊`), GroupLeaveRemoved, false},
+	{regexp.MustCompile(`^(?:You|"(?P<inviter>.+?)") invited "(?P<members>.+)" to the group chat`), GroupJoinInvite, true},
+	{regexp.MustCompile(`^"(?P<members>.+?)" joined the group chat via the QR Code shared by (?:you|"(?P<inviter>.+?)")`), GroupJoinQRCode, true},
+	{regexp.MustCompile(`^(?:You|"(?P<inviter>.+?)") removed "(?P<members>.+)" from the group chat`), GroupLeaveRemoved, false},
+}
+
+// parseGroupSystemMsg parse `"张三"邀请"李四、王五"加入了群聊` like messages.
+func parseGroupSystemMsg(content string) []*groupMemberHint {
+
+	content = strings.NewReplacer(`“`, `"`, `”`, `"`).Replace(normalizeText(content))
+
+	for _, m := range groupSystemMsgs {
+		match := m.reg.FindStringSubmatch(content)
+		if match == nil {
+			continue
+		}
+		var inviter, members string
+		for i, name := range m.reg.SubexpNames() {
+			switch name {
+			case `inviter`:
+				inviter = match[i]
+			case `members`:
+				members = match[i]
+			}
+		}
+		var hints []*groupMemberHint
+		for _, member := range strings.Split(strings.Replace(members, `", "`, `、`, -1), `、`) {
+			hints = append(hints, &groupMemberHint{
+				member:  member,
+				inviter: inviter,
+				method:  m.method,
+				join:    m.join,
+			})
+		}
+		return hints
+	}
+
+	return nil
+}
+
+// collectGroupHints keep hints of group system messages until groups are refreshed,
+// returns UserName of the groups.
+func (wechat *WeChat) collectGroupHints(msgs []map[string]interface{}) []string {
+
+	wechat.groupHints.Lock()
+	defer wechat.groupHints.Unlock()
+
+	var groups []string
+	for _, m := range msgs {
+		msgType, _ := m[`MsgType`].(float64)
+		from, _ := m[`FromUserName`].(string)
+		content, _ := m[`Content`].(string)
+		if msgType != 10000 || !strings.HasPrefix(from, `@@`) {
+			continue
+		}
+		hints := parseGroupSystemMsg(content)
+		if len(hints) == 0 {
+			continue
+		}
+		if _, found := wechat.groupHints.hints[from]; !found {
+			groups = append(groups, from)
+		}
+		wechat.groupHints.add(from, hints)
+	}
+
+	return groups
+}
+
+func (wechat *WeChat) addGroupHints(group string, hints []*groupMemberHint) {
+	wechat.groupHints.Lock()
+	defer wechat.groupHints.Unlock()
+	wechat.groupHints.add(group, hints)
+}
+
+// add must be called with lock held.
+func (gh *groupHints) add(group string, hints []*groupMemberHint) {
+	if gh.hints == nil {
+		gh.hints = make(map[string][]*groupMemberHint)
+	}
+	gh.hints[group] = append(gh.hints[group], hints...)
+}
+
+// takeGroupHint remove and return the hint about member.
+func (wechat *WeChat) takeGroupHint(group string, member *Contact, join bool) *groupMemberHint {
+
+	wechat.groupHints.Lock()
+	defer wechat.groupHints.Unlock()
+
+	hints := wechat.groupHints.hints[group]
+	for i, h := range hints {
+		if h.join == join && h.matches(member) {
+			wechat.groupHints.hints[group] = append(hints[:i], hints[i+1:]...)
+			return h
+		}
+	}
+	return nil
+}
+
+// diffGroupMembers emit join and leave events between two snapshots of group.
+func (wechat *WeChat) diffGroupMembers(old, group *Contact) {
+
+	olds := make(map[string]*Contact)
+	for _, m := range old.MemberList {
+		olds[m.UserName] = m
+	}
+	news := make(map[string]*Contact)
+	for _, m := range group.MemberList {
+		news[m.UserName] = m
+	}
+
+	for un, m := range news {
+		if _, found := olds[un]; !found {
+			hint := wechat.takeGroupHint(group.UserName, m, true)
+			wechat.emitGroupMemberEvent(group, m, hint, old, true)
+		}
+	}
+	for un, m := range olds {
+		if _, found := news[un]; !found {
+			hint := wechat.takeGroupHint(group.UserName, m, false)
+			wechat.emitGroupMemberEvent(group, m, hint, old, false)
+		}
+	}
+}
+
+// flushGroupHints emit events of hints not matched by member list diff,
+// members of them are only known by name.
+func (wechat *WeChat) flushGroupHints(groupUserName string) {
+
+	wechat.groupHints.Lock()
+	hints := wechat.groupHints.hints[groupUserName]
+	delete(wechat.groupHints.hints, groupUserName)
+	wechat.groupHints.Unlock()
+
+	if len(hints) == 0 {
+		return
+	}
+
+	group := wechat.cache.snapshot(groupUserName)
+	if group == nil {
+		group = &Contact{UserName: groupUserName}
+	}
+
+	for _, h := range hints {
+		if len(h.userName) > 0 {
+			// made by myself but not seen in member list, e.g. member blocked me
+			logger.Warnf(`[%s] is not changed in group [%s]`, h.userName, groupUserName)
+			continue
+		}
+		var member *Contact
+		for _, m := range group.MemberList {
+			if h.matches(m) {
+				member = m
+				break
+			}
+		}
+		if member == nil {
+			member = &Contact{NickName: h.member}
+		}
+		wechat.emitGroupMemberEvent(group, member, h, group, h.join)
+	}
+}
+
+func (h *groupMemberHint) matches(member *Contact) bool {
+	if len(h.userName) > 0 {
+		return h.userName == member.UserName
+	}
+	return h.member == member.NickName || h.member == member.DisplayName
+}
+
+func findMemberByName(members []*Contact, name string) *Contact {
+	for _, m := range members {
+		if m.NickName == name || m.DisplayName == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// firstEmit record a join or leave, returns false if it is emitted within
+// groupEventDedupWindow. A member only known by name from a system message
+// is the same as a member of that name.
+func (gh *groupHints) firstEmit(group string, member *Contact, join bool, now time.Time) bool {
+
+	gh.Lock()
+	defer gh.Unlock()
+
+	if gh.emitted == nil {
+		gh.emitted = make(map[string]time.Time)
+	}
+	for k, t := range gh.emitted {
+		if now.Sub(t) > groupEventDedupWindow {
+			delete(gh.emitted, k)
+		}
+	}
+
+	keys := func(join bool) (record, check []string) {
+		prefix := group + `|leave|`
+		if join {
+			prefix = group + `|join|`
+		}
+		for _, name := range []string{member.NickName, member.DisplayName} {
+			if len(name) == 0 {
+				continue
+			}
+			check = append(check, prefix+`hint:`+name)
+			if len(member.UserName) > 0 {
+				record = append(record, prefix+`name:`+name)
+			} else {
+				record = append(record, prefix+`hint:`+name)
+				check = append(check, prefix+`name:`+name)
+			}
+		}
+		if len(member.UserName) > 0 {
+			record = append(record, prefix+`un:`+member.UserName)
+			check = append(check, prefix+`un:`+member.UserName)
+		}
+		return record, check
+	}
+
+	record, check := keys(join)
+	for _, k := range check {
+		if _, found := gh.emitted[k]; found {
+			return false
+		}
+	}
+	for _, k := range record {
+		gh.emitted[k] = now
+	}
+	// 退群后又进群的不算重复
+	opposite, _ := keys(!join)
+	for _, k := range opposite {
+		delete(gh.emitted, k)
+	}
+	return true
+}
+
+// emitGroupMemberEvent resolve inviter of hint in members of old and emit event.
+func (wechat *WeChat) emitGroupMemberEvent(group, member *Contact, hint *groupMemberHint, old *Contact, join bool) {
+
+	if !wechat.groupHints.firstEmit(group.UserName, member, join, time.Now()) {
+		logger.Debugf(`join or leave of [%s] in group [%s] is emitted already`, nameInGroup(member), group.UserName)
+		return
+	}
+
+	data := EventGroupMemberData{
+		Group:  *group,
+		Member: *member,
+		Method: GroupMethodUnknow,
+	}
+
+	if hint != nil {
+		data.Method = hint.method
+		if len(hint.inviter) == 0 {
+			data.Inviter = wechat.myselfCopy()
+		} else if inviter := findMemberByName(group.MemberList, hint.inviter); inviter != nil {
+			data.Inviter = inviter
+		} else if inviter := findMemberByName(old.MemberList, hint.inviter); inviter != nil {
+			data.Inviter = inviter
+		} else {
+			data.Inviter = &Contact{NickName: hint.inviter}
+		}
+	}
+
+	route := `/leave`
+	if join {
+		route = `/join`
+	}
+
+	wechat.emitGroupEvent(group, route, data)
+}
+
+func (wechat *WeChat) emitGroupEvent(group *Contact, route string, data interface{}) {
+	event := Event{
+		Type: `GroupMemberChange`,
+		From: `Server`,
+		Path: `/group/` + group.UserName + route,
+		To:   `End`,
+		Time: time.Now().Unix(),
+		Data: data,
+	}
+	go func() {
+		wechat.evtStream.serverEvt <- event
+	}()
+}
@@ -0,0 +1,161 @@
+package wechat
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// drainGroupEvents returns paths of group events emitted in a short while.
+func drainGroupEvents(es *evtStream) []string {
+	var paths []string
+	for {
+		select {
+		case evt := <-es.serverEvt:
+			paths = append(paths, evt.Path)
+		case <-time.After(50 * time.Millisecond):
+			return paths
+		}
+	}
+}
+
+func TestGroupMemberEventDedup(t *testing.T) {
+
+	wechat := &WeChat{cache: newCache(), evtStream: newEvtStream()}
+	old := &Contact{UserName: `@@g`, MemberList: []*Contact{{UserName: `@a`, NickName: `甲`}}}
+	group := &Contact{UserName: `@@g`, MemberList: []*Contact{
+		{UserName: `@a`, NickName: `甲`},
+		{UserName: `@b`, NickName: `张三`},
+	}}
+	wechat.cache.contacts[`@@g`] = group
+
+	// two refreshes diff the same change
+	wechat.diffGroupMembers(old, group)
+	wechat.diffGroupMembers(old, group)
+	if paths := drainGroupEvents(wechat.evtStream); len(paths) != 1 || paths[0] != `/group/@@g/join` {
+		t.Fatalf(`diff twice emits %v`, paths)
+	}
+
+	// system message of the same join comes later
+	wechat.addGroupHints(`@@g`, parseGroupSystemMsg(`"甲"邀请"张三"加入了群聊`))
+	wechat.flushGroupHints(`@@g`)
+	if paths := drainGroupEvents(wechat.evtStream); len(paths) != 0 {
+		t.Fatalf(`hint of emitted join emits %v`, paths)
+	}
+
+	// left and joined again
+	wechat.diffGroupMembers(group, old)
+	wechat.diffGroupMembers(old, group)
+	if paths := drainGroupEvents(wechat.evtStream); len(paths) != 2 {
+		t.Fatalf(`leave and join again emits %v`, paths)
+	}
+
+	// a name only hint first, then the diff
+	wechat.addGroupHints(`@@g`, parseGroupSystemMsg(`"甲"邀请"李四"加入了群聊`))
+	wechat.flushGroupHints(`@@g`)
+	newer := &Contact{UserName: `@@g`, MemberList: append(group.MemberList, &Contact{UserName: `@c`, NickName: `李四`})}
+	wechat.diffGroupMembers(group, newer)
+	if paths := drainGroupEvents(wechat.evtStream); len(paths) != 1 {
+		t.Fatalf(`hint then diff emits %v`, paths)
+	}
+}
+
+func TestOwnGroupChangeNotEmittedTwice(t *testing.T) {
+
+	wechat := &WeChat{cache: newCache(), evtStream: newEvtStream()}
+	old := &Contact{UserName: `@@g`, MemberList: []*Contact{{UserName: `@a`, NickName: `甲`}}}
+	group := &Contact{UserName: `@@g`, MemberList: []*Contact{
+		{UserName: `@a`, NickName: `甲`},
+		{UserName: `@b`, NickName: `张三`},
+	}}
+	wechat.cache.contacts[`@@g`] = group
+
+	// AddGroupMembers
+	wechat.addGroupHints(`@@g`, []*groupMemberHint{{userName: `@b`, method: GroupJoinInvite, join: true}})
+	wechat.diffGroupMembers(old, group)
+	wechat.flushGroupHints(`@@g`)
+
+	// 10000 message of the same change
+	wechat.addGroupHints(`@@g`, parseGroupSystemMsg(`你邀请"张三"加入了群聊`))
+	wechat.flushGroupHints(`@@g`)
+
+	if paths := drainGroupEvents(wechat.evtStream); len(paths) != 1 {
+		t.Fatalf(`own change emits %v`, paths)
+	}
+}
+
+func TestDisplayNameInGroup(t *testing.T) {
+
+	wechat := &WeChat{cache: newCache()}
+	wechat.cache.contacts[`@@g`] = &Contact{UserName: `@@g`, MemberList: []*Contact{
+		{UserName: `@a`, DisplayName: `群名片`},
+		{UserName: `@b`},
+	}}
+
+	cases := []struct {
+		member  *Contact
+		name    string
+		inGroup bool
+	}{
+		{&Contact{UserName: `@a`, NickName: `甲`, DisplayName: `别的群`}, `群名片`, true},
+		{&Contact{UserName: `@b`, NickName: `乙`, RemarkName: `老乙`, DisplayName: `别的群`}, `老乙`, true},
+		{&Contact{UserName: `@b`, NickName: `乙`, DisplayName: `别的群`}, `乙`, true},
+		{&Contact{UserName: `@c`, NickName: `丙`}, `丙`, false},
+	}
+	for _, c := range cases {
+		name, inGroup := wechat.displayNameInGroup(`@@g`, c.member)
+		if name != c.name || inGroup != c.inGroup {
+			t.Errorf(`displayNameInGroup(%s) = %s, %v, want %s, %v`, c.member.UserName, name, inGroup, c.name, c.inGroup)
+		}
+	}
+}
+
+func TestGroupChangeReloadError(t *testing.T) {
+
+	var block int32
+	release := make(chan struct{})
+	wechat, done := newServerTestBot(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, `webwxupdatechatroom`) {
+			w.Write([]byte(`{"BaseResponse":{"Ret":0}}`))
+			return
+		}
+		if atomic.LoadInt32(&block) == 1 {
+			<-release
+			return
+		}
+		w.Write([]byte(`{"BaseResponse":{"Ret":1100}}`))
+	}))
+	defer done()
+	defer close(release)
+
+	wechat.cache.updateContact(map[string]interface{}{`UserName`: `@@g`, `NickName`: `群`, `Type`: Group})
+
+	if err := wechat.RenameGroup(context.Background(), `@@g`, `新群名`); err == nil {
+		t.Error(`rename returns no error when group can't be reloaded`)
+	}
+	if err := wechat.AddGroupMembers(context.Background(), `@@g`, []string{`@a`}); err == nil {
+		t.Error(`add members returns no error when group can't be reloaded`)
+	}
+	if paths := drainGroupEvents(wechat.evtStream); len(paths) != 0 {
+		t.Errorf(`failed reload emits %v`, paths)
+	}
+
+	atomic.StoreInt32(&block, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	finished := make(chan error, 1)
+	go func() {
+		finished <- wechat.RemoveGroupMembers(ctx, `@@g`, []string{`@a`})
+	}()
+	select {
+	case err := <-finished:
+		if err == nil {
+			t.Error(`canceled reload returns no error`)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`reload ignores ctx`)
+	}
+}
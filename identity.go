@@ -0,0 +1,403 @@
+package wechat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContactID is a stable identity of contact across sessions, UserName is not.
+type ContactID string
+
+// EventRemapData is the data of `/identity/remap`, emitted after re-login.
+type EventRemapData struct {
+	Mapping map[string]string // old UserName => new UserName
+}
+
+// EventAmbiguousData is the data of `/identity/ambiguous`,
+// contacts in Old and New share the same ContactID so they can't be mapped.
+type EventAmbiguousData struct {
+	ID  ContactID
+	Old []Contact
+	New []Contact
+}
+
+// weights of the fields compared when matching a contact of last session
+// which has no Uin or Alias, see matchScore.
+var identityWeights = []struct {
+	field  func(c *Contact) string
+	weight float64
+}{
+	{func(c *Contact) string { return c.RemarkName }, 0.3},
+	{func(c *Contact) string { return c.NickName }, 0.25},
+	{func(c *Contact) string { return c.HeadHash }, 0.25},
+	{func(c *Contact) string { return c.Province + c.City }, 0.1},
+	{func(c *Contact) string { return sexString(c.Sex) }, 0.1},
+	{func(c *Contact) string { return countString(c.MemberCount) }, 0.25}, // groups only
+	{func(c *Contact) string { return c.DisplayName }, 0.25},              // members only
+}
+
+// coMemberWeight is added to score of two members in a pair of matched groups.
+var coMemberWeight = 0.25
+
+// identityMatchThreshold is the lowest score to carry an assigned ID over,
+// e.g. same NickName and avatar, same RemarkName and NickName, for groups
+// same NickName and member count, for members same NickName in the same group.
+var identityMatchThreshold = 0.5
+
+func countString(n int) string {
+	if n == 0 {
+		return ``
+	}
+	return fmt.Sprint(n)
+}
+
+func sexString(sex float64) string {
+	if sex == 0 {
+		return ``
+	}
+	return fmt.Sprint(sex)
+}
+
+// ID returns stable identity of contact and the confidence in [0, 1].
+// Uin or Alias is used when server tells. Otherwise an ID is assigned when
+// the contact is first seen and carried to next session if the contact
+// matches fuzzily, the confidence is the match score then. A contact not
+// synced, or a group member not matched with one of last session yet, is
+// identified by UserName for this session only with confidence 0.
+func (contact *Contact) ID() (ContactID, float64) {
+	if id := contact.stableKey(); len(id) > 0 {
+		return id, 1
+	}
+	if len(contact.StableID) > 0 && contact.IDConfidence > 0 {
+		return contact.StableID, contact.IDConfidence
+	}
+	return ContactID(`un:` + contact.UserName), 0
+}
+
+// stableKey is the ID from fields server keeps across sessions, empty if unknown.
+func (contact *Contact) stableKey() ContactID {
+	if contact.Uin != 0 {
+		return ContactID(fmt.Sprintf(`uin:%d`, contact.Uin))
+	}
+	if len(contact.Alias) > 0 {
+		return ContactID(`alias:` + contact.Alias)
+	}
+	return ``
+}
+
+// assignID give contact a new ID if it can't be identified by stable fields.
+// ID of a group member is not used until it matches in next session, members
+// are many and have few fields to tell who they are.
+func (contact *Contact) assignID() {
+	if len(contact.stableKey()) > 0 {
+		return
+	}
+	if len(contact.StableID) == 0 {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			logger.Warnf(`generate id of [%s] failed: %v`, contact.UserName, err)
+			return
+		}
+		contact.StableID = ContactID(`id:` + hex.EncodeToString(b))
+	}
+	// 成了好友的群成员
+	if contact.Type != Member && contact.IDConfidence == 0 {
+		contact.IDConfidence = 1
+	}
+}
+
+// matchScore tell how likely a and b are the same contact, a group never
+// matches a person.
+func matchScore(a, b *Contact) float64 {
+	if isGroupUserName(a.UserName) != isGroupUserName(b.UserName) {
+		return 0
+	}
+	score := 0.0
+	for _, w := range identityWeights {
+		if v := w.field(a); len(v) > 0 && v == w.field(b) {
+			score += w.weight
+		}
+	}
+	return math.Min(score, 1)
+}
+
+func isGroupUserName(un string) bool {
+	return strings.HasPrefix(un, `@@`)
+}
+
+// identities remember how UserName of last session map to current session.
+type identities struct {
+	sync.RWMutex
+	mapping map[string]string
+}
+
+// identityMatch pair a contact of last session with one of this session.
+type identityMatch struct {
+	old, new *Contact
+	score    float64
+}
+
+// matchContacts pair contacts of two sessions, by Uin or Alias first, then
+// the others by matchScore if it is not less than identityMatchThreshold.
+// Contacts which match more than one on the other side are ambiguous.
+func matchContacts(olds, news map[string]*Contact) ([]identityMatch, []EventAmbiguousData) {
+
+	var matches []identityMatch
+	var ambiguous []EventAmbiguousData
+	matched := make(map[*Contact]bool)
+
+	ambiguity := func(id ContactID, ocs, ncs []*Contact) {
+		data := EventAmbiguousData{ID: id}
+		for _, c := range ocs {
+			data.Old = append(data.Old, *c)
+		}
+		for _, c := range ncs {
+			data.New = append(data.New, *c)
+		}
+		ambiguous = append(ambiguous, data)
+	}
+
+	byKey := func(cs map[string]*Contact) map[ContactID][]*Contact {
+		m := make(map[ContactID][]*Contact)
+		for _, c := range cs {
+			if key := c.stableKey(); len(key) > 0 {
+				m[key] = append(m[key], c)
+			}
+		}
+		return m
+	}
+
+	oldByKey := byKey(olds)
+	for key, ncs := range byKey(news) {
+		ocs, found := oldByKey[key]
+		if !found {
+			continue
+		}
+		if len(ocs) == 1 && len(ncs) == 1 {
+			matches = append(matches, identityMatch{ocs[0], ncs[0], 1})
+			matched[ocs[0]], matched[ncs[0]] = true, true
+			continue
+		}
+		ambiguity(key, ocs, ncs)
+	}
+
+	// 其余的按名字和头像找候选, 不用两两比较, 群成员在群对应好之后再找
+	var others, members []*Contact
+	for _, n := range news {
+		if matched[n] {
+			continue
+		}
+		if n.Type == Member {
+			members = append(members, n)
+		} else {
+			others = append(others, n)
+		}
+	}
+
+	fuzzy := func(news []*Contact, bonus func(o, n *Contact) float64) {
+
+		candidates := make(map[string][]*Contact)
+		for _, c := range olds {
+			if matched[c] {
+				continue
+			}
+			for _, k := range matchKeys(c) {
+				candidates[k] = append(candidates[k], c)
+			}
+		}
+
+		proposals := make(map[*Contact][]identityMatch)
+		for _, n := range news {
+
+			var best []*Contact
+			bestScore := 0.0
+			seen := make(map[*Contact]bool)
+			for _, k := range matchKeys(n) {
+				for _, o := range candidates[k] {
+					if seen[o] {
+						continue
+					}
+					seen[o] = true
+					// Uin 或 Alias 不同的一定不是同一个人
+					if len(o.stableKey()) > 0 && len(n.stableKey()) > 0 {
+						continue
+					}
+					score := matchScore(o, n)
+					if bonus != nil {
+						score = math.Min(score+bonus(o, n), 1)
+					}
+					if score < identityMatchThreshold || score < bestScore {
+						continue
+					}
+					if score > bestScore {
+						best, bestScore = nil, score
+					}
+					best = append(best, o)
+				}
+			}
+
+			switch len(best) {
+			case 0:
+			case 1:
+				proposals[best[0]] = append(proposals[best[0]], identityMatch{best[0], n, bestScore})
+			default:
+				id, _ := best[0].ID()
+				ambiguity(id, best, []*Contact{n})
+			}
+		}
+
+		for o, ms := range proposals {
+			if len(ms) == 1 {
+				matches = append(matches, ms[0])
+				matched[o], matched[ms[0].new] = true, true
+				continue
+			}
+			ncs := make([]*Contact, 0, len(ms))
+			for _, m := range ms {
+				ncs = append(ncs, m.new)
+			}
+			id, _ := o.ID()
+			ambiguity(id, []*Contact{o}, ncs)
+		}
+	}
+
+	fuzzy(others, nil)
+
+	if len(members) > 0 {
+		// 成员在对应好的一对群里, 分别是 新群 UserName 的集合
+		oldIn := make(map[string]map[string]bool)
+		newIn := make(map[string]map[string]bool)
+		in := func(sets map[string]map[string]bool, un, group string) {
+			if sets[un] == nil {
+				sets[un] = make(map[string]bool)
+			}
+			sets[un][group] = true
+		}
+		for _, m := range matches {
+			if !isGroupUserName(m.new.UserName) {
+				continue
+			}
+			for _, c := range m.old.MemberList {
+				in(oldIn, c.UserName, m.new.UserName)
+			}
+			for _, c := range m.new.MemberList {
+				in(newIn, c.UserName, m.new.UserName)
+			}
+		}
+		fuzzy(members, func(o, n *Contact) float64 {
+			for g := range oldIn[o.UserName] {
+				if newIn[n.UserName][g] {
+					return coMemberWeight
+				}
+			}
+			return 0
+		})
+	}
+
+	return matches, ambiguous
+}
+
+// matchKeys are the fields two contacts must share one of to be matched.
+func matchKeys(c *Contact) []string {
+	var keys []string
+	if len(c.RemarkName) > 0 {
+		keys = append(keys, `r:`+c.RemarkName)
+	}
+	if len(c.NickName) > 0 {
+		keys = append(keys, `n:`+c.NickName)
+	}
+	if len(c.HeadHash) > 0 {
+		keys = append(keys, `h:`+c.HeadHash)
+	}
+	if len(c.DisplayName) > 0 {
+		keys = append(keys, `d:`+c.DisplayName)
+	}
+	return keys
+}
+
+// remapContacts is called when contacts of a new session replace the old ones,
+// assigned IDs of matched contacts are carried over. Must be called with cache
+// lock held.
+func (wechat *WeChat) remapContacts(olds, news map[string]*Contact) map[string]string {
+
+	matches, ambiguous := matchContacts(olds, news)
+
+	mapping := make(map[string]string, len(matches))
+	for _, m := range matches {
+		mapping[m.old.UserName] = m.new.UserName
+		if len(m.new.stableKey()) == 0 && len(m.old.StableID) > 0 {
+			wechat.cache.unindexContact(m.new)
+			m.new.StableID = m.old.StableID
+			m.new.IDConfidence = m.score
+			wechat.cache.indexContact(m.new)
+		}
+	}
+
+	changed := 0
+	for o, n := range mapping {
+		if o != n {
+			changed++
+		}
+	}
+
+	wechat.identities.Lock()
+	wechat.identities.mapping = mapping
+	wechat.identities.Unlock()
+
+	if changed > 0 {
+		logger.Infof(`%d contact(s) got new UserName, %d ambiguous`, changed, len(ambiguous))
+		wechat.emitIdentityEvent(`/identity/remap`, EventRemapData{Mapping: mapping})
+	}
+	for _, data := range ambiguous {
+		wechat.emitIdentityEvent(`/identity/ambiguous`, data)
+	}
+
+	return mapping
+}
+
+func (wechat *WeChat) emitIdentityEvent(path string, data interface{}) {
+	event := Event{
+		Type: `ContactIdentity`,
+		From: `Wechat`,
+		Path: path,
+		To:   `End`,
+		Time: time.Now().Unix(),
+		Data: data,
+	}
+	go func() {
+		wechat.evtStream.serverEvt <- event
+	}()
+}
+
+// ResolveUserName returns the UserName in current session of a UserName
+// stored in a previous session.
+func (wechat *WeChat) ResolveUserName(old string) (string, bool) {
+	wechat.identities.RLock()
+	defer wechat.identities.RUnlock()
+	un, found := wechat.identities.mapping[old]
+	return un, found
+}
+
+// UserNameMapping returns a copy of old UserName => new UserName of last re-login.
+func (wechat *WeChat) UserNameMapping() map[string]string {
+	wechat.identities.RLock()
+	defer wechat.identities.RUnlock()
+	m := make(map[string]string, len(wechat.identities.mapping))
+	for k, v := range wechat.identities.mapping {
+		m[k] = v
+	}
+	return m
+}
+
+// ContactByID find contact in current session by its stable identity.
+func (wechat *WeChat) ContactByID(id ContactID) *Contact {
+	c := wechat.cache
+	c.Lock()
+	defer c.Unlock()
+	return c.contacts[c.ids[id]]
+}
@@ -0,0 +1,144 @@
+package wechat
+
+import "testing"
+
+func TestContactID(t *testing.T) {
+	c := &Contact{UserName: `@a`, Uin: 42, Alias: `tom`, NickName: `Tom`}
+	if id, confidence := c.ID(); id != `uin:42` || confidence != 1 {
+		t.Errorf(`ID() = %s %v`, id, confidence)
+	}
+
+	c.Uin = 0
+	c.NickName, c.RemarkName, c.HeadHash = `Tommy`, `汤姆`, `ffff`
+	if id, _ := c.ID(); id != `alias:tom` {
+		t.Errorf(`ID() = %s after rename`, id)
+	}
+
+	// sparse contacts and unnamed groups must not collide
+	a, b := &Contact{UserName: `@@x`}, &Contact{UserName: `@@y`}
+	a.assignID()
+	b.assignID()
+	ida, _ := a.ID()
+	idb, _ := b.ID()
+	if ida == idb {
+		t.Errorf(`two unnamed groups got the same ID %s`, ida)
+	}
+
+	a.NickName = `renamed`
+	if id, _ := a.ID(); id != ida {
+		t.Errorf(`ID changed from %s to %s by rename`, ida, id)
+	}
+
+	if id, confidence := (&Contact{UserName: `@m`}).ID(); id != `un:@m` || confidence != 0 {
+		t.Errorf(`unassigned ID() = %s %v`, id, confidence)
+	}
+}
+
+func TestRemapContacts(t *testing.T) {
+
+	olds := map[string]*Contact{
+		`@old1`: {UserName: `@old1`, Uin: 1, NickName: `A`},
+		`@old2`: {UserName: `@old2`, NickName: `Bob`, HeadHash: `h2`, StableID: `id:2`, IDConfidence: 1},
+		`@old3`: {UserName: `@old3`, NickName: `Carol`, StableID: `id:3`, IDConfidence: 1},
+		`@old4`: {UserName: `@old4`, NickName: `Dan`, HeadHash: `h4`, StableID: `id:4`, IDConfidence: 1},
+		`@old5`: {UserName: `@old5`, NickName: `Dan`, HeadHash: `h4`, StableID: `id:5`, IDConfidence: 1},
+	}
+
+	wechat := &WeChat{cache: newCache(), evtStream: newEvtStream()}
+	for _, m := range []map[string]interface{}{
+		{`UserName`: `@new1`, `Uin`: 1, `NickName`: `A2`},
+		{`UserName`: `@new2`, `NickName`: `Bob`, `HeadHash`: `h2`, `RemarkName`: `老鲍`}, // remark added
+		{`UserName`: `@new3`, `NickName`: `Carol`},                                     // score too low
+		{`UserName`: `@new4`, `NickName`: `Dan`, `HeadHash`: `h4`},                     // two olds match
+	} {
+		wechat.cache.updateContact(m)
+	}
+
+	wechat.cache.Lock()
+	mapping := wechat.remapContacts(olds, wechat.cache.contacts)
+	wechat.cache.Unlock()
+
+	want := map[string]string{`@old1`: `@new1`, `@old2`: `@new2`}
+	if len(mapping) != len(want) {
+		t.Fatalf(`mapping = %v, want %v`, mapping, want)
+	}
+	for o, n := range want {
+		if mapping[o] != n {
+			t.Errorf(`%s => %s, want %s`, o, mapping[o], n)
+		}
+	}
+
+	if c := wechat.ContactByID(`id:2`); c == nil || c.UserName != `@new2` {
+		t.Errorf(`ContactByID(id:2) = %v`, c)
+	} else if _, confidence := c.ID(); confidence != matchScore(olds[`@old2`], c) {
+		t.Errorf(`confidence of carried ID is %v`, confidence)
+	}
+	if c := wechat.ContactByID(`uin:1`); c == nil || c.UserName != `@new1` {
+		t.Errorf(`ContactByID(uin:1) = %v`, c)
+	}
+	if wechat.ContactByID(`id:3`) != nil || wechat.ContactByID(`id:4`) != nil {
+		t.Error(`ID carried by a weak or ambiguous match`)
+	}
+	if id, _ := wechat.cache.contacts[`@new3`].ID(); id == `id:3` || len(id) == 0 {
+		t.Errorf(`unmatched contact got ID %s`, id)
+	}
+}
+
+// session returns contacts of a new session remapped from olds.
+func session(olds map[string]*Contact, suffix string) map[string]*Contact {
+
+	wechat := &WeChat{cache: newCache(), evtStream: newEvtStream()}
+	member := func(un, nick, display string) map[string]interface{} {
+		return map[string]interface{}{`UserName`: un + suffix, `NickName`: nick, `DisplayName`: display, `Type`: Member}
+	}
+	cts := []map[string]interface{}{
+		{`UserName`: `@@g` + suffix, `NickName`: `同学群`, `MemberCount`: 3, `Type`: Group, `MemberList`: []interface{}{
+			member(`@zhang`, `张三`, `小张`), member(`@li`, `李四`, ``), member(`@wang`, `王五`, ``),
+		}},
+		{`UserName`: `@@h` + suffix, `NickName`: `家长群`, `MemberCount`: 1, `Type`: Group, `MemberList`: []interface{}{
+			member(`@wang2`, `王五`, ``),
+		}},
+		member(`@zhang`, `张三`, `小张`),
+		member(`@li`, `李四`, ``),
+		member(`@wang`, `王五`, ``),
+		member(`@wang2`, `王五`, ``),
+	}
+	for _, v := range cts {
+		wechat.cache.updateContact(v)
+	}
+	if olds != nil {
+		wechat.cache.Lock()
+		wechat.remapContacts(olds, wechat.cache.contacts)
+		wechat.cache.Unlock()
+	}
+	return wechat.cache.contacts
+}
+
+func TestMemberIDAcrossSessions(t *testing.T) {
+
+	first := session(nil, `1`)
+	if id, confidence := first[`@zhang1`].ID(); id != `un:@zhang1` || confidence != 0 {
+		t.Fatalf(`member of first session has ID %s %v`, id, confidence)
+	}
+
+	second := session(first, `2`)
+	third := session(second, `3`)
+
+	for _, un := range []string{`@zhang`, `@li`, `@wang`, `@wang2`} {
+		id2, confidence := second[un+`2`].ID()
+		if confidence < identityMatchThreshold {
+			t.Errorf(`%s is not matched in second session: %s %v`, un, id2, confidence)
+			continue
+		}
+		if id3, _ := third[un+`3`].ID(); id3 != id2 {
+			t.Errorf(`ID of %s changed from %s to %s`, un, id2, id3)
+		}
+	}
+
+	// 同名的王五在不同的群里, 不会混
+	a, _ := third[`@wang3`].ID()
+	b, _ := third[`@wang23`].ID()
+	if a == b {
+		t.Errorf(`members of same name in different groups share ID %s`, a)
+	}
+}
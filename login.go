@@ -12,6 +12,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -300,11 +301,27 @@ func (wechat *WeChat) init() error {
 	wechat.BaseRequest.Skey = resp.Skey
 
 	wechat.MySelf = resp.User
+	wechat.MySelf.normalize()
+	wechat.MySelf.Type = Self
 	wechat.syncKey = resp.SyncKey
 
 	return nil
 }
 
+// LoggedIn tell whether the session is alive, it's safe to call in any goroutine.
+func (wechat *WeChat) LoggedIn() bool {
+	return atomic.LoadInt32(&wechat.loggedIn) == 1
+}
+
+func (wechat *WeChat) setLogin(login bool) {
+	var v int32
+	if login {
+		v = 1
+	}
+	atomic.StoreInt32(&wechat.loggedIn, v)
+	wechat.IsLogin = login
+}
+
 func (wechat *WeChat) keepAlive() {
 	go func() {
 
@@ -330,10 +347,11 @@ func (wechat *WeChat) keepAlive() {
 		}
 		logger.Info(`sync contact successfully`)
 
-		wechat.IsLogin = true
+		wechat.setLogin(true)
 		wechat.loginState <- 1
 		err = wechat.beginSync()
-		wechat.IsLogin = false
+		wechat.setLogin(false)
+		wechat.cache.flush(wechat.conf.contactCachePath())
 		wechat.loginState <- -1
 
 		logger.Errorf(`sync error: %v`, err)
@@ -0,0 +1,213 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/h2non/filetype.v1"
+	"gopkg.in/h2non/filetype.v1/types"
+)
+
+// ErrEmptyMedia is returned when there is nothing to upload.
+var ErrEmptyMedia = errors.New(`media is empty`)
+
+// MediaError records a failed step while preparing an attachment.
+type MediaError struct {
+	Op   string // read, spool, seek
+	Name string
+	Err  error
+}
+
+func (e *MediaError) Error() string {
+	return fmt.Sprintf(`%s media [%s] failed: %v`, e.Op, e.Name, e.Err)
+}
+
+// sniffLen is the count of bytes filetype need to detect the type.
+const sniffLen = 261
+
+// preparedMedia is an attachment which is hashed and sniffed, ready to upload.
+type preparedMedia struct {
+	MediaInfo
+	Size      int64
+	Extension string
+
+	head   []byte
+	reader io.Reader
+	spool  *os.File
+}
+
+// close remove the spooled temp file if any.
+func (pm *preparedMedia) close() {
+	if pm.spool != nil {
+		pm.spool.Close()
+		os.Remove(pm.spool.Name())
+	}
+}
+
+func (pm *preparedMedia) isImage() bool {
+	return pm.MediaType == `pic`
+}
+
+func (pm *preparedMedia) isVideo() bool {
+	return pm.MediaType == `video`
+}
+
+// prepareMedia read r once to compute the md5 and sniff the type.
+// A io.ReadSeeker is rewound after hashing, any other reader is spooled
+// into a temp file under CachePath, so the content never hold in memory.
+func (wechat *WeChat) prepareMedia(r io.Reader, name string, modTime time.Time) (*preparedMedia, error) {
+
+	pm := &preparedMedia{}
+	pm.Name = name
+	pm.ModTime = modTime
+	if pm.ModTime.IsZero() {
+		pm.ModTime = time.Now()
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, &MediaError{`read`, name, err}
+	}
+	pm.head = head[:n]
+
+	hash := md5.New()
+	hash.Write(pm.head)
+
+	if seeker, ok := r.(io.ReadSeeker); ok {
+		rest, err := io.Copy(hash, r)
+		if err != nil {
+			return nil, &MediaError{`read`, name, err}
+		}
+		if _, err = seeker.Seek(-(rest + int64(n)), io.SeekCurrent); err != nil {
+			return nil, &MediaError{`seek`, name, err}
+		}
+		pm.Size = rest + int64(n)
+		pm.reader = seeker
+	} else {
+		spool, err := ioutil.TempFile(wechat.conf.CachePath, `upload-`)
+		if err != nil {
+			return nil, &MediaError{`spool`, name, err}
+		}
+		pm.spool = spool
+		rest, err := io.Copy(io.MultiWriter(hash, spool), r)
+		if err != nil {
+			pm.close()
+			return nil, &MediaError{`spool`, name, err}
+		}
+		if _, err = spool.Seek(0, io.SeekStart); err != nil {
+			pm.close()
+			return nil, &MediaError{`seek`, name, err}
+		}
+		pm.Size = rest + int64(n)
+		pm.reader = io.MultiReader(bytes.NewReader(pm.head), spool)
+	}
+
+	if pm.Size == 0 {
+		pm.close()
+		return nil, ErrEmptyMedia
+	}
+
+	pm.MD5 = hex.EncodeToString(hash.Sum(nil))
+
+	kind, _ := filetype.Match(pm.head)
+	pm.MIME, pm.Extension, pm.MediaType = detectMediaType(kind, name)
+
+	return pm, nil
+}
+
+// detectMediaType prefer the sniffed type, fall back to the file extension.
+func detectMediaType(kind types.Type, name string) (mimeType, ext, mediaType string) {
+
+	mimeType = kind.MIME.Value
+	ext = kind.Extension
+
+	if kind == types.Unknown || len(mimeType) == 0 {
+		ext = strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), `.`)
+		mimeType = mime.TypeByExtension(`.` + ext)
+		if len(ext) == 0 || len(mimeType) == 0 {
+			mimeType = `application/octet-stream`
+		}
+	}
+
+	mediaType = `doc`
+	if strings.HasPrefix(mimeType, `image/`) {
+		mediaType = `pic`
+	} else if strings.HasPrefix(mimeType, `video/`) {
+		mediaType = `video`
+	}
+
+	return
+}
+
+// uploadedMedia remember media id by md5 and media type in this session,
+// a file uploaded as doc can't be sent as pic.
+type uploadedMedia struct {
+	sync.Mutex
+	ids map[string]string
+}
+
+func uploadedKey(info MediaInfo) string {
+	return info.MediaType + `:` + info.MD5
+}
+
+func (um *uploadedMedia) get(info MediaInfo) string {
+	um.Lock()
+	defer um.Unlock()
+	return um.ids[uploadedKey(info)]
+}
+
+func (um *uploadedMedia) set(info MediaInfo, mediaID string) {
+	um.Lock()
+	defer um.Unlock()
+	if um.ids == nil {
+		um.ids = make(map[string]string)
+	}
+	um.ids[uploadedKey(info)] = mediaID
+}
+
+type checkUploadResponse struct {
+	Response
+	MediaID       string `json:"MediaId"`
+	EncryFileName string
+}
+
+// checkUpload ask wx server whether the file with this md5 is already uploaded,
+// returns the media id if it is. Files of a single chunk are uploaded without asking.
+func (wechat *WeChat) checkUpload(ctx context.Context, size int64, info MediaInfo, to string) (string, error) {
+
+	data, err := json.Marshal(map[string]interface{}{
+		`BaseRequest`:  wechat.BaseRequest,
+		`FileMd5`:      info.MD5,
+		`FileName`:     info.Name,
+		`FileSize`:     size,
+		`FileType`:     7,
+		`FromUserName`: wechat.MySelf.UserName,
+		`ToUserName`:   to,
+	})
+	if err != nil {
+		return ``, err
+	}
+
+	urlPath := fmt.Sprintf(`%s/webwxcheckupload?%s`, wechat.BaseURL, wechat.PassTicketKV())
+	resp := new(checkUploadResponse)
+
+	if err = wechat.ExecuteContext(ctx, urlPath, bytes.NewReader(data), resp); err != nil {
+		return ``, err
+	}
+
+	return resp.MediaID, nil
+}
@@ -0,0 +1,328 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadedMediaKeyedByType(t *testing.T) {
+	var um uploadedMedia
+	doc := MediaInfo{MD5: `d41d8cd98f00b204e9800998ecf8427e`, MediaType: `doc`}
+	pic := MediaInfo{MD5: doc.MD5, MediaType: `pic`}
+
+	um.set(doc, `@crypt_doc`)
+	if id := um.get(pic); len(id) > 0 {
+		t.Fatalf(`media uploaded as doc is reused as pic: %s`, id)
+	}
+	if id := um.get(doc); id != `@crypt_doc` {
+		t.Fatalf(`get doc = %q`, id)
+	}
+}
+
+func TestMediaCacheKeepsOversized(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `media`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mc := newMediaCache(dir, 4, 0)
+	data := []byte(`larger than maxSize`)
+	mr := &MediaReader{ReadCloser: ioutil.NopCloser(bytes.NewReader(data)), Length: int64(len(data))}
+	if err = mc.put(EventMsgData{MsgID: `1`}, mr); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := mc.open(`1`)
+	if err != nil {
+		t.Fatalf(`oversized media is not readable: %v`, err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(got, data) {
+		t.Fatalf(`read %q`, got)
+	}
+
+	// the next one evicts it
+	mr = &MediaReader{ReadCloser: ioutil.NopCloser(bytes.NewReader([]byte(`ab`))), Length: 2}
+	if err = mc.put(EventMsgData{MsgID: `2`}, mr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mc.open(`1`); err != ErrMediaNotCached {
+		t.Fatalf(`open evicted media: %v`, err)
+	}
+}
+
+func TestFetchMediaWaiterGetsError(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `media`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wechat := &WeChat{mediaCache: newMediaCache(dir, 0, 0)}
+	f := &mediaFetch{done: make(chan struct{})}
+	wechat.mediaCache.inflight[`1`] = f
+
+	result := make(chan error)
+	go func() {
+		result <- wechat.fetchMedia(context.Background(), `1`)
+	}()
+
+	f.err = errors.New(`download failed`)
+	close(f.done)
+
+	if err = <-result; err != f.err {
+		t.Fatalf(`waiter got %v, want %v`, err, f.err)
+	}
+}
+
+func TestUploadChunks(t *testing.T) {
+
+	type chunk struct {
+		index, data        string
+		startPos, totalLen float64
+		dataLen            string
+	}
+	var chunks []chunk
+
+	wechat, done := newServerTestBot(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, `/webwxuploadmedia`) {
+			t.Errorf(`upload to %s`, r.URL.Path)
+		}
+		file, _, err := r.FormFile(`filename`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(file)
+		var req struct {
+			StartPos float64
+			TotalLen string
+			DataLen  string
+		}
+		if err = json.Unmarshal([]byte(r.FormValue(`uploadmediarequest`)), &req); err != nil {
+			t.Fatal(err)
+		}
+		total, _ := strconv.ParseFloat(req.TotalLen, 64)
+		chunks = append(chunks, chunk{r.FormValue(`chunk`), string(data), req.StartPos, total, req.DataLen})
+		w.Write([]byte(`{"BaseResponse":{"Ret":0},"MediaId":"@crypt_m"}`))
+	}))
+	defer done()
+	wechat.Client.Jar, _ = cookiejar.New(nil)
+
+	defer func(size int64, hosts []string) { uploadChunkSize, uploadHosts = size, hosts }(uploadChunkSize, uploadHosts)
+	uploadChunkSize, uploadHosts = 10, []string{``}
+
+	data := `0123456789abcdefghijKLMNO`
+	var progress []int64
+	id, err := wechat.UploadMediaContext(context.Background(), strings.NewReader(data), int64(len(data)),
+		MediaInfo{Name: `a.txt`, MediaType: `doc`}, `filehelper`, func(uploaded, total int64) {
+			progress = append(progress, uploaded)
+		})
+	if err != nil || id != `@crypt_m` {
+		t.Fatalf(`upload: %s, %v`, id, err)
+	}
+
+	want := []chunk{
+		{`0`, `0123456789`, 0, 25, `10`},
+		{`1`, `abcdefghij`, 10, 25, `10`},
+		{`2`, `KLMNO`, 20, 25, `5`},
+	}
+	if len(chunks) != len(want) {
+		t.Fatalf(`chunks = %+v`, chunks)
+	}
+	for i := range want {
+		if chunks[i] != want[i] {
+			t.Errorf(`chunk %d = %+v, want %+v`, i, chunks[i], want[i])
+		}
+	}
+	if len(progress) != 3 || progress[2] != 25 {
+		t.Errorf(`progress = %v`, progress)
+	}
+}
+
+// onceReader hides Seek, so prepareMedia has to spool it.
+type onceReader struct{ r io.Reader }
+
+func (o onceReader) Read(p []byte) (int, error) { return o.r.Read(p) }
+
+func TestPrepareMedia(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `media`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wechat := &WeChat{conf: &Configure{CachePath: dir}}
+
+	gif := append([]byte(`GIF89a`), bytes.Repeat([]byte{1}, 500)...)
+
+	cases := []struct {
+		name      string
+		data      []byte
+		seekable  bool
+		mime      string
+		ext       string
+		mediaType string
+	}{
+		{`a.gif`, gif, true, `image/gif`, `gif`, `pic`},
+		{`a.dat`, gif, false, `image/gif`, `gif`, `pic`},                  // sniffed type wins
+		{`Note.PDF`, []byte(`hi`), true, `application/pdf`, `pdf`, `doc`}, // shorter than sniffLen
+		{`a.png`, []byte(`not a real image`), false, `image/png`, `png`, `pic`},
+		{`noext`, []byte(`x`), true, `application/octet-stream`, ``, `doc`},
+	}
+	for _, c := range cases {
+		var r io.Reader = bytes.NewReader(c.data)
+		if !c.seekable {
+			r = onceReader{r}
+		}
+		pm, err := wechat.prepareMedia(r, c.name, time.Time{})
+		if err != nil {
+			t.Fatalf(`prepare %s: %v`, c.name, err)
+		}
+
+		sum := md5.Sum(c.data)
+		if pm.MD5 != hex.EncodeToString(sum[:]) || pm.Size != int64(len(c.data)) {
+			t.Errorf(`%s: md5 %s, size %d`, c.name, pm.MD5, pm.Size)
+		}
+		if pm.MIME != c.mime || pm.Extension != c.ext || pm.MediaType != c.mediaType {
+			t.Errorf(`%s: %s %s %s, want %s %s %s`, c.name, pm.MIME, pm.Extension, pm.MediaType, c.mime, c.ext, c.mediaType)
+		}
+		if pm.ModTime.IsZero() {
+			t.Errorf(`%s: zero ModTime`, c.name)
+		}
+
+		// 读到的和原来的一样
+		if data, _ := ioutil.ReadAll(pm.reader); !bytes.Equal(data, c.data) {
+			t.Errorf(`%s: read %d byte(s) after prepare`, c.name, len(data))
+		}
+		pm.close()
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf(`%d spooled file(s) left`, len(files))
+	}
+	if _, err = wechat.prepareMedia(bytes.NewReader(nil), `empty`, time.Time{}); err != ErrEmptyMedia {
+		t.Errorf(`prepare empty: %v`, err)
+	}
+}
+
+func TestCheckUploadOnlyLargeFiles(t *testing.T) {
+
+	var paths []string
+	wechat, done := newServerTestBot(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path[strings.LastIndex(r.URL.Path, `/`)+1:])
+		if strings.HasSuffix(r.URL.Path, `/webwxcheckupload`) {
+			w.Write([]byte(`{"BaseResponse":{"Ret":0},"MediaId":"@crypt_checked"}`))
+			return
+		}
+		w.Write([]byte(`{"BaseResponse":{"Ret":0},"MediaId":"@crypt_uploaded"}`))
+	}))
+	defer done()
+	wechat.Client.Jar, _ = cookiejar.New(nil)
+
+	defer func(size int64, hosts []string) { uploadChunkSize, uploadHosts = size, hosts }(uploadChunkSize, uploadHosts)
+	uploadChunkSize, uploadHosts = 4, []string{``}
+
+	upload := func(data string) string {
+		sum := md5.Sum([]byte(data))
+		info := MediaInfo{Name: `a.txt`, MediaType: `doc`, MD5: hex.EncodeToString(sum[:])}
+		id, err := wechat.UploadMediaContext(context.Background(), strings.NewReader(data), int64(len(data)), info, `filehelper`, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	if id := upload(`abc`); id != `@crypt_uploaded` || strings.Join(paths, `,`) != `webwxuploadmedia` {
+		t.Fatalf(`small file: %s, requests %v`, id, paths)
+	}
+	// 同一个文件这次会话里不再上传
+	if id := upload(`abc`); id != `@crypt_uploaded` || len(paths) != 1 {
+		t.Fatalf(`same file: %s, requests %v`, id, paths)
+	}
+
+	paths = nil
+	if id := upload(`abcdefgh`); id != `@crypt_checked` || strings.Join(paths, `,`) != `webwxcheckupload` {
+		t.Fatalf(`large file: %s, requests %v`, id, paths)
+	}
+}
+
+func TestMediaCacheEvictsLeastRecentlyRead(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `media`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mc := newMediaCache(dir, 6, 0)
+	put := func(id string) {
+		mr := &MediaReader{ReadCloser: ioutil.NopCloser(strings.NewReader(`ab`)), Length: 2}
+		if err := mc.put(EventMsgData{MsgID: id}, mr); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	put(`1`)
+	put(`2`)
+	put(`3`)
+
+	// 1 是最早下载的, 但刚读过
+	r, err := mc.open(`1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	time.Sleep(time.Millisecond)
+
+	put(`4`)
+	for id, cached := range map[string]bool{`1`: true, `2`: false, `3`: true, `4`: true} {
+		r, err := mc.open(id)
+		if (err == nil) != cached {
+			t.Errorf(`media %s cached %v: %v`, id, !cached, err)
+		}
+		if err == nil {
+			r.Close()
+		}
+	}
+}
+
+func TestMediaContextCancel(t *testing.T) {
+
+	dir, err := ioutil.TempDir(``, `media`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wechat, done := newServerTestBot(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer done()
+	wechat.mediaCache = newMediaCache(dir, 0, 0)
+	wechat.mediaCache.remember(EventMsgData{MsgID: `1`, MsgType: 3,
+		OriginalMsg: map[string]interface{}{`MsgId`: `1`, `MsgType`: 3.0}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := wechat.MediaContext(ctx, `1`); err == nil || time.Since(start) > 2*time.Second {
+		t.Fatalf(`download is not canceled: %v after %v`, err, time.Since(start))
+	}
+}
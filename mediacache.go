@@ -0,0 +1,336 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrMediaNotCached is returned by Media when msg is unknown or evicted.
+var ErrMediaNotCached = errors.New(`media not cached`)
+
+// maxPendingMedia is the count of unfetched media msgs remembered for lazy fetching.
+var maxPendingMedia = 1024
+
+// mediaIndexSaveDelay is how long access times of media wait to be written.
+var mediaIndexSaveDelay = 2 * time.Second
+
+type mediaCacheEntry struct {
+	MsgID       string
+	MsgType     int64
+	FileName    string
+	ContentType string
+	Size        int64
+	Time        time.Time // downloaded
+	Accessed    time.Time // last read, eviction is by it
+}
+
+// mediaCache store media content on disk by MsgId, so it can be read
+// after the MediaURL expired.
+type mediaCache struct {
+	sync.Mutex
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	total   int64
+	entries map[string]*mediaCacheEntry
+
+	pending      map[string]EventMsgData
+	pendingOrder []string
+	inflight     map[string]*mediaFetch
+	saving       bool
+}
+
+// mediaFetch is a download in progress, err is set before done is closed.
+type mediaFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func newMediaCache(dir string, maxSize int64, maxAge time.Duration) *mediaCache {
+
+	mc := &mediaCache{
+		dir:      dir,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		entries:  make(map[string]*mediaCacheEntry),
+		pending:  make(map[string]EventMsgData),
+		inflight: make(map[string]*mediaFetch),
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		logger.Errorf(`create media cache dir failed: %v`, err)
+	}
+
+	data, err := ioutil.ReadFile(mc.indexPath())
+	if err == nil {
+		var entries []*mediaCacheEntry
+		if err = json.Unmarshal(data, &entries); err != nil {
+			logger.Warnf(`media cache index is broken: %v`, err)
+		}
+		for _, e := range entries {
+			if _, err := os.Stat(mc.contentPath(e.MsgID)); err == nil {
+				if e.Accessed.IsZero() {
+					e.Accessed = e.Time
+				}
+				mc.entries[e.MsgID] = e
+				mc.total += e.Size
+			}
+		}
+	}
+
+	mc.Lock()
+	mc.evict(``)
+	mc.Unlock()
+
+	return mc
+}
+
+func (mc *mediaCache) indexPath() string {
+	return filepath.Join(mc.dir, `index.json`)
+}
+
+func (mc *mediaCache) contentPath(msgID string) string {
+	return filepath.Join(mc.dir, msgID)
+}
+
+// scheduleSave write index a moment later, must be called with lock held.
+func (mc *mediaCache) scheduleSave() {
+	if mc.saving {
+		return
+	}
+	mc.saving = true
+	time.AfterFunc(mediaIndexSaveDelay, func() {
+		mc.Lock()
+		mc.saveIndex()
+		mc.Unlock()
+	})
+}
+
+// saveIndex must be called with lock held.
+func (mc *mediaCache) saveIndex() {
+	mc.saving = false
+	entries := make([]*mediaCacheEntry, 0, len(mc.entries))
+	for _, e := range mc.entries {
+		entries = append(entries, e)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		logger.Warnf(`marshal media cache index failed: %v`, err)
+		return
+	}
+	createFile(mc.indexPath(), data, false)
+}
+
+// evict remove entries not read for maxAge, then the least recently read
+// ones until under maxSize.
+// keep is the one just downloaded, it is kept even if larger than maxSize,
+// and will be evicted by the next one. must be called with lock held.
+func (mc *mediaCache) evict(keep string) {
+
+	entries := make([]*mediaCacheEntry, 0, len(mc.entries))
+	for _, e := range mc.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Accessed.Before(entries[j].Accessed)
+	})
+
+	changed := false
+	for _, e := range entries {
+		aged := mc.maxAge > 0 && time.Since(e.Accessed) > mc.maxAge
+		full := mc.maxSize > 0 && mc.total > mc.maxSize
+		if !aged && !full {
+			break
+		}
+		if e.MsgID == keep {
+			continue
+		}
+		os.Remove(mc.contentPath(e.MsgID))
+		delete(mc.entries, e.MsgID)
+		mc.total -= e.Size
+		changed = true
+		logger.Debugf(`media [%s] evicted from cache`, e.MsgID)
+	}
+
+	if changed {
+		mc.saveIndex()
+	}
+}
+
+// remember keep msg so its media can be fetched lazily.
+func (mc *mediaCache) remember(msg EventMsgData) {
+	mc.Lock()
+	defer mc.Unlock()
+
+	if _, found := mc.pending[msg.MsgID]; found {
+		return
+	}
+	mc.pending[msg.MsgID] = msg
+	mc.pendingOrder = append(mc.pendingOrder, msg.MsgID)
+
+	for len(mc.pendingOrder) > maxPendingMedia {
+		delete(mc.pending, mc.pendingOrder[0])
+		mc.pendingOrder = mc.pendingOrder[1:]
+	}
+}
+
+func (mc *mediaCache) open(msgID string) (*MediaReader, error) {
+	mc.Lock()
+	e, found := mc.entries[msgID]
+	if found {
+		e.Accessed = time.Now()
+		mc.scheduleSave()
+	}
+	mc.Unlock()
+
+	if !found {
+		return nil, ErrMediaNotCached
+	}
+
+	file, err := os.Open(mc.contentPath(msgID))
+	if err != nil {
+		return nil, err
+	}
+
+	return &MediaReader{
+		ReadCloser:  file,
+		ContentType: e.ContentType,
+		Length:      e.Size,
+		FileName:    e.FileName,
+	}, nil
+}
+
+// put copy mr into cache.
+func (mc *mediaCache) put(msg EventMsgData, mr *MediaReader) error {
+
+	tmp, err := ioutil.TempFile(mc.dir, `tmp-`)
+	if err != nil {
+		return err
+	}
+
+	size, err := io.Copy(tmp, mr)
+	tmp.Close()
+	if err == nil && mr.Length >= 0 && size != mr.Length {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), mc.contentPath(msg.MsgID))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	mc.Lock()
+	defer mc.Unlock()
+
+	if old, found := mc.entries[msg.MsgID]; found {
+		mc.total -= old.Size
+	}
+	now := time.Now()
+	mc.entries[msg.MsgID] = &mediaCacheEntry{
+		MsgID:       msg.MsgID,
+		MsgType:     msg.MsgType,
+		FileName:    mr.FileName,
+		ContentType: mr.ContentType,
+		Size:        size,
+		Time:        now,
+		Accessed:    now,
+	}
+	mc.total += size
+	mc.saveIndex()
+	mc.evict(msg.MsgID)
+
+	return nil
+}
+
+// fetchMedia download media of a remembered msg into cache,
+// concurrent fetching of the same msg wait for the first one and get its error.
+func (wechat *WeChat) fetchMedia(ctx context.Context, msgID string) error {
+
+	mc := wechat.mediaCache
+
+	mc.Lock()
+	if _, found := mc.entries[msgID]; found {
+		mc.Unlock()
+		return nil
+	}
+	if f, found := mc.inflight[msgID]; found {
+		mc.Unlock()
+		select {
+		case <-f.done:
+			return f.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	msg, found := mc.pending[msgID]
+	if !found {
+		mc.Unlock()
+		return ErrMediaNotCached
+	}
+	f := &mediaFetch{done: make(chan struct{})}
+	mc.inflight[msgID] = f
+	mc.Unlock()
+
+	f.err = wechat.downloadMedia(ctx, msg)
+
+	mc.Lock()
+	delete(mc.inflight, msgID)
+	mc.Unlock()
+	close(f.done)
+
+	return f.err
+}
+
+func (wechat *WeChat) downloadMedia(ctx context.Context, msg EventMsgData) error {
+
+	mr, err := wechat.OpenMedia(ctx, msg)
+	if err != nil {
+		return err
+	}
+	defer mr.Close()
+
+	return wechat.mediaCache.put(msg, mr)
+}
+
+// prefetchMediaIfNeeded fetch media on arrival if msg type is configured.
+func (wechat *WeChat) prefetchMediaIfNeeded(msg EventMsgData) {
+	for _, t := range wechat.conf.PrefetchMedia {
+		if t == msg.MsgType {
+			if err := wechat.fetchMedia(context.Background(), msg.MsgID); err != nil {
+				logger.Warnf(`prefetch media [%s] failed: %v`, msg.MsgID, err)
+			}
+			return
+		}
+	}
+}
+
+// Media read media content of msg from cache, media of a recent msg which is
+// not cached yet will be downloaded first.
+func (wechat *WeChat) Media(msgID string) (*MediaReader, error) {
+	return wechat.MediaContext(context.Background(), msgID)
+}
+
+// MediaContext is Media with a context for the download.
+func (wechat *WeChat) MediaContext(ctx context.Context, msgID string) (*MediaReader, error) {
+
+	mr, err := wechat.mediaCache.open(msgID)
+	if err != ErrMediaNotCached {
+		return mr, err
+	}
+
+	if err = wechat.fetchMedia(ctx, msgID); err != nil {
+		return nil, err
+	}
+
+	return wechat.mediaCache.open(msgID)
+}
@@ -0,0 +1,426 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventMemberProgressData is the data of `/progress/members`,
+// emitted every time member details of a group are loaded or failed.
+type EventMemberProgressData struct {
+	Group  string // UserName of the group
+	Err    error
+	Loaded int // count of groups whose members are loaded
+	Total  int
+}
+
+// memberFetchRetryBackoff is the wait before first retry of a batch, it grows linearly.
+var memberFetchRetryBackoff = time.Second
+
+// memberLoader load member details of groups, on first access or in
+// background, groups with recent messages go first.
+type memberLoader struct {
+	sync.Mutex
+	known    map[string]bool
+	loaded   map[string]bool
+	pending  map[string]bool
+	inflight map[string]chan struct{}
+	fetching map[string]chan struct{} // single members fetched on cache miss
+	errs     map[string]error
+	active   map[string]time.Time // time of last message in group
+	wake     chan struct{}
+}
+
+func newMemberLoader() *memberLoader {
+	return &memberLoader{
+		known:    make(map[string]bool),
+		loaded:   make(map[string]bool),
+		pending:  make(map[string]bool),
+		inflight: make(map[string]chan struct{}),
+		fetching: make(map[string]chan struct{}),
+		errs:     make(map[string]error),
+		active:   make(map[string]time.Time),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// enqueue mark members of groups need (re)loading.
+func (l *memberLoader) enqueue(groups ...string) {
+	l.Lock()
+	for _, g := range groups {
+		l.known[g] = true
+		delete(l.loaded, g)
+		l.pending[g] = true
+	}
+	l.Unlock()
+
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// touch record activity of group, raise its priority.
+func (l *memberLoader) touch(group string) {
+	l.Lock()
+	l.active[group] = time.Now()
+	l.Unlock()
+}
+
+// next returns the pending group with the latest activity.
+func (l *memberLoader) next() (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	next, found := ``, false
+	for g := range l.pending {
+		if !found || l.active[g].After(l.active[next]) {
+			next, found = g, true
+		}
+	}
+	return next, found
+}
+
+// runMemberLoader load pending groups one by one in background.
+func (wechat *WeChat) runMemberLoader() {
+
+	l := wechat.memberLoader
+
+	for range l.wake {
+		for !wechat.LoggedIn() {
+			time.Sleep(time.Second)
+		}
+		for {
+			g, found := l.next()
+			if !found {
+				break
+			}
+			if err := wechat.loadMembers(context.Background(), g); err != nil {
+				logger.Warnf(`load members of group [%s] failed: %v`, g, err)
+			}
+		}
+	}
+}
+
+// loadMembers fetch member details of group unless they are loaded,
+// concurrent calls for the same group share one fetch.
+func (wechat *WeChat) loadMembers(ctx context.Context, groupUserName string) error {
+
+	l := wechat.memberLoader
+
+	l.Lock()
+	if l.loaded[groupUserName] {
+		l.Unlock()
+		return nil
+	}
+	if ch, found := l.inflight[groupUserName]; found {
+		l.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		l.Lock()
+		defer l.Unlock()
+		return l.errs[groupUserName]
+	}
+	ch := make(chan struct{})
+	l.inflight[groupUserName] = ch
+	l.known[groupUserName] = true
+	delete(l.pending, groupUserName)
+	l.Unlock()
+
+	err := wechat.fetchMemberDetails(ctx, groupUserName)
+
+	l.Lock()
+	delete(l.inflight, groupUserName)
+	if err == nil {
+		l.loaded[groupUserName] = true
+		delete(l.errs, groupUserName)
+	} else {
+		l.errs[groupUserName] = err
+	}
+	close(ch)
+	data := EventMemberProgressData{
+		Group:  groupUserName,
+		Err:    err,
+		Loaded: len(l.loaded),
+		Total:  len(l.known),
+	}
+	l.Unlock()
+
+	event := Event{
+		Type: `MemberProgress`,
+		From: `Wechat`,
+		Path: `/progress/members`,
+		To:   `End`,
+		Time: time.Now().Unix(),
+		Data: data,
+	}
+	go func() {
+		wechat.evtStream.serverEvt <- event
+	}()
+
+	return err
+}
+
+func (wechat *WeChat) fetchMemberDetails(ctx context.Context, groupUserName string) error {
+
+	group := wechat.cache.snapshot(groupUserName)
+	if group == nil {
+		return fmt.Errorf(`group [%s] is not in cache`, groupUserName)
+	}
+
+	list := make([]map[string]string, 0, len(group.MemberList))
+	for _, m := range group.MemberList {
+		list = append(list, map[string]string{
+			`UserName`:        m.UserName,
+			`EncryChatRoomId`: group.EncryChatRoomID,
+		})
+	}
+
+	logger.Debugf(`will load %d member(s) of group [%s]`, len(list), group.NickName)
+
+	// 部分失败的也先存下来
+	members, err := wechat.batchGetContact(ctx, list)
+	if len(members) > 0 {
+		wechat.markMembers(members)
+		wechat.mergeMembers(members)
+	}
+
+	return err
+}
+
+// markMembers set Type of group members by what is in cache.
+func (wechat *WeChat) markMembers(members []map[string]interface{}) {
+	wechat.cache.Lock()
+	defer wechat.cache.Unlock()
+
+	for _, v := range members {
+		un, _ := v[`UserName`].(string)
+		if un == wechat.MySelf.UserName {
+			v[`Type`] = Self
+		} else if c, found := wechat.cache.contacts[un]; found && (c.Type == Friend || c.Type == FriendAndMember) {
+			v[`Type`] = FriendAndMember
+		} else {
+			v[`Type`] = Member
+		}
+	}
+}
+
+// GroupMembers returns copies of members of group with details,
+// they are loaded on first access.
+func (wechat *WeChat) GroupMembers(ctx context.Context, groupUserName string) ([]*Contact, error) {
+
+	if err := wechat.loadMembers(ctx, groupUserName); err != nil {
+		return nil, err
+	}
+
+	wechat.cache.Lock()
+	defer wechat.cache.Unlock()
+
+	group, found := wechat.cache.contacts[groupUserName]
+	if !found {
+		return nil, fmt.Errorf(`group [%s] is not in cache`, groupUserName)
+	}
+
+	members := make([]*Contact, 0, len(group.MemberList))
+	for _, m := range group.MemberList {
+		if c, found := wechat.cache.contacts[m.UserName]; found {
+			members = append(members, c.clone())
+		} else {
+			members = append(members, m.clone())
+		}
+	}
+	return members, nil
+}
+
+// memberOf returns a copy of member of group, it is fetched from server
+// with EncryChatRoomId of group if not in cache.
+func (wechat *WeChat) memberOf(ctx context.Context, groupUserName, un string) (*Contact, error) {
+
+	if c := wechat.cache.snapshot(un); c != nil {
+		return c, nil
+	}
+
+	l := wechat.memberLoader
+
+	l.Lock()
+	if ch, found := l.fetching[un]; found {
+		l.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if c := wechat.cache.snapshot(un); c != nil {
+			return c, nil
+		}
+		return nil, fmt.Errorf(`fetch member [%s] failed`, un)
+	}
+	ch := make(chan struct{})
+	l.fetching[un] = ch
+	l.Unlock()
+
+	defer func() {
+		l.Lock()
+		delete(l.fetching, un)
+		close(ch)
+		l.Unlock()
+	}()
+
+	encryChatRoomID := ``
+	if group := wechat.cache.snapshot(groupUserName); group != nil {
+		encryChatRoomID = group.EncryChatRoomID
+	}
+
+	cts, err := wechat.batchGetContact(ctx, []map[string]string{{
+		`UserName`:        un,
+		`EncryChatRoomId`: encryChatRoomID,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if len(cts) == 0 {
+		return nil, fmt.Errorf(`member [%s] not found`, un)
+	}
+
+	wechat.markMembers(cts)
+	wechat.mergeMembers(cts)
+
+	if c := wechat.cache.snapshot(un); c != nil {
+		return c, nil
+	}
+	return nil, fmt.Errorf(`member [%s] not found`, un)
+}
+
+// displayNameInGroup returns the name of member shown in group, DisplayName
+// in MemberList of group first, then RemarkName and NickName. DisplayName of
+// member itself may be the one in another group so it is not used.
+// ok is false if member is not in MemberList.
+func (wechat *WeChat) displayNameInGroup(groupUserName string, member *Contact) (string, bool) {
+
+	name := member.RemarkName
+	if len(name) == 0 {
+		name = member.NickName
+	}
+
+	if group := wechat.cache.snapshot(groupUserName); group != nil {
+		for _, m := range group.MemberList {
+			if m.UserName == member.UserName {
+				if len(m.DisplayName) > 0 {
+					return m.DisplayName, true
+				}
+				return name, true
+			}
+		}
+	}
+	return name, false
+}
+
+// batchGetContact get contacts by webwxbatchgetcontact, list is split to batches
+// which are fetched concurrently and retried, contacts of succeeded batches are
+// returned even if some batches failed.
+func (wechat *WeChat) batchGetContact(ctx context.Context, list []map[string]string) ([]map[string]interface{}, error) {
+
+	var batches [][]map[string]string
+	for len(list) > maxCountOnceLoadGroupMember {
+		batches = append(batches, list[:maxCountOnceLoadGroupMember])
+		list = list[maxCountOnceLoadGroupMember:]
+	}
+	if len(list) > 0 {
+		batches = append(batches, list)
+	}
+
+	concurrency := wechat.conf.MemberFetchConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	results := make([][]map[string]interface{}, len(batches))
+	errs := make([]error, len(batches))
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		go func(i int, batch []map[string]string) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+			results[i], errs[i] = wechat.batchGetContactWithRetry(ctx, batch)
+		}(i, batch)
+	}
+	wg.Wait()
+
+	var cts []map[string]interface{}
+	var err error
+	failed := 0
+	for i := range batches {
+		if errs[i] != nil {
+			failed++
+			err = errs[i]
+			continue
+		}
+		cts = append(cts, results[i]...)
+	}
+
+	if failed > 0 {
+		return cts, fmt.Errorf(`%d of %d batch(es) failed, last error: %v`, failed, len(batches), err)
+	}
+	return cts, nil
+}
+
+func (wechat *WeChat) batchGetContactWithRetry(ctx context.Context, list []map[string]string) ([]map[string]interface{}, error) {
+
+	var cts []map[string]interface{}
+	var err error
+
+	for i := 0; i <= wechat.conf.MemberFetchRetryTimes; i++ {
+
+		if i > 0 {
+			logger.Warnf(`batch get contact failed: %v, will retry after %v`, err, memberFetchRetryBackoff*time.Duration(i))
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(memberFetchRetryBackoff * time.Duration(i)):
+			}
+		}
+
+		if cts, err = wechat.batchGetContactOnce(ctx, list); err == nil {
+			return cts, nil
+		}
+	}
+
+	return nil, err
+}
+
+func (wechat *WeChat) batchGetContactOnce(ctx context.Context, list []map[string]string) ([]map[string]interface{}, error) {
+
+	data, err := json.Marshal(map[string]interface{}{
+		`BaseRequest`: wechat.BaseRequest,
+		`Count`:       len(list),
+		`List`:        list,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	urlPath := fmt.Sprintf(`%s/webwxbatchgetcontact?type=ex&r=%v`, wechat.BaseURL, time.Now().Unix()*1000)
+	resp := new(batchGetContactResponse)
+
+	if err = wechat.ExecuteContext(ctx, urlPath, bytes.NewReader(data), resp); err != nil {
+		return nil, err
+	}
+
+	return resp.ContactList, nil
+}
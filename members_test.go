@@ -0,0 +1,212 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memberServer answers webwxbatchgetcontact with a NickName for every
+// UserName asked, fail decides whether a request fails.
+type memberServer struct {
+	sync.Mutex
+	requests int
+	inflight int
+	peak     int
+	delay    time.Duration
+	fail     func(n int) bool
+	contacts map[string]map[string]interface{} // returned instead of the default
+}
+
+func (s *memberServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct{ List []map[string]string }
+	json.NewDecoder(r.Body).Decode(&body)
+
+	s.Lock()
+	s.requests++
+	n := s.requests
+	s.inflight++
+	if s.inflight > s.peak {
+		s.peak = s.inflight
+	}
+	s.Unlock()
+
+	time.Sleep(s.delay)
+
+	s.Lock()
+	s.inflight--
+	s.Unlock()
+
+	if s.fail != nil && s.fail(n) {
+		w.Write([]byte(`{"BaseResponse":{"Ret":1100}}`))
+		return
+	}
+
+	var cts []map[string]interface{}
+	for _, m := range body.List {
+		if c, found := s.contacts[m[`UserName`]]; found {
+			cts = append(cts, c)
+			continue
+		}
+		cts = append(cts, map[string]interface{}{`UserName`: m[`UserName`], `NickName`: `nick` + m[`UserName`]})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		`BaseResponse`: map[string]interface{}{`Ret`: 0},
+		`Count`:        len(cts),
+		`ContactList`:  cts,
+	})
+}
+
+func memberList(n int) []map[string]string {
+	list := make([]map[string]string, n)
+	for i := range list {
+		list[i] = map[string]string{`UserName`: `@` + string(rune('a'+i))}
+	}
+	return list
+}
+
+func TestBatchGetContactConcurrency(t *testing.T) {
+
+	s := &memberServer{delay: 20 * time.Millisecond}
+	wechat, done := newServerTestBot(t, s)
+	defer done()
+
+	defer func(n int) { maxCountOnceLoadGroupMember = n }(maxCountOnceLoadGroupMember)
+	maxCountOnceLoadGroupMember = 2
+	wechat.conf.MemberFetchConcurrency = 2
+
+	cts, err := wechat.batchGetContact(context.Background(), memberList(9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cts) != 9 || s.requests != 5 {
+		t.Fatalf(`%d contact(s) in %d request(s)`, len(cts), s.requests)
+	}
+	if s.peak != 2 {
+		t.Errorf(`%d request(s) at the same time, want 2`, s.peak)
+	}
+}
+
+func TestBatchGetContactRetry(t *testing.T) {
+
+	s := &memberServer{}
+	wechat, done := newServerTestBot(t, s)
+	defer done()
+
+	defer func(n int, d time.Duration) {
+		maxCountOnceLoadGroupMember, memberFetchRetryBackoff = n, d
+	}(maxCountOnceLoadGroupMember, memberFetchRetryBackoff)
+	maxCountOnceLoadGroupMember, memberFetchRetryBackoff = 2, time.Millisecond
+
+	// 第一批失败一次后成功
+	s.fail = func(n int) bool { return n == 1 }
+	wechat.conf.MemberFetchRetryTimes = 1
+	if cts, err := wechat.batchGetContact(context.Background(), memberList(2)); err != nil || len(cts) != 2 || s.requests != 2 {
+		t.Fatalf(`retry: %d contact(s), %d request(s), %v`, len(cts), s.requests, err)
+	}
+
+	// 没有重试机会的批次失败, 其余的照样返回
+	s.requests = 0
+	s.fail = func(n int) bool { return n == 1 }
+	wechat.conf.MemberFetchRetryTimes = 0
+	cts, err := wechat.batchGetContact(context.Background(), memberList(4))
+	if err == nil || len(cts) != 2 {
+		t.Fatalf(`partial failure: %d contact(s), %v`, len(cts), err)
+	}
+}
+
+func TestMemberLoaderTouchPriority(t *testing.T) {
+	l := newMemberLoader()
+	l.enqueue(`@@a`, `@@b`, `@@c`)
+	l.touch(`@@a`)
+	time.Sleep(time.Millisecond)
+	l.touch(`@@b`)
+
+	var order []string
+	for {
+		g, found := l.next()
+		if !found {
+			break
+		}
+		order = append(order, g)
+		delete(l.pending, g)
+	}
+	if len(order) != 3 || order[0] != `@@b` || order[1] != `@@a` || order[2] != `@@c` {
+		t.Errorf(`load order = %v`, order)
+	}
+}
+
+func TestLoadMembers(t *testing.T) {
+
+	s := &memberServer{contacts: map[string]map[string]interface{}{
+		// 好友按成员取回来的信息少
+		`@f`: {`UserName`: `@f`, `NickName`: `Frank`, `Province`: `北京`},
+	}}
+	wechat, done := newServerTestBot(t, s)
+	defer done()
+
+	wechat.cache.updateContact(map[string]interface{}{`UserName`: `@f`, `NickName`: `Frank`, `RemarkName`: `老弗`,
+		`StarFriend`: 1.0, `Alias`: `frank`, `Type`: Friend})
+	wechat.cache.updateContact(map[string]interface{}{`UserName`: `@@g`, `NickName`: `群`, `Type`: Group,
+		`MemberList`: []interface{}{
+			map[string]interface{}{`UserName`: `@f`},
+			map[string]interface{}{`UserName`: `@m`},
+		}})
+	wechat.cache.dirty = false
+
+	members, err := wechat.GroupMembers(context.Background(), `@@g`)
+	if err != nil || len(members) != 2 {
+		t.Fatalf(`members: %v, %v`, members, err)
+	}
+	f, m := members[0], members[1]
+	if f.RemarkName != `老弗` || f.StarFriend != 1 || f.Alias != `frank` || f.Province != `北京` || f.Type != FriendAndMember {
+		t.Errorf(`friend is clobbered by member: %+v`, f)
+	}
+	if m.NickName != `nick@m` || m.Type != Member {
+		t.Errorf(`member: %+v`, m)
+	}
+
+	evts := drainGroupEvents(wechat.evtStream)
+	if len(evts) != 1 || evts[0] != `/progress/members` {
+		t.Fatalf(`events: %v`, evts)
+	}
+
+	// 没有变化的不写缓存
+	wechat.cache.dirty = false
+	wechat.memberLoader.enqueue(`@@g`)
+	if err = wechat.loadMembers(context.Background(), `@@g`); err != nil || s.requests != 2 {
+		t.Fatalf(`reload: %d request(s), %v`, s.requests, err)
+	}
+	if wechat.cache.dirty {
+		t.Error(`unchanged members mark cache dirty`)
+	}
+}
+
+func TestMemberProgressEvent(t *testing.T) {
+
+	s := &memberServer{fail: func(n int) bool { return n == 2 }}
+	wechat, done := newServerTestBot(t, s)
+	defer done()
+
+	for _, g := range []string{`@@a`, `@@b`} {
+		wechat.cache.updateContact(map[string]interface{}{`UserName`: g, `Type`: Group,
+			`MemberList`: []interface{}{map[string]interface{}{`UserName`: `@m` + g}}})
+	}
+	wechat.memberLoader.enqueue(`@@a`, `@@b`)
+
+	var got []EventMemberProgressData
+	for _, g := range []string{`@@a`, `@@b`} {
+		wechat.loadMembers(context.Background(), g)
+		evt := <-wechat.evtStream.serverEvt
+		got = append(got, evt.Data.(EventMemberProgressData))
+	}
+	if got[0].Err != nil || got[0].Loaded != 1 || got[0].Total != 2 {
+		t.Errorf(`first progress = %+v`, got[0])
+	}
+	if got[1].Err == nil || got[1].Group != `@@b` || got[1].Loaded != 1 {
+		t.Errorf(`failed progress = %+v`, got[1])
+	}
+}
@@ -0,0 +1,163 @@
+package wechat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/KevinGong2013/wechat/messages"
+)
+
+// MentionAll in EventMsgData.Mentions means `@所有人` was mentioned.
+const MentionAll = `@all`
+
+var mentionAllNames = []string{`所有人`, `all`}
+
+// nameInGroup is the name shown for a member in a group chat
+func nameInGroup(member *Contact) string {
+	if len(member.DisplayName) > 0 {
+		return member.DisplayName
+	}
+	return member.NickName
+}
+
+// NewMentionTextMsg create a text msg which @ members of group,
+// the names are resolved from group's MemberList, use MentionAll to @所有人.
+func (wechat *WeChat) NewMentionTextMsg(text, groupUserName string, userNames ...string) (*messages.MentionTextMsg, error) {
+
+	members, err := wechat.MembersOfGroup(groupUserName)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, un := range userNames {
+		if un == MentionAll {
+			names = append(names, mentionAllNames[0])
+			continue
+		}
+		found := false
+		for _, m := range members {
+			if m.UserName == un {
+				names = append(names, nameInGroup(m))
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf(`can't find member [%s] in group [%s]`, un, groupUserName)
+		}
+	}
+
+	return messages.NewMentionTextMsg(text, groupUserName, names...), nil
+}
+
+// SendMentionTextMsg send text message to group and @ members
+func (wechat *WeChat) SendMentionTextMsg(text, groupUserName string, userNames ...string) error {
+	msg, err := wechat.NewMentionTextMsg(text, groupUserName, userNames...)
+	if err != nil {
+		return err
+	}
+	return wechat.SendMsg(msg)
+}
+
+// mentionCandidate is a name which can be @-ed in a group.
+type mentionCandidate struct {
+	name     string
+	userName string
+	display  bool // DisplayName in group, preferred over NickName
+}
+
+// mentionCandidates returns names of members, longer names first, then
+// DisplayName before NickName, so the same input always has the same result.
+func mentionCandidates(members []*Contact) []mentionCandidate {
+
+	var cands []mentionCandidate
+	for _, n := range mentionAllNames {
+		cands = append(cands, mentionCandidate{n, MentionAll, true})
+	}
+	for _, m := range members {
+		if len(m.DisplayName) > 0 {
+			cands = append(cands, mentionCandidate{m.DisplayName, m.UserName, true})
+		}
+		if len(m.NickName) > 0 {
+			cands = append(cands, mentionCandidate{m.NickName, m.UserName, false})
+		}
+	}
+
+	sort.SliceStable(cands, func(i, j int) bool {
+		a, b := cands[i], cands[j]
+		if len(a.name) != len(b.name) {
+			return len(a.name) > len(b.name)
+		}
+		if a.display != b.display {
+			return a.display
+		}
+		return a.userName < b.userName
+	})
+	return cands
+}
+
+// parseMentions find out which members are mentioned in content,
+// the longest name wins when names share a prefix. `@` must be at the start
+// of content or after a space or line break.
+func (wechat *WeChat) parseMentions(groupUserName, content string) []string {
+
+	if !strings.Contains(content, `@`) {
+		return nil
+	}
+
+	members, _ := wechat.MembersOfGroup(groupUserName)
+	return findMentions(content, mentionCandidates(members))
+}
+
+func findMentions(content string, cands []mentionCandidate) []string {
+
+	var mentions []string
+	seen := make(map[string]bool)
+
+	for i := 0; i < len(content); i++ {
+		// `mail@张三` 和 `a@all` 不是 @
+		if content[i] != '@' || !isMentionStart(content[:i]) {
+			continue
+		}
+		rest := content[i+1:]
+		for _, c := range cands {
+			if !strings.HasPrefix(rest, c.name) || !isMentionEnd(rest[len(c.name):]) {
+				continue
+			}
+			if !seen[c.userName] {
+				seen[c.userName] = true
+				mentions = append(mentions, c.userName)
+			}
+			i += len(c.name)
+			break
+		}
+	}
+
+	return mentions
+}
+
+// isMentionStart reports whether `@` after s starts a mention.
+func isMentionStart(s string) bool {
+	return len(s) == 0 ||
+		strings.HasSuffix(s, messages.MentionSeparator) ||
+		strings.HasSuffix(s, ` `) ||
+		strings.HasSuffix(s, "\n")
+}
+
+func isMentionEnd(s string) bool {
+	return len(s) == 0 ||
+		strings.HasPrefix(s, messages.MentionSeparator) ||
+		strings.HasPrefix(s, ` `) ||
+		strings.HasPrefix(s, "\n")
+}
+
+func isMentioned(mentions []string, userName string) bool {
+	for _, m := range mentions {
+		if m == userName || m == MentionAll {
+			return true
+		}
+	}
+	return false
+}
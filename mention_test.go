@@ -0,0 +1,59 @@
+package wechat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+
+	wechat := &WeChat{cache: newCache()}
+	wechat.cache.contacts[`@@g`] = &Contact{
+		UserName: `@@g`,
+		MemberList: []*Contact{
+			{UserName: `@a`, NickName: `张三`, DisplayName: `老张`},
+			{UserName: `@b`, NickName: `老张`}, // NickName same as DisplayName of @a
+			{UserName: `@c`, NickName: `张三丰`},
+			{UserName: `@d`, NickName: `Tom`, DisplayName: `Tom`}, // same name twice
+			{UserName: `@e`, NickName: `Tim`},
+			{UserName: `@f`, NickName: `Tim`}, // same NickName, smaller UserName wins
+		},
+	}
+
+	cases := []struct {
+		content  string
+		mentions []string
+	}{
+		{`no mention`, nil},
+		{`@老张 hi`, []string{`@a`}},
+		{"@张三丰 @张三 hi", []string{`@c`, `@a`}},
+		{`@张三`, []string{`@a`}},
+		{`@Tom @Tom`, []string{`@d`}},
+		{`@Tim`, []string{`@e`}},
+		{`@所有人 开会`, []string{MentionAll}},
+		{`mail@张三`, nil},
+		{`a@all b`, nil},
+		{"开会\n@张三\u2005@老张", []string{`@a`}},
+		{"@Tim\u2005@all", []string{`@e`, MentionAll}},
+		{`@张三x`, nil},
+	}
+
+	for _, c := range cases {
+		// map iteration must not change the result
+		for i := 0; i < 10; i++ {
+			got := wechat.parseMentions(`@@g`, c.content)
+			if !reflect.DeepEqual(got, c.mentions) {
+				t.Fatalf(`parseMentions(%q) = %v, want %v`, c.content, got, c.mentions)
+			}
+		}
+	}
+}
+
+func TestIsMentioned(t *testing.T) {
+	if !isMentioned([]string{MentionAll}, `@me`) {
+		t.Error(`@所有人 should mention everyone`)
+	}
+	if isMentioned([]string{`@a`}, `@me`) {
+		t.Error(`@a should not mention @me`)
+	}
+}
@@ -0,0 +1,48 @@
+package messages
+
+import "fmt"
+
+// CardMsg is a contact name card msg
+type CardMsg struct {
+	to       string
+	userName string
+	nickName string
+	alias    string
+	province string
+	city     string
+	sign     string
+	sex      int
+}
+
+// Path is card msg's api path
+func (msg *CardMsg) Path() string {
+	return `webwxsendmsg`
+}
+
+// To destination
+func (msg *CardMsg) To() string {
+	return msg.to
+}
+
+// Content card msg's content
+func (msg *CardMsg) Content() map[string]interface{} {
+	content := make(map[string]interface{}, 0)
+
+	content[`Type`] = 42
+	content[`Content`] = fmt.Sprintf(`<?xml version="1.0"?><msg bigheadimgurl="" smallheadimgurl="" username="%s" nickname="%s" fullpy="" shortpy="" alias="%s" imagestatus="3" scene="17" province="%s" city="%s" sign="%s" sex="%d" certflag="0" certinfo="" brandIconUrl="" brandHomeUrl="" brandSubscriptConfigUrl="" brandFlags="0" regionCode="" />`, escape(msg.userName), escape(msg.nickName), escape(msg.alias), escape(msg.province), escape(msg.city), escape(msg.sign), msg.sex)
+
+	return content
+}
+
+func (msg *CardMsg) Description() string {
+	return fmt.Sprintf(`[CardMsg] %s`, msg.nickName)
+}
+
+// NewCardMsg construct a new CardMsg's instance
+func NewCardMsg(userName, nickName, alias, province, city, sign string, sex int, to string) *CardMsg {
+	return &CardMsg{to, userName, nickName, alias, province, city, sign, sex}
+}
+
+func (msg *CardMsg) String() string {
+	return msg.nickName
+}
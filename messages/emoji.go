@@ -0,0 +1,16 @@
+package messages
+
+import "strings"
+
+// textReplacer convert text to the form wx server keeps as is,
+// variation selectors after emoji are turned into `?` by the server.
+var textReplacer = strings.NewReplacer(
+	"\ufe0f", ``,
+	"\ufe0e", ``,
+	"\r\n", "\n",
+)
+
+// encodeText prepare user input before it is sent
+func encodeText(s string) string {
+	return textReplacer.Replace(s)
+}
@@ -10,6 +10,7 @@ type FileMsg struct {
 	ftype   int
 	fname   string
 	ext     string
+	size    int64
 }
 
 // Path is text msg's api path
@@ -29,7 +30,7 @@ func (msg *FileMsg) Content() map[string]interface{} {
 	content[`Type`] = msg.ftype
 
 	if msg.ftype == 6 {
-		content[`Content`] = fmt.Sprintf(`<appmsg appid='wxeb7ec651dd0aefa9' sdkver=''><title>%s</title><des></des><action></action><type>6</type><content></content><url></url><lowurl></lowurl><appattach><totallen>10</totallen><attachid>%s</attachid><fileext>%s</fileext></appattach><extinfo></extinfo></appmsg>`, msg.fname, msg.mediaID, msg.ext)
+		content[`Content`] = fmt.Sprintf(`<appmsg appid='wxeb7ec651dd0aefa9' sdkver=''><title>%s</title><des></des><action></action><type>6</type><content></content><url></url><lowurl></lowurl><appattach><totallen>%d</totallen><attachid>%s</attachid><fileext>%s</fileext></appattach><extinfo></extinfo></appmsg>`, escape(msg.fname), msg.size, escape(msg.mediaID), escape(msg.ext))
 	} else {
 		content[`MediaId`] = msg.mediaID
 	}
@@ -41,19 +42,25 @@ func (msg *FileMsg) Description() string {
 	return fmt.Sprintf(`[FileMsg] %s`, msg.fname)
 }
 
-// NewFileMsg construct a new FileMsg's instance
+// NewFileMsg construct a new FileMsg's instance, totallen is 0, use
+// NewFileMsgWithSize if size of file is known.
 func NewFileMsg(mediaID, to, name, ext string) *FileMsg {
-	return &FileMsg{to, mediaID, `webwxsendappmsg?fun=async&f=json`, 6, name, ext}
+	return NewFileMsgWithSize(mediaID, to, name, ext, 0)
+}
+
+// NewFileMsgWithSize is NewFileMsg with size of the uploaded file.
+func NewFileMsgWithSize(mediaID, to, name, ext string, size int64) *FileMsg {
+	return &FileMsg{to, mediaID, `webwxsendappmsg?fun=async&f=json`, 6, name, ext, size}
 }
 
 // NewImageMsg ..
 func NewImageMsg(mediaID, to string) *FileMsg {
-	return &FileMsg{to, mediaID, `webwxsendmsgimg?fun=async&f=json`, 3, ``, ``}
+	return &FileMsg{to, mediaID, `webwxsendmsgimg?fun=async&f=json`, 3, ``, ``, 0}
 }
 
 // NewVideoMsg ..
 func NewVideoMsg(mediaID, to string) *FileMsg {
-	return &FileMsg{to, mediaID, `webwxsendvideomsg?fun=async&f=json`, 43, ``, ``}
+	return &FileMsg{to, mediaID, `webwxsendvideomsg?fun=async&f=json`, 43, ``, ``, 0}
 }
 
 func (msg *FileMsg) String() string {
@@ -0,0 +1,21 @@
+package messages
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFileMsgTotalLen(t *testing.T) {
+	cases := []struct {
+		msg  *FileMsg
+		want string
+	}{
+		{NewFileMsgWithSize(`@crypt_1`, `filehelper`, `a.pdf`, `pdf`, 1048576), `<totallen>1048576</totallen>`},
+		{NewFileMsg(`@crypt_1`, `filehelper`, `a.pdf`, `pdf`), `<totallen>0</totallen>`},
+	}
+	for _, c := range cases {
+		if content := c.msg.Content()[`Content`].(string); !strings.Contains(content, c.want) {
+			t.Errorf(`content %s has no %s`, content, c.want)
+		}
+	}
+}
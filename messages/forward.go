@@ -0,0 +1,67 @@
+package messages
+
+import "fmt"
+
+// ForwardMsg resend the content of a received message,
+// media is referenced by the server side MediaId or the original xml.
+type ForwardMsg struct {
+	to         string
+	msgType    int
+	appMsgType int
+	content    string
+	mediaID    string
+}
+
+// Path is forward msg's api path, it depends on the original type
+func (msg *ForwardMsg) Path() string {
+	switch msg.msgType {
+	case 3:
+		return `webwxsendmsgimg?fun=async&f=json`
+	case 43:
+		return `webwxsendvideomsg?fun=async&f=json`
+	case 47:
+		return `webwxsendemoticon?fun=sys`
+	case 49:
+		return `webwxsendappmsg?fun=async&f=json`
+	}
+	return `webwxsendmsg`
+}
+
+// To destination
+func (msg *ForwardMsg) To() string {
+	return msg.to
+}
+
+// Content forward msg's content
+func (msg *ForwardMsg) Content() map[string]interface{} {
+	content := make(map[string]interface{}, 0)
+
+	content[`Type`] = msg.msgType
+	if msg.msgType == 49 {
+		// app msg 发送时 Type 是 AppMsgType
+		content[`Type`] = msg.appMsgType
+	}
+	content[`Content`] = msg.content
+	if len(msg.mediaID) > 0 {
+		content[`MediaId`] = msg.mediaID
+	}
+	if msg.msgType == 47 {
+		content[`EmojiFlag`] = 2
+	}
+
+	return content
+}
+
+func (msg *ForwardMsg) Description() string {
+	return fmt.Sprintf(`[ForwardMsg] type %d/%d %s`, msg.msgType, msg.appMsgType, msg.mediaID)
+}
+
+// NewForwardMsg construct a new ForwardMsg's instance,
+// msgType is the MsgType of the original msg, appMsgType is only for app messages (49).
+func NewForwardMsg(msgType, appMsgType int, content, mediaID, to string) *ForwardMsg {
+	return &ForwardMsg{to, msgType, appMsgType, content, mediaID}
+}
+
+func (msg *ForwardMsg) String() string {
+	return `FORWARD`
+}
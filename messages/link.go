@@ -0,0 +1,45 @@
+package messages
+
+import "fmt"
+
+// LinkMsg is a link share app msg
+type LinkMsg struct {
+	to          string
+	title       string
+	description string
+	url         string
+	thumbURL    string
+}
+
+// Path is link msg's api path
+func (msg *LinkMsg) Path() string {
+	return `webwxsendappmsg?fun=async&f=json`
+}
+
+// To destination
+func (msg *LinkMsg) To() string {
+	return msg.to
+}
+
+// Content link msg's content
+func (msg *LinkMsg) Content() map[string]interface{} {
+	content := make(map[string]interface{}, 0)
+
+	content[`Type`] = 5
+	content[`Content`] = fmt.Sprintf(`<appmsg appid='' sdkver='0'><title>%s</title><des>%s</des><action></action><type>5</type><showtype>0</showtype><content></content><url>%s</url><thumburl>%s</thumburl></appmsg>`, escape(msg.title), escape(msg.description), escape(msg.url), escape(msg.thumbURL))
+
+	return content
+}
+
+func (msg *LinkMsg) Description() string {
+	return fmt.Sprintf(`[LinkMsg] %s %s`, msg.title, msg.url)
+}
+
+// NewLinkMsg construct a new LinkMsg's instance
+func NewLinkMsg(title, description, url, thumbURL, to string) *LinkMsg {
+	return &LinkMsg{to, title, description, url, thumbURL}
+}
+
+func (msg *LinkMsg) String() string {
+	return msg.url
+}
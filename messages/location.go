@@ -0,0 +1,49 @@
+package messages
+
+import "fmt"
+
+// LocationMsg is a location share msg. Web wx can't send locations, this is
+// MsgType 48 of received ones sent through webwxsendmsg, which wx server is not
+// verified to accept, so it is sent only if Configure.LocationMsg is on.
+type LocationMsg struct {
+	to        string
+	latitude  float64
+	longitude float64
+	scale     int
+	label     string
+	poiName   string
+}
+
+// Path is location msg's api path
+func (msg *LocationMsg) Path() string {
+	return `webwxsendmsg`
+}
+
+// To destination
+func (msg *LocationMsg) To() string {
+	return msg.to
+}
+
+// Content location msg's content
+func (msg *LocationMsg) Content() map[string]interface{} {
+	content := make(map[string]interface{}, 0)
+
+	content[`Type`] = 48
+	content[`Content`] = fmt.Sprintf(`<?xml version="1.0"?><msg><location x="%f" y="%f" scale="%d" label="%s" maptype="0" poiname="%s" poiid="" /></msg>`, msg.latitude, msg.longitude, msg.scale, escape(msg.label), escape(msg.poiName))
+
+	return content
+}
+
+func (msg *LocationMsg) Description() string {
+	return fmt.Sprintf(`[LocationMsg] %s (%f, %f)`, msg.label, msg.latitude, msg.longitude)
+}
+
+// NewLocationMsg construct a new LocationMsg's instance,
+// label is the address and poiName the name of the place.
+func NewLocationMsg(latitude, longitude float64, label, poiName, to string) *LocationMsg {
+	return &LocationMsg{to, latitude, longitude, 15, label, poiName}
+}
+
+func (msg *LocationMsg) String() string {
+	return msg.label
+}
@@ -0,0 +1,57 @@
+package messages
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// MentionSeparator is the U+2005 space wechat clients put after `@name`
+const MentionSeparator = "\u2005"
+
+// MentionTextMsg is a text msg which @ some group members
+type MentionTextMsg struct {
+	to      string
+	content string
+	names   []string
+}
+
+// Path is mention msg's api path
+func (msg *MentionTextMsg) Path() string {
+	return `webwxsendmsg`
+}
+
+// To destination
+func (msg *MentionTextMsg) To() string {
+	return msg.to
+}
+
+// Content mention msg's content
+func (msg *MentionTextMsg) Content() map[string]interface{} {
+	content := make(map[string]interface{}, 0)
+
+	content[`Type`] = 1
+	content[`Content`] = encodeText(msg.String())
+
+	return content
+}
+
+func (msg *MentionTextMsg) Description() string {
+	return fmt.Sprintf(`[MentionTextMsg] %s`, msg.String())
+}
+
+// NewMentionTextMsg construct a new MentionTextMsg's instance,
+// names are the display names of the members in the group.
+func NewMentionTextMsg(text, to string, names ...string) *MentionTextMsg {
+	return &MentionTextMsg{to, text, names}
+}
+
+func (msg *MentionTextMsg) String() string {
+	var buffer bytes.Buffer
+	for _, name := range msg.names {
+		buffer.WriteString(`@`)
+		buffer.WriteString(name)
+		buffer.WriteString(MentionSeparator)
+	}
+	buffer.WriteString(msg.content)
+	return buffer.String()
+}
@@ -23,7 +23,7 @@ func (msg *TextMsg) Content() map[string]interface{} {
 	content := make(map[string]interface{}, 0)
 
 	content["Type"] = 1
-	content["Content"] = msg.content
+	content["Content"] = encodeText(msg.content)
 
 	return content
 }
@@ -40,4 +40,3 @@ func NewTextMsg(text, to string) *TextMsg {
 func (msg *TextMsg) String() string {
 	return msg.content
 }
-
@@ -0,0 +1,13 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/xml"
+)
+
+// escape user input before it is put into xml content or attribute
+func escape(s string) string {
+	var buffer bytes.Buffer
+	xml.EscapeText(&buffer, []byte(s))
+	return buffer.String()
+}
@@ -0,0 +1,70 @@
+package messages
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+// xmlValues parse content and returns all attribute values and text,
+// unescaped by encoding/xml.
+func xmlValues(t *testing.T, content string) []string {
+	var values []string
+	d := xml.NewDecoder(strings.NewReader(content))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return values
+		}
+		if err != nil {
+			t.Fatalf(`bad xml %s: %v`, content, err)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			for _, attr := range tok.Attr {
+				values = append(values, attr.Value)
+			}
+		case xml.CharData:
+			values = append(values, string(tok))
+		}
+	}
+}
+
+func TestXMLEscaping(t *testing.T) {
+
+	const (
+		title = `<b>Tom & "Jerry"</b> 's`
+		link  = `https://example.com/?a=1&b=<2>&c="3"`
+	)
+
+	cases := []struct {
+		name string
+		msg  interface {
+			Content() map[string]interface{}
+		}
+		want []string
+	}{
+		{`link`, NewLinkMsg(title, `a & b`, link, link+`&thumb`, `to`), []string{title, `a & b`, link, link + `&thumb`}},
+		{`file`, NewFileMsgWithSize(`@crypt_<1>`, `to`, title+`.pdf`, `p&f`, 1), []string{title + `.pdf`, `@crypt_<1>`, `p&f`}},
+		{`card`, NewCardMsg(`@u"1`, title, `a'b`, `<p>`, `c&c`, `"sign"`, 1, `to`), []string{`@u"1`, title, `a'b`, `<p>`, `c&c`, `"sign"`}},
+		{`location`, NewLocationMsg(39.9, 116.4, title, `"天安门" & <广场>`, `to`), []string{title, `"天安门" & <广场>`}},
+	}
+
+	for _, c := range cases {
+		content := c.msg.Content()[`Content`].(string)
+		values := xmlValues(t, content)
+		for _, w := range c.want {
+			found := false
+			for _, v := range values {
+				if v == w {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Errorf(`%s: %q is not in %s`, c.name, w, content)
+			}
+		}
+	}
+}
@@ -2,26 +2,27 @@ package wechat
 
 import (
 	"bytes"
-	"crypto/md5"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"math/rand"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/KevinGong2013/wechat/messages"
-
-	"gopkg.in/h2non/filetype.v1"
-	"gopkg.in/h2non/filetype.v1/types"
 )
 
+// ErrLocationMsgDisabled is returned when a LocationMsg is sent but Configure.LocationMsg is off.
+var ErrLocationMsgDisabled = errors.New(`location message is disabled`)
+
 type uploadMediaResponse struct {
 	Response
 	MediaID string `json:"MediaId"`
@@ -42,16 +43,27 @@ type Msg interface {
 	Description() string
 }
 
+// mediaIndex number uploads of this process, uploads may run concurrently
 var mediaIndex = int64(0)
 
-// SendMsg send Message to group or contact
+// SendMsg send Message to group or contact, message is throttled by the outbound queue.
 func (wechat *WeChat) SendMsg(message Msg) error {
+	_, err := wechat.SendMsgContext(context.Background(), message)
+	return err
+}
+
+// sendMsg post message to wx server directly, id is LocalID and ClientMsgId
+// of message, retries must use the same id so server can tell it's resent.
+func (wechat *WeChat) sendMsg(ctx context.Context, message Msg, id string) (*SentMessage, error) {
 
 	if wechat.BaseRequest == nil {
-		return fmt.Errorf(`wechat BaseRequest is empty`)
+		return nil, fmt.Errorf(`wechat BaseRequest is empty`)
+	}
+	if _, ok := message.(*messages.LocationMsg); ok && !wechat.conf.LocationMsg {
+		return nil, ErrLocationMsgDisabled
 	}
 
-	msg := baseMsg(message.To())
+	msg := baseMsg(message.To(), id)
 
 	for k, v := range message.Content() {
 		msg[k] = v
@@ -69,7 +81,7 @@ func (wechat *WeChat) SendMsg(message Msg) error {
 	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	logger.Debugf(`sending [%s]`, msg[`LocalID`])
@@ -84,13 +96,21 @@ func (wechat *WeChat) SendMsg(message Msg) error {
 		apiURL += `?` + wechat.PassTicketKV()
 	}
 
-	err = wechat.Execute(apiURL, buffer, resp)
+	err = wechat.ExecuteContext(ctx, apiURL, buffer, resp)
 
-	if err == nil {
-		logger.Debugf(`sended [%s] MsgID=[%s]`, resp.LocalID, resp.MsgID)
+	if err != nil {
+		return nil, err
 	}
 
-	return err
+	logger.Debugf(`sended [%s] MsgID=[%s]`, resp.LocalID, resp.MsgID)
+
+	return &SentMessage{
+		MsgID:   resp.MsgID,
+		LocalID: resp.LocalID,
+		To:      message.To(),
+		Msg:     message,
+		Time:    time.Now().Unix(),
+	}, nil
 }
 
 // SendTextMsg send text message
@@ -110,187 +130,356 @@ func (wechat *WeChat) SendFile(path, to string) error {
 	return wechat.SendMsg(msg)
 }
 
+// AttachmentKind decide which kind of message an attachment is sent as.
+type AttachmentKind int
+
+const (
+	// AutoAttachment detect kind by content
+	AutoAttachment AttachmentKind = iota
+	// ImageAttachment 图片
+	ImageAttachment
+	// VideoAttachment 视频
+	VideoAttachment
+	// DocumentAttachment 文件
+	DocumentAttachment
+	// EmoticonAttachment 表情
+	EmoticonAttachment
+)
+
+// Attachment is a media not in local file system, e.g. a chart generated in memory.
+// Set Data for a byte slice or Reader for a stream, Reader is used if both set.
+type Attachment struct {
+	Name    string
+	ModTime time.Time
+	Kind    AttachmentKind
+	Data    []byte
+	Reader  io.Reader
+}
+
+// SendImage send image read from r
+func (wechat *WeChat) SendImage(ctx context.Context, to, name string, r io.Reader) (*SentMessage, error) {
+	return wechat.SendAttachment(ctx, to, Attachment{Name: name, Kind: ImageAttachment, Reader: r})
+}
+
+// SendVideo send video read from r
+func (wechat *WeChat) SendVideo(ctx context.Context, to, name string, r io.Reader) (*SentMessage, error) {
+	return wechat.SendAttachment(ctx, to, Attachment{Name: name, Kind: VideoAttachment, Reader: r})
+}
+
+// SendDocument send file read from r, name is shown as file name
+func (wechat *WeChat) SendDocument(ctx context.Context, to, name string, r io.Reader) (*SentMessage, error) {
+	return wechat.SendAttachment(ctx, to, Attachment{Name: name, Kind: DocumentAttachment, Reader: r})
+}
+
+// SendEmoticon send gif emoticon read from r
+func (wechat *WeChat) SendEmoticon(ctx context.Context, to, name string, r io.Reader) (*SentMessage, error) {
+	return wechat.SendAttachment(ctx, to, Attachment{Name: name, Kind: EmoticonAttachment, Reader: r})
+}
+
+// SendAttachment upload attachment and send it as the message of att.Kind,
+// ctx covers both upload and send, the receipt has MsgID of the message.
+func (wechat *WeChat) SendAttachment(ctx context.Context, to string, att Attachment) (*SentMessage, error) {
+	msg, err := wechat.newAttachmentMsg(ctx, to, att)
+	if err != nil {
+		return nil, err
+	}
+
+	return wechat.SendMsgContext(ctx, msg)
+}
+
+func (wechat *WeChat) newAttachmentMsg(ctx context.Context, to string, att Attachment) (Msg, error) {
+
+	r := att.Reader
+	if r == nil {
+		r = bytes.NewReader(att.Data)
+	}
+
+	pm, err := wechat.prepareMedia(r, att.Name, att.ModTime)
+	if err != nil {
+		return nil, err
+	}
+	defer pm.close()
+
+	switch att.Kind {
+	case ImageAttachment, EmoticonAttachment:
+		pm.MediaType = `pic`
+	case VideoAttachment:
+		pm.MediaType = `video`
+	case DocumentAttachment:
+		pm.MediaType = `doc`
+	}
+
+	media, err := wechat.UploadMediaContext(ctx, pm.reader, pm.Size, pm.MediaInfo, to, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch att.Kind {
+	case ImageAttachment:
+		return messages.NewImageMsg(media, to), nil
+	case EmoticonAttachment:
+		return messages.NewEmoticonMsgMsg(media, to), nil
+	case VideoAttachment:
+		return messages.NewVideoMsg(media, to), nil
+	case DocumentAttachment:
+		return messages.NewFileMsgWithSize(media, to, pm.Name, pm.Extension, pm.Size), nil
+	}
+
+	return newMediaMsg(pm, media, to), nil
+}
+
+// uploadChunkSize is the max size of one chunk accepted by wx cdn for web client.
+var uploadChunkSize int64 = 512 * 1024
+
+// uploadHosts are prefixed to host of BaseURL to upload media, tried in turn.
+var uploadHosts = []string{`file.`, `file2.`}
+
+var maxUploadChunkRetryTimes = 3
+
+// UploadProgress is called after every uploaded chunk.
+type UploadProgress func(uploaded, total int64)
+
+// MediaInfo describes an attachment which will be uploaded.
+type MediaInfo struct {
+	Name      string
+	ModTime   time.Time
+	MIME      string
+	MediaType string // pic, video or doc
+	MD5       string // hex encoded
+}
+
 // UploadMedia is a convernice method to upload attachment to wx cdn.
-func (wechat *WeChat) UploadMedia(buf []byte, kind types.Type, info os.FileInfo, to string) (string, error) {
+// r is read chunk by chunk, so the whole attachment never hold in memory,
+// size must be the exact count of bytes can read from r.
+func (wechat *WeChat) UploadMedia(r io.Reader, size int64, info MediaInfo, to string, progress UploadProgress) (string, error) {
+	return wechat.UploadMediaContext(context.Background(), r, size, info, to, progress)
+}
 
-	// Only the first 261 bytes are used to sniff the content type.
-	head := buf[:261]
+// UploadMediaContext is UploadMedia with a context.
+func (wechat *WeChat) UploadMediaContext(ctx context.Context, r io.Reader, size int64, info MediaInfo, to string, progress UploadProgress) (string, error) {
 
-	var mediatype string
-	if filetype.IsImage(head) {
-		mediatype = `pic`
-	} else if filetype.IsVideo(head) {
-		mediatype = `video`
-	} else {
-		mediatype = `doc`
+	if size <= 0 {
+		return ``, ErrEmptyMedia
+	}
+
+	if len(info.MD5) > 0 {
+		mediaID := wechat.uploaded.get(info)
+		// 一块就能传完的不值得多问一次
+		if len(mediaID) == 0 && size > uploadChunkSize {
+			var err error
+			if mediaID, err = wechat.checkUpload(ctx, size, info, to); err != nil {
+				logger.Debugf(`check upload [%s] failed: %v`, info.Name, err)
+			}
+		}
+		if len(mediaID) > 0 {
+			logger.Debugf(`media [%s] md5 [%s] already uploaded`, info.Name, info.MD5)
+			wechat.uploaded.set(info, mediaID)
+			if progress != nil {
+				progress(size, size)
+			}
+			return mediaID, nil
+		}
 	}
 
+	clientMediaID := now()
 	fields := map[string]string{
-		`id`:                `WU_FILE_` + str(mediaIndex),
-		`name`:              info.Name(),
-		`type`:              kind.MIME.Value,
-		`lastModifiedDate`:  info.ModTime().UTC().String(),
-		`size`:              str(info.Size()),
-		`mediatype`:         mediatype,
+		`id`:                `WU_FILE_` + str(atomic.AddInt64(&mediaIndex, 1)-1),
+		`name`:              info.Name,
+		`type`:              info.MIME,
+		`lastModifiedDate`:  info.ModTime.UTC().String(),
+		`size`:              str(size),
+		`mediatype`:         info.MediaType,
 		`pass_ticket`:       wechat.BaseRequest.PassTicket,
 		`webwx_data_ticket`: wechat.CookieDataTicket(),
 	}
 
-	media, err := json.Marshal(&map[string]interface{}{
-		`BaseRequest`:   wechat.BaseRequest,
-		`ClientMediaId`: now(),
-		`TotalLen`:      str(info.Size()),
-		`StartPos`:      0,
-		`DataLen`:       str(info.Size()),
-		`MediaType`:     4,
-		`UploadType`:    2,
-		`ToUserName`:    to,
-		`FromUserName`:  wechat.MySelf.UserName,
-		`FileMd5`:       string(md5.New().Sum(buf)),
-	})
-
-	if err != nil {
-		return ``, err
+	chunks := (size + uploadChunkSize - 1) / uploadChunkSize
+	if chunks > 1 {
+		fields[`chunks`] = str(chunks)
 	}
 
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
+	buf := make([]byte, uploadChunkSize)
+	uploaded := int64(0)
+	mediaID := ``
 
-	fw, err := writer.CreateFormFile(`filename`, info.Name())
-	if err != nil {
-		return ``, err
+	for chunk := int64(0); chunk < chunks; chunk++ {
+
+		if err := ctx.Err(); err != nil {
+			return ``, err
+		}
+
+		n := size - uploaded
+		if n > uploadChunkSize {
+			n = uploadChunkSize
+		}
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return ``, fmt.Errorf(`read chunk %d/%d failed: %v`, chunk, chunks, err)
+		}
+
+		// 每一块都带上自己的位置和长度
+		media, err := json.Marshal(&map[string]interface{}{
+			`BaseRequest`:   wechat.BaseRequest,
+			`ClientMediaId`: clientMediaID,
+			`TotalLen`:      str(size),
+			`StartPos`:      uploaded,
+			`DataLen`:       str(n),
+			`MediaType`:     4,
+			`UploadType`:    2,
+			`ToUserName`:    to,
+			`FromUserName`:  wechat.MySelf.UserName,
+			`FileMd5`:       info.MD5,
+		})
+		if err != nil {
+			return ``, err
+		}
+		fields[`uploadmediarequest`] = string(media)
+
+		if chunks > 1 {
+			fields[`chunk`] = str(chunk)
+		}
+
+		mediaID, err = wechat.uploadChunk(ctx, fields, info.Name, buf[:n])
+		if err != nil {
+			return ``, fmt.Errorf(`upload chunk %d/%d failed: %v`, chunk, chunks, err)
+		}
+
+		uploaded += n
+		if progress != nil {
+			progress(uploaded, size)
+		}
 	}
-	fw.Write(buf)
 
-	for k, v := range fields {
-		writer.WriteField(k, v)
+	if len(mediaID) == 0 {
+		return ``, errors.New(`wx cdn did not return media id`)
 	}
 
-	writer.WriteField(`uploadmediarequest`, string(media))
-	writer.Close()
+	if len(info.MD5) > 0 {
+		wechat.uploaded.set(info, mediaID)
+	}
 
-	urlOBJ, err := url.Parse(wechat.BaseURL)
+	return mediaID, nil
+}
+
+// uploadChunk post one chunk, retry on file and file2 host alternately.
+func (wechat *WeChat) uploadChunk(ctx context.Context, fields map[string]string, name string, data []byte) (string, error) {
 
+	urlOBJ, err := url.Parse(wechat.BaseURL)
 	if err != nil {
 		return ``, err
 	}
 
-	host := urlOBJ.Host
-
-	urls := [2]string{
-		fmt.Sprintf(`https://file.%s/cgi-bin/mmwebwx-bin/webwxuploadmedia?f=json`, host),
-		fmt.Sprintf(`https://file2.%s/cgi-bin/mmwebwx-bin/webwxuploadmedia?f=json`, host),
+	urls := make([]string, len(uploadHosts))
+	for i, prefix := range uploadHosts {
+		urls[i] = fmt.Sprintf(`%s://%s%s/cgi-bin/mmwebwx-bin/webwxuploadmedia?f=json`, urlOBJ.Scheme, prefix, urlOBJ.Host)
 	}
 
-	for _, urlPath := range urls {
+	for i := 0; i < maxUploadChunkRetryTimes; i++ {
+
+		if i > 0 {
+			logger.Warnf(`upload chunk failed: %v, will retry after %d second(s)`, err, i)
+			select {
+			case <-ctx.Done():
+				return ``, ctx.Err()
+			case <-time.After(time.Second * time.Duration(i)):
+			}
+		}
+
+		var body *bytes.Buffer
+		var contentType string
+		body, contentType, err = multipartChunk(fields, name, data)
+		if err != nil {
+			return ``, err
+		}
 
 		var req *http.Request
-		req, err = http.NewRequest(`POST`, urlPath, body)
+		req, err = http.NewRequest(`POST`, urls[i%len(urls)], body)
 		if err != nil {
 			return ``, err
 		}
 
-		req.Header.Set(`Content-Type`, writer.FormDataContentType())
+		req = req.WithContext(ctx)
+		req.Header.Set(`Content-Type`, contentType)
 
 		resp := new(uploadMediaResponse)
 
 		err = wechat.ExecuteRequest(req, resp)
-		if err != nil {
-			return ``, err
+		if err == nil {
+			return resp.MediaID, nil
 		}
-
-		mediaIndex++
-		return resp.MediaID, nil
 	}
 
 	return ``, err
 }
 
-// DownloadMedia use to download a voice or immage msg
-func (wechat *WeChat) DownloadMedia(url string, localPath string) (string, error) {
-
-	req, err := http.NewRequest(`GET`, url, nil)
-	if err != nil {
-		return ``, err
-	}
-
-	req.Header.Set(`Range`, `bytes=0-`) // 只有小视频才需要加这个headers
+// multipartChunk returns the form of a chunk and its content type.
+func multipartChunk(fields map[string]string, name string, data []byte) (*bytes.Buffer, string, error) {
 
-	resp, err := wechat.Client.Do(req)
-	defer resp.Body.Close()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
 
-	if err != nil {
-		return ``, err
-	}
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return ``, err
+	for k, v := range fields {
+		if err := writer.WriteField(k, v); err != nil {
+			return nil, ``, err
+		}
 	}
 
-	t, err := filetype.Get(data)
+	fw, err := writer.CreateFormFile(`filename`, name)
 	if err != nil {
-		return ``, err
+		return nil, ``, err
 	}
-
-	path := filepath.Join(localPath + `.` + t.Extension)
-	err = createFile(path, data, false)
-	if err != nil {
-		return ``, err
+	if _, err = fw.Write(data); err != nil {
+		return nil, ``, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, ``, err
 	}
 
-	return path, nil
+	return body, writer.FormDataContentType(), nil
 }
 
 // NewMsg create new message instance
 func (wechat *WeChat) newMsg(filepath, to string) (Msg, error) {
 
-	info, err := os.Stat(filepath)
-	if err != nil {
-		return nil, err
-	}
-
-	buf, err := ioutil.ReadFile(filepath)
+	file, err := os.Open(filepath)
 	if err != nil {
 		return nil, err
 	}
-	kind, _ := filetype.Get(buf)
-
-	media, err := wechat.UploadMedia(buf, kind, info, to)
+	defer file.Close()
 
+	info, err := file.Stat()
 	if err != nil {
 		return nil, err
 	}
 
-	var msg Msg
+	return wechat.newAttachmentMsg(context.Background(), to, Attachment{
+		Name:    info.Name(),
+		ModTime: info.ModTime(),
+		Reader:  file,
+	})
+}
 
-	if filetype.IsImage(buf) {
-		if strings.HasSuffix(kind.MIME.Value, `gif`) {
-			msg = messages.NewEmoticonMsgMsg(media, to)
-		} else {
-			msg = messages.NewImageMsg(media, to)
-		}
-	} else {
-		info, _ := os.Stat(filepath)
-		if filetype.IsVideo(buf) {
-			msg = messages.NewVideoMsg(media, to)
-		} else {
-			msg = messages.NewFileMsg(media, to, info.Name(), kind.Extension)
+func newMediaMsg(pm *preparedMedia, media, to string) Msg {
+	if pm.isImage() {
+		if pm.Extension == `gif` {
+			return messages.NewEmoticonMsgMsg(media, to)
 		}
+		return messages.NewImageMsg(media, to)
+	} else if pm.isVideo() {
+		return messages.NewVideoMsg(media, to)
 	}
-
-	return msg, err
+	return messages.NewFileMsgWithSize(media, to, pm.Name, pm.Extension, pm.Size)
 }
 
 func clientMsgID() string {
 	return strconv.FormatInt(time.Now().Unix()*1000, 10) + strconv.Itoa(rand.Intn(10000))
 }
 
-func baseMsg(to string) map[string]interface{} {
+func baseMsg(to, id string) map[string]interface{} {
 
 	msg := map[string]interface{}{
 		`ToUserName`:  to,
-		`LocalID`:     clientMsgID(),
-		`ClientMsgId`: clientMsgID(),
+		`LocalID`:     id,
+		`ClientMsgId`: id,
 	}
 
 	return msg
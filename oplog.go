@@ -0,0 +1,132 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// CmdId of webwxoplog
+const (
+	opLogCmdRemarkName = 2
+	opLogCmdTop        = 3
+	opLogCmdStar       = 4
+)
+
+// ContactFlag bits
+const (
+	contactFlagStar = 64
+	contactFlagTop  = 2048
+)
+
+// SetRemarkName set remark name of contact, `/contact/mod/remark` is emitted.
+func (wechat *WeChat) SetRemarkName(ctx context.Context, contact *Contact, name string) error {
+
+	err := wechat.opLog(ctx, map[string]interface{}{
+		`UserName`:   contact.UserName,
+		`CmdId`:      opLogCmdRemarkName,
+		`RemarkName`: name,
+	})
+	if err != nil {
+		return err
+	}
+
+	return wechat.modifyContact(contact.UserName, func(c *Contact) {
+		c.RemarkName, c.RawRemarkName = name, name
+	})
+}
+
+// SetPinned pin contact to top of the chat list or not.
+func (wechat *WeChat) SetPinned(ctx context.Context, contact *Contact, pinned bool) error {
+
+	err := wechat.opLog(ctx, map[string]interface{}{
+		`UserName`: contact.UserName,
+		`CmdId`:    opLogCmdTop,
+		`OP`:       boolToOP(pinned),
+	})
+	if err != nil {
+		return err
+	}
+
+	return wechat.modifyContact(contact.UserName, func(c *Contact) {
+		c.ContactFlag = setFlag(c.ContactFlag, contactFlagTop, pinned)
+	})
+}
+
+// SetStarred star contact or not, `/contact/mod/starred` or `/contact/mod/unstarred`
+// is emitted. It is sent by webwxoplog like pinning, cache is not changed if
+// server refuse it.
+func (wechat *WeChat) SetStarred(ctx context.Context, contact *Contact, starred bool) error {
+
+	err := wechat.opLog(ctx, map[string]interface{}{
+		`UserName`: contact.UserName,
+		`CmdId`:    opLogCmdStar,
+		`OP`:       boolToOP(starred),
+	})
+	if err != nil {
+		return err
+	}
+
+	return wechat.modifyContact(contact.UserName, func(c *Contact) {
+		c.StarFriend = float64(boolToOP(starred))
+		c.ContactFlag = setFlag(c.ContactFlag, contactFlagStar, starred)
+	})
+}
+
+func (wechat *WeChat) opLog(ctx context.Context, body map[string]interface{}) error {
+
+	body[`BaseRequest`] = wechat.BaseRequest
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	urlPath := fmt.Sprintf(`%s/webwxoplog?lang=zh_CN&%v`, wechat.BaseURL, wechat.PassTicketKV())
+	resp := new(Response)
+
+	// BaseResponse is checked by ExecuteContext
+	return wechat.ExecuteContext(ctx, urlPath, bytes.NewReader(data), resp)
+}
+
+// modifyContact apply f to a copy of cached contact, replace the cached one
+// and emit the change, it's called after server accepted the change so a
+// contact not in cache is not an error.
+func (wechat *WeChat) modifyContact(un string, f func(*Contact)) error {
+
+	c := wechat.cache
+	c.Lock()
+	old, found := c.contacts[un]
+	if !found {
+		c.Unlock()
+		// 服务器已经改了, 下次同步时会拿到
+		logger.Warnf(`contact [%s] is modified but not in cache`, un)
+		return nil
+	}
+	nc := old.clone()
+	f(nc)
+	c.unindexContact(old)
+	c.contacts[un] = nc
+	c.indexContact(nc)
+	c.dirty = true
+	c.Unlock()
+
+	go wechat.evtStream.emitContactModEvent(*old, *nc)
+
+	return nil
+}
+
+func boolToOP(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func setFlag(flags float64, flag int, on bool) float64 {
+	if on {
+		return float64(int(flags) | flag)
+	}
+	return float64(int(flags) &^ flag)
+}
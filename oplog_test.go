@@ -0,0 +1,51 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestSetStarred(t *testing.T) {
+
+	var mu sync.Mutex
+	var bodies []map[string]interface{}
+	ret := 0
+	wechat, done := newServerTestBot(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		bodies = append(bodies, body)
+		w.Write([]byte(`{"BaseResponse":{"Ret":` + string(rune('0'+ret)) + `}}`))
+		mu.Unlock()
+	}))
+	defer done()
+
+	wechat.cache.updateContact(map[string]interface{}{`UserName`: `@a`, `NickName`: `甲`, `Type`: Friend})
+
+	if err := wechat.SetStarred(context.Background(), &Contact{UserName: `@a`}, true); err != nil {
+		t.Fatal(err)
+	}
+	if c := wechat.cache.snapshot(`@a`); c.StarFriend != 1 || !hasFlag(c.ContactFlag, contactFlagStar) {
+		t.Errorf(`starred contact in cache: %v %v`, c.StarFriend, c.ContactFlag)
+	}
+	if paths := drainGroupEvents(wechat.evtStream); len(paths) != 1 || paths[0] != `/contact/mod/`+ContactStarred {
+		t.Errorf(`star emits %v`, paths)
+	}
+	if b := bodies[0]; b[`CmdId`] != float64(opLogCmdStar) || b[`OP`] != 1.0 || b[`UserName`] != `@a` {
+		t.Errorf(`oplog body %v`, b)
+	}
+
+	// refused by server, cache is not changed
+	mu.Lock()
+	ret = 1
+	mu.Unlock()
+	if err := wechat.SetStarred(context.Background(), &Contact{UserName: `@a`}, false); err == nil {
+		t.Fatal(`refused star returns no error`)
+	}
+	if c := wechat.cache.snapshot(`@a`); c.StarFriend != 1 {
+		t.Error(`refused unstar changed cache`)
+	}
+}
@@ -0,0 +1,355 @@
+package wechat
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mozillazg/go-pinyin"
+)
+
+// contactIndex map lowercased names, their pinyin and pinyin initials to UserNames,
+// and runes to the keys containing them for NameLike.
+type contactIndex struct {
+	names map[string]map[string]bool
+	runes map[rune]map[string]bool
+}
+
+func newContactIndex() contactIndex {
+	return contactIndex{
+		names: make(map[string]map[string]bool),
+		runes: make(map[rune]map[string]bool),
+	}
+}
+
+// names of contact used for lookup
+func contactNames(c *Contact) []string {
+	return []string{c.RemarkName, c.NickName, c.DisplayName, c.Alias}
+}
+
+// indexKeys returns all keys a contact can be found by, e.g. `陈Chris` is
+// indexed as `陈chris`, `chenchris` and `cchris`.
+func indexKeys(c *Contact) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	add := func(k string) {
+		if len(k) > 0 && !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	for _, name := range contactNames(c) {
+		if len(name) == 0 {
+			continue
+		}
+		add(strings.ToLower(name))
+		add(toPinyin(name, pinyin.Normal))
+		add(toPinyin(name, pinyin.FirstLetter))
+	}
+	return keys
+}
+
+// toPinyin convert han characters in s to pinyin of style, others are kept.
+func toPinyin(s string, style int) string {
+	args := pinyin.NewArgs()
+	args.Style = style
+	args.Fallback = func(r rune, a pinyin.Args) []string {
+		return []string{string(r)}
+	}
+	return strings.ToLower(strings.Join(pinyin.LazyPinyin(s, args), ``))
+}
+
+// add must be called with lock held.
+func (idx contactIndex) add(c *Contact) {
+	for _, k := range indexKeys(c) {
+		uns, found := idx.names[k]
+		if !found {
+			uns = make(map[string]bool)
+			idx.names[k] = uns
+			for _, r := range k {
+				keys, found := idx.runes[r]
+				if !found {
+					keys = make(map[string]bool)
+					idx.runes[r] = keys
+				}
+				keys[k] = true
+			}
+		}
+		uns[c.UserName] = true
+	}
+}
+
+// remove must be called with lock held.
+func (idx contactIndex) remove(c *Contact) {
+	for _, k := range indexKeys(c) {
+		uns, found := idx.names[k]
+		if !found {
+			continue
+		}
+		delete(uns, c.UserName)
+		if len(uns) > 0 {
+			continue
+		}
+		delete(idx.names, k)
+		for _, r := range k {
+			delete(idx.runes[r], k)
+			if len(idx.runes[r]) == 0 {
+				delete(idx.runes, r)
+			}
+		}
+	}
+}
+
+// like returns keys containing every rune of s, the only ones matchKey may
+// accept, must be called with lock held.
+func (idx contactIndex) like(s string) []string {
+
+	var smallest map[string]bool
+	for _, r := range s {
+		keys := idx.runes[r]
+		if len(keys) == 0 {
+			return nil
+		}
+		if smallest == nil || len(keys) < len(smallest) {
+			smallest = keys
+		}
+	}
+
+	var result []string
+	for k := range smallest {
+		all := true
+		for _, r := range s {
+			if !idx.runes[r][k] {
+				all = false
+				break
+			}
+		}
+		if all {
+			result = append(result, k)
+		}
+	}
+	return result
+}
+
+// match score of a key, higher is better
+const (
+	matchNone = iota
+	matchFuzzy
+	matchContains
+	matchPrefix
+	matchExact
+)
+
+func matchKey(key, s string) int {
+	switch {
+	case key == s:
+		return matchExact
+	case strings.HasPrefix(key, s):
+		return matchPrefix
+	case strings.Contains(key, s):
+		return matchContains
+	case isSubsequence(key, s):
+		return matchFuzzy
+	}
+	return matchNone
+}
+
+// isSubsequence reports whether runes of s appear in key in order, `crs` matches `chris`
+func isSubsequence(key, s string) bool {
+	rs := []rune(s)
+	i := 0
+	for _, r := range key {
+		if i < len(rs) && r == rs[i] {
+			i++
+		}
+	}
+	return i == len(rs)
+}
+
+// ContactQuery is a composable contact query, conditions are ANDed.
+// e.g. bot.Query().Type(wechat.Friend).City(`朝阳区`).NameLike(`chr`).All()
+type ContactQuery struct {
+	wechat  *WeChat
+	name    string
+	like    string
+	filters []func(*Contact) bool
+	limit   int
+}
+
+// Query start a contact query.
+func (wechat *WeChat) Query() *ContactQuery {
+	return &ContactQuery{wechat: wechat}
+}
+
+// Name match RemarkName, NickName, DisplayName, Alias or their pinyin
+// exactly, case is ignored.
+func (q *ContactQuery) Name(name string) *ContactQuery {
+	q.name = strings.ToLower(name)
+	return q
+}
+
+// NameLike match names fuzzily, results are ordered by how well they match:
+// exact, prefix, contains, then runes in order (`crs` matches `Chris`).
+func (q *ContactQuery) NameLike(name string) *ContactQuery {
+	q.like = strings.ToLower(name)
+	return q
+}
+
+// Type filter by contact type, Friend, Group, Member, ... A FriendAndMember
+// is both a Friend and a Member.
+func (q *ContactQuery) Type(contactType int) *ContactQuery {
+	return q.Where(func(c *Contact) bool {
+		if c.Type == FriendAndMember && (contactType == Friend || contactType == Member) {
+			return true
+		}
+		return c.Type == contactType
+	})
+}
+
+// Sex filter by Male, Female or Unknow.
+func (q *ContactQuery) Sex(sex int) *ContactQuery {
+	return q.Where(func(c *Contact) bool { return sexMatches(c.Sex, sex) })
+}
+
+// City filter by city.
+func (q *ContactQuery) City(city string) *ContactQuery {
+	return q.Where(func(c *Contact) bool { return c.City == city })
+}
+
+// Province filter by province.
+func (q *ContactQuery) Province(province string) *ContactQuery {
+	return q.Where(func(c *Contact) bool { return c.Province == province })
+}
+
+// Where filter by any condition, f gets a copy of contact and is called
+// without cache locked, so it may call methods of bot.
+func (q *ContactQuery) Where(f func(*Contact) bool) *ContactQuery {
+	q.filters = append(q.filters, f)
+	return q
+}
+
+// Limit the count of results, 0 means no limit.
+func (q *ContactQuery) Limit(n int) *ContactQuery {
+	q.limit = n
+	return q
+}
+
+// wx server use 1 for male and 2 for female
+func sexMatches(sex float64, want int) bool {
+	switch want {
+	case Male:
+		return sex == 1
+	case Female:
+		return sex == 2
+	case Unknow:
+		return sex != 1 && sex != 2
+	}
+	return true
+}
+
+// All returns copies of matched contacts, taken at the same moment,
+// later changes of cache won't affect them.
+func (q *ContactQuery) All() []*Contact {
+
+	c := q.wechat.cache
+	c.Lock()
+	scores := q.candidates(c)
+	snapshot := make([]*Contact, 0, len(scores))
+	for un := range scores {
+		if contact, found := c.contacts[un]; found {
+			snapshot = append(snapshot, contact.clone())
+		}
+	}
+	c.Unlock()
+
+	var results []*Contact
+	for _, contact := range snapshot {
+		if q.accept(contact) {
+			results = append(results, contact)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		si, sj := scores[results[i].UserName], scores[results[j].UserName]
+		if si != sj {
+			return si > sj
+		}
+		return results[i].UserName < results[j].UserName
+	})
+
+	if q.limit > 0 && len(results) > q.limit {
+		results = results[:q.limit]
+	}
+
+	return results
+}
+
+// First returns the best matched contact or nil.
+func (q *ContactQuery) First() *Contact {
+	cs := q.Limit(1).All()
+	if len(cs) == 0 {
+		return nil
+	}
+	return cs[0]
+}
+
+// Count returns count of matched contacts.
+func (q *ContactQuery) Count() int {
+	return len(q.All())
+}
+
+// candidates returns UserNames matched by names and their score,
+// must be called with lock held.
+func (q *ContactQuery) candidates(c *cache) map[string]int {
+
+	scores := make(map[string]int)
+
+	if len(q.name) > 0 {
+		for un := range c.index.names[q.name] {
+			scores[un] = matchExact
+		}
+		if len(q.like) == 0 {
+			return scores
+		}
+	}
+
+	if len(q.like) > 0 {
+		likes := make(map[string]int)
+		for _, key := range c.index.like(q.like) {
+			score := matchKey(key, q.like)
+			if score == matchNone {
+				continue
+			}
+			for un := range c.index.names[key] {
+				if score > likes[un] {
+					likes[un] = score
+				}
+			}
+		}
+		if len(q.name) == 0 {
+			return likes
+		}
+		// both Name and NameLike are given
+		for un := range scores {
+			if s, found := likes[un]; found {
+				scores[un] = s
+			} else {
+				delete(scores, un)
+			}
+		}
+		return scores
+	}
+
+	for un := range c.contacts {
+		scores[un] = matchNone
+	}
+	return scores
+}
+
+func (q *ContactQuery) accept(c *Contact) bool {
+	for _, f := range q.filters {
+		if !f(c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,123 @@
+package wechat
+
+import (
+	"testing"
+	"time"
+)
+
+func newQueryTestBot() *WeChat {
+	wechat := &WeChat{cache: newCache()}
+	for _, v := range []map[string]interface{}{
+		{`UserName`: `@a`, `NickName`: `Chris`, `Sex`: 1.0, `Type`: Friend},
+		{`UserName`: `@b`, `NickName`: `陈曦`, `Sex`: 2.0, `Type`: Friend},
+		{`UserName`: `@c`, `NickName`: `christina`, `RemarkName`: `Tina`, `Type`: Friend},
+		{`UserName`: `@d`, `NickName`: `Bob`, `Type`: Friend},
+	} {
+		wechat.cache.updateContact(v)
+	}
+	return wechat
+}
+
+func userNames(cs []*Contact) []string {
+	var uns []string
+	for _, c := range cs {
+		uns = append(uns, c.UserName)
+	}
+	return uns
+}
+
+func TestNameLike(t *testing.T) {
+	wechat := newQueryTestBot()
+
+	cases := []struct {
+		like string
+		want []string
+	}{
+		{`chris`, []string{`@a`, `@c`}}, // exact before prefix
+		{`tina`, []string{`@c`}},
+		{`cx`, []string{`@b`}},     // pinyin initials
+		{`chenxi`, []string{`@b`}}, // pinyin
+		{`crs`, []string{`@a`, `@c`}},
+		{`陈`, []string{`@b`}},
+		{`zz`, nil},
+	}
+	for _, c := range cases {
+		got := userNames(wechat.Query().NameLike(c.like).All())
+		if len(got) != len(c.want) {
+			t.Errorf(`NameLike(%q) = %v, want %v`, c.like, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf(`NameLike(%q) = %v, want %v`, c.like, got, c.want)
+				break
+			}
+		}
+	}
+
+	// removed contacts are not found
+	wechat.cache.clearContactBy(`@d`)
+	if cs := wechat.Query().NameLike(`bob`).All(); len(cs) > 0 {
+		t.Errorf(`removed contact found: %v`, userNames(cs))
+	}
+	if _, found := wechat.cache.index.runes['b']; found {
+		t.Error(`runes of removed keys are kept`)
+	}
+}
+
+func TestSearchContact(t *testing.T) {
+	wechat := newQueryTestBot()
+
+	if cs, err := wechat.SearchContact(`Chris`, ``, Any, Any); err != nil || len(cs) != 1 || cs[0].UserName != `@a` {
+		t.Errorf(`SearchContact(Chris) = %v, %v`, cs, err)
+	}
+	// NickName is compared exactly as before, not by pinyin or case
+	if _, err := wechat.SearchContact(`chris`, ``, Any, Any); err == nil {
+		t.Error(`SearchContact ignores case`)
+	}
+	if _, err := wechat.SearchContact(`Tina`, ``, Any, Any); err == nil {
+		t.Error(`SearchContact matches RemarkName`)
+	}
+	if cs, _ := wechat.SearchContact(`陈曦`, ``, Female, Friend); len(cs) != 1 {
+		t.Errorf(`SearchContact(陈曦, Female) = %v`, userNames(cs))
+	}
+	if cs, _ := wechat.SearchContact(`陈曦`, ``, Male, Any); len(cs) != 0 {
+		t.Errorf(`SearchContact(陈曦, Male) = %v`, userNames(cs))
+	}
+}
+
+func TestQueryType(t *testing.T) {
+	wechat := newQueryTestBot()
+	wechat.cache.updateContact(map[string]interface{}{`UserName`: `@e`, `NickName`: `Eve`, `Type`: FriendAndMember})
+	wechat.cache.updateContact(map[string]interface{}{`UserName`: `@f`, `NickName`: `Frank`, `Type`: Member})
+
+	if n := wechat.Query().Type(Friend).Count(); n != 5 {
+		t.Errorf(`%d friend(s)`, n)
+	}
+	if uns := userNames(wechat.Query().Type(Member).All()); len(uns) != 2 || uns[0] != `@e` || uns[1] != `@f` {
+		t.Errorf(`members = %v`, uns)
+	}
+	if uns := userNames(wechat.Query().Type(FriendAndMember).All()); len(uns) != 1 || uns[0] != `@e` {
+		t.Errorf(`friends and members = %v`, uns)
+	}
+}
+
+func TestQueryWhereCallsBot(t *testing.T) {
+	wechat := newQueryTestBot()
+
+	done := make(chan []*Contact)
+	go func() {
+		// 条件里再查一次缓存不会死锁
+		done <- wechat.Query().Where(func(c *Contact) bool {
+			return wechat.Query().Name(c.NickName).Count() == 1
+		}).All()
+	}()
+	select {
+	case cs := <-done:
+		if len(cs) != 4 {
+			t.Errorf(`%d contact(s)`, len(cs))
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`Where is called with cache locked`)
+	}
+}
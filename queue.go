@@ -0,0 +1,521 @@
+package wechat
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrNotLogin is returned when a message is sent without a live session.
+var ErrNotLogin = errors.New(`not logged in`)
+
+// Priority of an outbound message, higher priority is sent first.
+type Priority int
+
+const (
+	// PriorityLow e.g. broadcast
+	PriorityLow Priority = iota - 1
+	// PriorityNormal default priority of SendMsg
+	PriorityNormal
+	// PriorityHigh e.g. reply
+	PriorityHigh
+)
+
+// SentMessage is the receipt of a message accepted by wx server.
+type SentMessage struct {
+	MsgID   string
+	LocalID string
+	To      string
+	Msg     Msg
+	Time    int64
+}
+
+// EventSendData is the data of `/send/ok` and `/send/failed` event.
+type EventSendData struct {
+	To       string
+	Msg      Msg
+	Sent     *SentMessage // nil if failed
+	Err      error        // nil if ok
+	Attempts int
+}
+
+// retryableRets are BaseResponse.Ret worth retrying, 1205 is sending too frequently.
+var retryableRets = map[int]bool{
+	-1:   true,
+	1205: true,
+}
+
+var (
+	sendRetryBackoff    = 2 * time.Second
+	maxSendRetryBackoff = time.Minute
+)
+
+// isRetryable tell whether a failed send should be retried, only network
+// errors and retryable Rets are, a broken response won't be fixed by resending.
+func isRetryable(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	switch e := err.(type) {
+	case *ResponseError:
+		return retryableRets[e.Ret]
+	case net.Error:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// tokenBucket allow rate tokens per second with burst.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// wait returns how long to wait for next token, 0 means a token is available.
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full tell whether bucket is refilled to burst at now.
+func (b *tokenBucket) full(now time.Time) bool {
+	if b.rate <= 0 || b.last.IsZero() {
+		return true
+	}
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+func (b *tokenBucket) take() {
+	if b.rate > 0 {
+		b.tokens--
+	}
+}
+
+type sendJob struct {
+	ctx       context.Context
+	msg       Msg
+	priority  Priority
+	id        string // ClientMsgId, the same for every attempt
+	seq       uint64
+	attempts  int
+	notBefore time.Time
+	done      chan sendResult // nil if nobody wait for the result
+}
+
+type sendResult struct {
+	sent *SentMessage
+	err  error
+}
+
+// sendJobs is a heap ordered by priority then enqueue order.
+type sendJobs []*sendJob
+
+func (js sendJobs) Len() int { return len(js) }
+func (js sendJobs) Less(i, j int) bool {
+	if js[i].priority != js[j].priority {
+		return js[i].priority > js[j].priority
+	}
+	return js[i].seq < js[j].seq
+}
+func (js sendJobs) Swap(i, j int)       { js[i], js[j] = js[j], js[i] }
+func (js *sendJobs) Push(x interface{}) { *js = append(*js, x.(*sendJob)) }
+func (js *sendJobs) Pop() interface{} {
+	old := *js
+	n := len(old)
+	j := old[n-1]
+	*js = old[:n-1]
+	return j
+}
+
+// backlogSaveInterval is how often the backlog is written if it changed.
+var backlogSaveInterval = time.Second
+
+// bucketPruneInterval is how often idle per recipient buckets are dropped.
+var bucketPruneInterval = time.Minute
+
+// sendQueue throttle all outbound messages by a global and a per recipient token bucket.
+type sendQueue struct {
+	sync.Mutex
+	jobs    sendJobs
+	sending *sendJob // popped but not finished, still in backlog
+	dirty   bool     // backlog changed since last save
+	seq     uint64
+	wake    chan struct{}
+	global  *tokenBucket
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+	conf    *Configure
+}
+
+func newSendQueue(conf *Configure) *sendQueue {
+	return &sendQueue{
+		wake:    make(chan struct{}, 1),
+		global:  newTokenBucket(conf.SendRate, conf.SendBurst),
+		buckets: make(map[string]*tokenBucket),
+		conf:    conf,
+	}
+}
+
+func (q *sendQueue) push(job *sendJob) {
+	if len(job.id) == 0 {
+		job.id = clientMsgID()
+	}
+	q.Lock()
+	q.seq++
+	job.seq = q.seq
+	heap.Push(&q.jobs, job)
+	if q.sending == job {
+		q.sending = nil
+	}
+	q.dirty = true
+	q.Unlock()
+	q.signal()
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next pop the first job which can be sent now, or returns how long to wait.
+func (q *sendQueue) next(now time.Time) (*sendJob, time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+
+	if now.Sub(q.pruned) >= bucketPruneInterval {
+		q.pruneBuckets(now)
+	}
+
+	if len(q.jobs) == 0 {
+		return nil, time.Hour
+	}
+
+	if d := q.global.wait(now); d > 0 {
+		return nil, d
+	}
+
+	var delayed []*sendJob
+	var job *sendJob
+	wait := time.Hour
+
+	for len(q.jobs) > 0 {
+		j := heap.Pop(&q.jobs).(*sendJob)
+		d := j.notBefore.Sub(now)
+		if d <= 0 {
+			d = q.bucket(j.msg.To()).wait(now)
+		}
+		if d <= 0 {
+			job = j
+			break
+		}
+		if d < wait {
+			wait = d
+		}
+		delayed = append(delayed, j)
+	}
+
+	for _, j := range delayed {
+		heap.Push(&q.jobs, j)
+	}
+
+	if job == nil {
+		return nil, wait
+	}
+
+	q.global.take()
+	q.bucket(job.msg.To()).take()
+	q.sending = job
+
+	return job, 0
+}
+
+// finish drop job from backlog, it's sent or failed for good.
+func (q *sendQueue) finish(job *sendJob) {
+	q.Lock()
+	if q.sending == job {
+		q.sending = nil
+	}
+	q.dirty = true
+	q.Unlock()
+}
+
+// popWaiting remove jobs whose sender is waiting for the result.
+func (q *sendQueue) popWaiting() []*sendJob {
+	q.Lock()
+	defer q.Unlock()
+
+	var waiting, rest sendJobs
+	for _, j := range q.jobs {
+		if j.done != nil {
+			waiting = append(waiting, j)
+		} else {
+			rest = append(rest, j)
+		}
+	}
+	if len(waiting) > 0 {
+		q.jobs = rest
+		heap.Init(&q.jobs)
+		q.dirty = true
+	}
+	return waiting
+}
+
+// pruneBuckets drop buckets refilled to burst, they are the same as new ones.
+// must be called with lock held.
+func (q *sendQueue) pruneBuckets(now time.Time) {
+	for to, b := range q.buckets {
+		if b.full(now) {
+			delete(q.buckets, to)
+		}
+	}
+	q.pruned = now
+}
+
+func (q *sendQueue) bucket(to string) *tokenBucket {
+	b, found := q.buckets[to]
+	if !found {
+		b = newTokenBucket(q.conf.SendRatePerUser, q.conf.SendBurstPerUser)
+		q.buckets[to] = b
+	}
+	return b
+}
+
+// backlogMsg is the persisted form of any Msg.
+type backlogMsg struct {
+	MsgPath    string
+	MsgTo      string
+	MsgContent map[string]interface{}
+	Desc       string
+	Priority   Priority
+	ID         string `json:",omitempty"` // ClientMsgId of the attempts before exit
+}
+
+func (m *backlogMsg) Path() string                    { return m.MsgPath }
+func (m *backlogMsg) To() string                      { return m.MsgTo }
+func (m *backlogMsg) Content() map[string]interface{} { return m.MsgContent }
+func (m *backlogMsg) Description() string             { return m.Desc }
+
+// saveBacklog write queued messages and the one being sent if changed.
+func (q *sendQueue) saveBacklog() {
+	if !q.conf.SendBacklog {
+		return
+	}
+
+	q.Lock()
+	if !q.dirty {
+		q.Unlock()
+		return
+	}
+	q.dirty = false
+	jobs := append(sendJobs(nil), q.jobs...)
+	if q.sending != nil {
+		jobs = append(jobs, q.sending)
+	}
+	q.Unlock()
+
+	list := make([]*backlogMsg, 0, len(jobs))
+	for _, j := range jobs {
+		list = append(list, &backlogMsg{j.msg.Path(), j.msg.To(), j.msg.Content(), j.msg.Description(), j.priority, j.id})
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		logger.Warnf(`save send backlog failed: %v`, err)
+		return
+	}
+	createFile(q.conf.sendBacklogPath(), data, false)
+}
+
+// loadBacklog restore messages not sent before last exit.
+func (q *sendQueue) loadBacklog() {
+	if !q.conf.SendBacklog {
+		return
+	}
+	data, err := ioutil.ReadFile(q.conf.sendBacklogPath())
+	if err != nil {
+		return
+	}
+	var list []*backlogMsg
+	if err = json.Unmarshal(data, &list); err != nil {
+		logger.Warnf(`send backlog is broken: %v`, err)
+		return
+	}
+	logger.Infof(`restore %d message(s) from send backlog`, len(list))
+	for _, m := range list {
+		q.push(&sendJob{ctx: context.Background(), msg: m, priority: m.Priority, id: m.ID})
+	}
+}
+
+// runBacklogSaver save backlog periodically instead of on every change.
+func (q *sendQueue) runBacklogSaver() {
+	for range time.Tick(backlogSaveInterval) {
+		q.saveBacklog()
+	}
+}
+
+// runSendQueue send queued messages one by one until the process exit.
+// while logged out, waiting senders get ErrNotLogin, async messages are
+// kept until next login.
+func (wechat *WeChat) runSendQueue() {
+
+	q := wechat.sendQueue
+	q.loadBacklog()
+	if q.conf.SendBacklog {
+		go q.runBacklogSaver()
+	}
+
+	for {
+		if !wechat.LoggedIn() {
+			for _, job := range q.popWaiting() {
+				wechat.finishSendJob(job, nil, ErrNotLogin)
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+
+		job, wait := q.next(time.Now())
+		if job == nil {
+			select {
+			case <-q.wake:
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		if err := job.ctx.Err(); err != nil {
+			wechat.finishSendJob(job, nil, err)
+			continue
+		}
+
+		// 上次运行留下的消息, 收件人的 UserName 可能已经变了
+		if bm, ok := job.msg.(*backlogMsg); ok {
+			if un, found := wechat.ResolveUserName(bm.MsgTo); found {
+				bm.MsgTo = un
+			}
+		}
+
+		job.attempts++
+		sent, err := wechat.sendMsg(job.ctx, job.msg, job.id)
+
+		if err != nil && isRetryable(err) && job.attempts <= wechat.conf.SendRetryTimes {
+			backoff := sendRetryBackoff << uint(job.attempts-1)
+			if backoff > maxSendRetryBackoff {
+				backoff = maxSendRetryBackoff
+			}
+			logger.Warnf(`send [%s] failed: %v, will retry after %v`, job.msg.Description(), err, backoff)
+			job.notBefore = time.Now().Add(backoff)
+			q.push(job)
+			continue
+		}
+
+		wechat.finishSendJob(job, sent, err)
+	}
+}
+
+func (wechat *WeChat) finishSendJob(job *sendJob, sent *SentMessage, err error) {
+
+	wechat.sendQueue.finish(job)
+
+	if job.done != nil {
+		job.done <- sendResult{sent, err}
+	}
+
+	wechat.recordOutbound(sent)
+
+	path := `/send/ok`
+	if err != nil {
+		path = `/send/failed`
+		logger.Errorf(`send [%s] failed: %v`, job.msg.Description(), err)
+	}
+
+	event := Event{
+		Type: `SendResult`,
+		From: `Wechat`,
+		Path: path,
+		To:   job.msg.To(),
+		Time: time.Now().Unix(),
+		Data: EventSendData{
+			To:       job.msg.To(),
+			Msg:      job.msg,
+			Sent:     sent,
+			Err:      err,
+			Attempts: job.attempts,
+		},
+	}
+	go func() {
+		wechat.evtStream.serverEvt <- event
+	}()
+}
+
+// SendMsgContext put message into outbound queue and wait until it is sent or failed,
+// ErrNotLogin is returned at once if not logged in, or when logged out before sent.
+func (wechat *WeChat) SendMsgContext(ctx context.Context, message Msg) (*SentMessage, error) {
+	return wechat.SendMsgWithPriority(ctx, message, PriorityNormal)
+}
+
+// SendMsgWithPriority is SendMsgContext with a priority.
+func (wechat *WeChat) SendMsgWithPriority(ctx context.Context, message Msg, priority Priority) (*SentMessage, error) {
+
+	if message == nil {
+		return nil, errors.New(`message is nil`)
+	}
+	if !wechat.LoggedIn() {
+		return nil, ErrNotLogin
+	}
+
+	done := make(chan sendResult, 1)
+	wechat.sendQueue.push(&sendJob{
+		ctx:      ctx,
+		msg:      message,
+		priority: priority,
+		done:     done,
+	})
+
+	select {
+	case r := <-done:
+		return r.sent, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf(`message [%s] is still queued: %v`, message.Description(), ctx.Err())
+	}
+}
+
+// SendMsgAsync put message into outbound queue and return immediately,
+// the result is delivered by `/send/ok` or `/send/failed` event. It is sent
+// after login if not logged in.
+func (wechat *WeChat) SendMsgAsync(message Msg, priority Priority) {
+	wechat.sendQueue.push(&sendJob{
+		ctx:      context.Background(),
+		msg:      message,
+		priority: priority,
+	})
+}
@@ -0,0 +1,227 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KevinGong2013/wechat/messages"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return `i/o timeout` }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsRetryable(t *testing.T) {
+	timeout := &net.OpError{Op: `read`, Net: `tcp`, Err: timeoutError{}}
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&ResponseError{Ret: 1205}, true},
+		{&ResponseError{Ret: 1101}, false},
+		{&url.Error{Op: `Post`, URL: `https://wx.qq.com`, Err: timeout}, true},
+		{&url.Error{Op: `Post`, URL: `https://wx.qq.com`, Err: io.ErrUnexpectedEOF}, true},
+		{&url.Error{Op: `Post`, URL: `https://wx.qq.com`, Err: context.Canceled}, false},
+		{context.DeadlineExceeded, false},
+		{&json.SyntaxError{}, false},
+		{errors.New(`unknown`), false},
+	}
+	for _, c := range cases {
+		if got := isRetryable(c.err); got != c.want {
+			t.Errorf(`isRetryable(%v) = %v, want %v`, c.err, got, c.want)
+		}
+	}
+}
+
+func TestSendWithoutLogin(t *testing.T) {
+	wechat := &WeChat{sendQueue: newSendQueue(&Configure{})}
+	done := make(chan error, 1)
+	go func() {
+		_, err := wechat.SendMsgContext(context.Background(), messages.NewTextMsg(`hi`, `filehelper`))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrNotLogin {
+			t.Fatalf(`send without login: %v`, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`send without login hangs`)
+	}
+}
+
+func TestBacklogKeepsJobUntilFinished(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `backlog`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := newSendQueue(&Configure{CachePath: dir, SendBacklog: true})
+	backlog := func() int {
+		q.saveBacklog()
+		data, err := ioutil.ReadFile(q.conf.sendBacklogPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list []*backlogMsg
+		json.Unmarshal(data, &list)
+		return len(list)
+	}
+
+	q.push(&sendJob{ctx: context.Background(), msg: messages.NewTextMsg(`hi`, `filehelper`)})
+	if n := backlog(); n != 1 {
+		t.Fatalf(`backlog has %d message(s) after push`, n)
+	}
+
+	job, _ := q.next(time.Now())
+	if job == nil {
+		t.Fatal(`no job`)
+	}
+	if n := backlog(); n != 1 {
+		t.Fatalf(`backlog has %d message(s) while sending`, n)
+	}
+
+	q.finish(job)
+	if n := backlog(); n != 0 {
+		t.Fatalf(`backlog has %d message(s) after sent`, n)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	b := newTokenBucket(1, 2)
+
+	for i := 0; i < 2; i++ {
+		if d := b.wait(now); d != 0 {
+			t.Fatalf(`token %d of burst waits %v`, i, d)
+		}
+		b.take()
+	}
+	if d := b.wait(now); d != time.Second {
+		t.Fatalf(`empty bucket waits %v`, d)
+	}
+	if d := b.wait(now.Add(500 * time.Millisecond)); d != 500*time.Millisecond {
+		t.Fatalf(`half refilled bucket waits %v`, d)
+	}
+	if b.full(now.Add(time.Second)) || !b.full(now.Add(2*time.Second)) {
+		t.Fatal(`bucket is full at wrong time`)
+	}
+	if d := b.wait(now.Add(time.Hour)); d != 0 || b.tokens != 2 {
+		t.Fatalf(`idle bucket has %v token(s)`, b.tokens)
+	}
+
+	if d := newTokenBucket(0, 0).wait(now); d != 0 {
+		t.Fatalf(`unlimited bucket waits %v`, d)
+	}
+}
+
+func TestSendQueueOrder(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	q := newSendQueue(&Configure{SendRatePerUser: 1, SendBurstPerUser: 1})
+
+	push := func(text, to string, priority Priority) {
+		q.push(&sendJob{ctx: context.Background(), msg: messages.NewTextMsg(text, to), priority: priority})
+	}
+	push(`low`, `@a`, PriorityLow)
+	push(`normal1`, `@b`, PriorityNormal)
+	push(`high`, `@c`, PriorityHigh)
+	push(`normal2`, `@d`, PriorityNormal)
+	push(`normal3`, `@b`, PriorityNormal)
+
+	var order []string
+	for {
+		job, wait := q.next(now)
+		if job == nil {
+			if wait != time.Second {
+				t.Errorf(`throttled recipient waits %v`, wait)
+			}
+			break
+		}
+		q.finish(job)
+		order = append(order, job.msg.Content()[`Content`].(string))
+	}
+	// normal3 waits for the bucket of @b
+	if want := `high normal1 normal2 low`; strings.Join(order, ` `) != want {
+		t.Errorf(`order = %v, want %s`, order, want)
+	}
+
+	job, _ := q.next(now.Add(time.Second))
+	if job == nil || job.msg.Content()[`Content`] != `normal3` {
+		t.Fatalf(`throttled job is not sent after refilled: %v`, job)
+	}
+
+	// buckets of idle recipients are dropped
+	q.next(now.Add(bucketPruneInterval + time.Minute))
+	if len(q.buckets) != 0 {
+		t.Errorf(`%d idle bucket(s) kept`, len(q.buckets))
+	}
+}
+
+func TestRetryKeepsClientMsgID(t *testing.T) {
+
+	var ids []string
+	wechat, done := newServerTestBot(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Msg map[string]interface{} }
+		json.NewDecoder(r.Body).Decode(&body)
+		ids = append(ids, body.Msg[`ClientMsgId`].(string)+`/`+body.Msg[`LocalID`].(string))
+		if len(ids) == 1 {
+			// 服务器收到了, 但是回复丢了
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`{"BaseResponse":{"Ret":0},"MsgID":"1","LocalID":"1"}`))
+	}))
+	defer done()
+
+	defer func(d time.Duration) { sendRetryBackoff = d }(sendRetryBackoff)
+	sendRetryBackoff = time.Millisecond
+	wechat.conf.SendRetryTimes = 1
+	wechat.sendQueue = newSendQueue(wechat.conf)
+	wechat.setLogin(true)
+	go wechat.runSendQueue()
+
+	if _, err := wechat.SendMsgContext(context.Background(), messages.NewTextMsg(`hi`, `filehelper`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != ids[1] {
+		t.Fatalf(`ids of attempts: %v`, ids)
+	}
+	wechat.setLogin(false)
+}
+
+func TestLocationMsgGated(t *testing.T) {
+
+	requests := 0
+	wechat, done := newServerTestBot(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"BaseResponse":{"Ret":0},"MsgID":"1","LocalID":"1"}`))
+	}))
+	defer done()
+
+	msg := messages.NewLocationMsg(39.9, 116.4, `北京市东城区`, `天安门`, `filehelper`)
+	if _, err := wechat.sendMsg(context.Background(), msg, `1`); err != ErrLocationMsgDisabled || requests != 0 {
+		t.Fatalf(`location sent while disabled: %v, %d request(s)`, err, requests)
+	}
+	if isRetryable(ErrLocationMsgDisabled) {
+		t.Error(`disabled location is retried`)
+	}
+
+	wechat.conf.LocationMsg = true
+	if _, err := wechat.sendMsg(context.Background(), msg, `1`); err != nil || requests != 1 {
+		t.Fatalf(`location: %v, %d request(s)`, err, requests)
+	}
+}
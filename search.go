@@ -0,0 +1,458 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// ErrArchiveDisabled is returned by SearchMessages when Configure.Archive is off.
+var ErrArchiveDisabled = errors.New(`archive is disabled`)
+
+// SearchQuery is a full text search of archived messages, zero fields are not filtered.
+// Text is matched against content of text and system messages, titles of links
+// and file names, every word of Text must be found.
+type SearchQuery struct {
+	Text         string
+	Conversation ContactID
+	Sender       ContactID
+	Since        time.Time // inclusive
+	Until        time.Time // exclusive
+	MsgTypes     []int64   // e.g. 1 text, 49 link and file
+	Limit        int       // 0 means all
+}
+
+// SearchResult is a matched message, results are ordered by Score then Time desc.
+type SearchResult struct {
+	Message *ArchivedMessage
+	Score   int
+}
+
+// searchDoc is what is kept in index for one message, text is not kept,
+// the whole message is read from store for results.
+type searchDoc struct {
+	msgID        string
+	conversation ContactID
+	sender       ContactID
+	time         time.Time
+	msgType      int64
+}
+
+// posting is where a token is in one message, rune offsets in content and title.
+type posting struct {
+	content []int32
+	title   []int32
+}
+
+func (p *posting) positions(title bool) []int32 {
+	if title {
+		return p.title
+	}
+	return p.content
+}
+
+// searchIndex is an inverted index of archived messages, chinese, japanese and
+// korean text is indexed by single characters and bigrams, others by words.
+// Words are also kept sorted for prefix lookup.
+type searchIndex struct {
+	sync.RWMutex
+	docs     map[string]*searchDoc
+	postings map[string]map[string]*posting // token => MsgID => positions
+	words    []string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		docs:     make(map[string]*searchDoc),
+		postings: make(map[string]map[string]*posting),
+	}
+}
+
+// searchable returns whether Content of message is text, content of media
+// and app messages is xml.
+func searchable(msgType int64) bool {
+	return msgType == 1 || msgType == 10000
+}
+
+// searchFields returns normalized content and title of m, title includes file name.
+func searchFields(m *ArchivedMessage) (string, string) {
+	content := ``
+	if searchable(m.MsgType) {
+		content = foldText(m.Content)
+	}
+	title := m.Title
+	if len(m.FileName) > 0 && m.FileName != m.Title {
+		title += "\n" + m.FileName
+	}
+	return content, foldText(title)
+}
+
+// add index m, the old one of same MsgID must be removed first.
+func (si *searchIndex) add(m *ArchivedMessage) {
+
+	content, title := searchFields(m)
+
+	si.Lock()
+	defer si.Unlock()
+
+	si.docs[m.MsgID] = &searchDoc{
+		msgID:        m.MsgID,
+		conversation: m.Conversation,
+		sender:       m.Sender,
+		time:         m.Time,
+		msgType:      m.MsgType,
+	}
+	for _, t := range tokenize(content) {
+		p := si.post(t.text, m.MsgID)
+		p.content = append(p.content, t.pos)
+	}
+	for _, t := range tokenize(title) {
+		p := si.post(t.text, m.MsgID)
+		p.title = append(p.title, t.pos)
+	}
+}
+
+// post returns posting of token in message, must be called with lock held.
+func (si *searchIndex) post(text, msgID string) *posting {
+	ids, found := si.postings[text]
+	if !found {
+		ids = make(map[string]*posting)
+		si.postings[text] = ids
+		if !isCJK([]rune(text)[0]) {
+			si.words = insertWord(si.words, text)
+		}
+	}
+	p, found := ids[msgID]
+	if !found {
+		p = new(posting)
+		ids[msgID] = p
+	}
+	return p
+}
+
+// remove drop m from index, m must be the indexed one.
+func (si *searchIndex) remove(m *ArchivedMessage) {
+
+	content, title := searchFields(m)
+
+	si.Lock()
+	defer si.Unlock()
+
+	delete(si.docs, m.MsgID)
+	for _, t := range append(tokenize(content), tokenize(title)...) {
+		ids, found := si.postings[t.text]
+		if !found {
+			continue
+		}
+		delete(ids, m.MsgID)
+		if len(ids) == 0 {
+			delete(si.postings, t.text)
+			if !isCJK([]rune(t.text)[0]) {
+				si.words = removeWord(si.words, t.text)
+			}
+		}
+	}
+}
+
+func insertWord(words []string, w string) []string {
+	i := sort.SearchStrings(words, w)
+	if i < len(words) && words[i] == w {
+		return words
+	}
+	words = append(words, ``)
+	copy(words[i+1:], words[i:])
+	words[i] = w
+	return words
+}
+
+func removeWord(words []string, w string) []string {
+	i := sort.SearchStrings(words, w)
+	if i < len(words) && words[i] == w {
+		return append(words[:i], words[i+1:]...)
+	}
+	return words
+}
+
+// search returns docs matched by q and their scores.
+func (si *searchIndex) search(ctx context.Context, q SearchQuery) ([]*searchDoc, []int, error) {
+
+	terms := searchTerms(foldText(q.Text))
+
+	types := make(map[int64]bool)
+	for _, t := range q.MsgTypes {
+		types[t] = true
+	}
+
+	si.RLock()
+	defer si.RUnlock()
+
+	// MsgID => score
+	var candidates map[string]int
+	for _, term := range terms {
+		counts := si.match(term)
+		if candidates == nil {
+			candidates = counts
+		} else {
+			for id, score := range candidates {
+				if c, found := counts[id]; found {
+					candidates[id] = score + c
+				} else {
+					delete(candidates, id)
+				}
+			}
+		}
+		if len(candidates) == 0 {
+			return nil, nil, nil
+		}
+	}
+	if candidates == nil {
+		candidates = make(map[string]int, len(si.docs))
+		for id := range si.docs {
+			candidates[id] = 0
+		}
+	}
+
+	var docs []*searchDoc
+	var scores []int
+	n := 0
+	for id, score := range candidates {
+		if n++; n%1000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		doc := si.docs[id]
+		if len(q.Conversation) > 0 && doc.conversation != q.Conversation ||
+			len(q.Sender) > 0 && doc.sender != q.Sender ||
+			!q.Since.IsZero() && doc.time.Before(q.Since) ||
+			!q.Until.IsZero() && !doc.time.Before(q.Until) ||
+			len(types) > 0 && !types[doc.msgType] {
+			continue
+		}
+
+		docs = append(docs, doc)
+		scores = append(scores, score)
+	}
+
+	return docs, scores, nil
+}
+
+// match returns MsgIDs containing term and times it is found, in title counts
+// double. Must be called with lock held. A word of other languages match words
+// start with it, e.g. invoice matches invoices, cjk text must be found as a
+// whole, bigrams of it from different places don't match.
+func (si *searchIndex) match(term string) map[string]int {
+
+	counts := make(map[string]int)
+	rs := []rune(term)
+
+	if !isCJK(rs[0]) {
+		for i := sort.SearchStrings(si.words, term); i < len(si.words) && strings.HasPrefix(si.words[i], term); i++ {
+			for id, p := range si.postings[si.words[i]] {
+				counts[id] += len(p.content) + 2*len(p.title)
+			}
+		}
+		return counts
+	}
+
+	if len(rs) == 1 {
+		for id, p := range si.postings[term] {
+			counts[id] = len(p.content) + 2*len(p.title)
+		}
+		return counts
+	}
+
+	bigrams := make([]map[string]*posting, len(rs)-1)
+	for i := range bigrams {
+		if bigrams[i] = si.postings[string(rs[i:i+2])]; len(bigrams[i]) == 0 {
+			return counts
+		}
+	}
+	for id := range bigrams[0] {
+		if c := phraseCount(bigrams, id, false) + 2*phraseCount(bigrams, id, true); c > 0 {
+			counts[id] = c
+		}
+	}
+	return counts
+}
+
+// phraseCount returns times bigrams are found one after another in content or title.
+func phraseCount(bigrams []map[string]*posting, id string, title bool) int {
+	n := 0
+next:
+	for _, pos := range bigrams[0][id].positions(title) {
+		for i := 1; i < len(bigrams); i++ {
+			p, found := bigrams[i][id]
+			if !found || !hasPosition(p.positions(title), pos+int32(i)) {
+				continue next
+			}
+		}
+		n++
+	}
+	return n
+}
+
+// positions of a token are sorted as they are added in order.
+func hasPosition(positions []int32, pos int32) bool {
+	i := sort.Search(len(positions), func(i int) bool { return positions[i] >= pos })
+	return i < len(positions) && positions[i] == pos
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// foldText lower case text, turn full width letters and digits to ascii and
+// remove emoji variation selectors.
+func foldText(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\ufe0f' || r == '\ufe0e':
+			return -1
+		case r >= '\uff01' && r <= '\uff5e':
+			r -= '\uff01' - '!'
+		case r == '\u3000':
+			r = ' '
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+// termRun is a run of cjk characters or a word, at rune offset pos.
+type termRun struct {
+	runes []rune
+	pos   int32
+}
+
+// splitRuns split s to runs of cjk characters and words.
+func splitRuns(s string) []termRun {
+
+	var runs []termRun
+	var run []rune
+	start, cjk := 0, false
+
+	flush := func() {
+		if len(run) > 0 {
+			runs = append(runs, termRun{runes: run, pos: int32(start)})
+			run = nil
+		}
+	}
+
+	i := 0
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) {
+			flush()
+		} else {
+			if len(run) > 0 && isCJK(r) != cjk {
+				flush()
+			}
+			if len(run) == 0 {
+				start = i
+			}
+			cjk = isCJK(r)
+			run = append(run, r)
+		}
+		i++
+	}
+	flush()
+
+	return runs
+}
+
+// searchTerms split query to runs of cjk characters and words.
+func searchTerms(s string) []string {
+	var terms []string
+	for _, run := range splitRuns(s) {
+		terms = append(terms, string(run.runes))
+	}
+	return uniqueTokens(terms)
+}
+
+// token is a word, or a character or bigram of cjk text, at rune offset pos.
+type token struct {
+	text string
+	pos  int32
+}
+
+// tokenize returns words, and characters and bigrams of cjk runs.
+func tokenize(s string) []token {
+
+	var tokens []token
+	for _, run := range splitRuns(s) {
+		if !isCJK(run.runes[0]) {
+			tokens = append(tokens, token{text: string(run.runes), pos: run.pos})
+			continue
+		}
+		for i := range run.runes {
+			pos := run.pos + int32(i)
+			tokens = append(tokens, token{text: string(run.runes[i]), pos: pos})
+			if i+1 < len(run.runes) {
+				tokens = append(tokens, token{text: string(run.runes[i : i+2]), pos: pos})
+			}
+		}
+	}
+	return tokens
+}
+
+func uniqueTokens(tokens []string) []string {
+	seen := make(map[string]bool, len(tokens))
+	result := tokens[:0]
+	for _, t := range tokens {
+		if !seen[t] {
+			seen[t] = true
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// SearchMessages find archived messages by text and filters.
+func (wechat *WeChat) SearchMessages(ctx context.Context, query SearchQuery) ([]*SearchResult, error) {
+
+	a := wechat.archive
+	if a == nil {
+		return nil, ErrArchiveDisabled
+	}
+
+	docs, scores, err := a.index.search(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*SearchResult, 0, len(docs))
+	for i, doc := range docs {
+		results = append(results, &SearchResult{Score: scores[i], Message: &ArchivedMessage{
+			MsgID: doc.msgID,
+			Time:  doc.time,
+		}})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if !a.Message.Time.Equal(b.Message.Time) {
+			return a.Message.Time.After(b.Message.Time)
+		}
+		return a.Message.MsgID < b.Message.MsgID
+	})
+	if query.Limit > 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+
+	// 只取需要返回的完整消息
+	for _, r := range results {
+		m, err := a.store.Get(r.Message.MsgID)
+		if err != nil {
+			return nil, err
+		}
+		r.Message = m
+	}
+
+	return results, nil
+}
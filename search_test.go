@@ -0,0 +1,94 @@
+package wechat
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSearchTestBot(t *testing.T) (*WeChat, func()) {
+
+	dir, err := ioutil.TempDir(``, `search`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenFileArchiveStore(filepath.Join(dir, `archive.log`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wechat := &WeChat{archive: &Archive{store: store, index: newSearchIndex()}}
+	return wechat, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func searchIDs(t *testing.T, wechat *WeChat, q SearchQuery) string {
+	results, err := wechat.SearchMessages(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := ``
+	for _, r := range results {
+		ids += r.Message.MsgID
+	}
+	return ids
+}
+
+func TestSearchMessages(t *testing.T) {
+
+	wechat, done := newSearchTestBot(t)
+	defer done()
+
+	base := time.Unix(1500000000, 0)
+	for _, m := range []*ArchivedMessage{
+		{MsgID: `1`, MsgType: 1, Time: base, Conversation: `uin:1`, Content: `上周二的发票开好了`},
+		{MsgID: `2`, MsgType: 1, Time: base.Add(time.Hour), Conversation: `uin:2`, Content: `发货了, 票据明天寄`},
+		{MsgID: `3`, MsgType: 49, Time: base.Add(2 * time.Hour), Conversation: `uin:1`, Title: `Invoices 2017.pdf`, RawContent: `<msg/>`},
+		{MsgID: `4`, MsgType: 1, Time: base.Add(3 * time.Hour), Conversation: `uin:2`, Content: `ＩＮＶＯＩＣＥ 发票 发票`},
+	} {
+		if err := wechat.archive.put(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		q   SearchQuery
+		ids string
+	}{
+		// 发 and 票 are both in 2, but not 发票
+		{SearchQuery{Text: `发票`}, `41`},
+		{SearchQuery{Text: `票`}, `421`},
+		{SearchQuery{Text: `invoice`}, `34`},
+		{SearchQuery{Text: `inv 发票`}, `4`},
+		{SearchQuery{Text: `发票`, Conversation: `uin:1`}, `1`},
+		{SearchQuery{Text: `invoice`, MsgTypes: []int64{49}}, `3`},
+		{SearchQuery{Text: `发票`, Since: base.Add(time.Hour)}, `4`},
+		{SearchQuery{Text: `发票`, Limit: 1}, `4`},
+		{SearchQuery{Text: `收据`}, ``},
+		{SearchQuery{Conversation: `uin:2`}, `42`},
+	}
+	for _, c := range cases {
+		if ids := searchIDs(t, wechat, c.q); ids != c.ids {
+			t.Errorf(`search %+v returns %s, want %s`, c.q, ids, c.ids)
+		}
+	}
+
+	// 修改后旧的内容就搜不到了
+	if err := wechat.archive.put(&ArchivedMessage{MsgID: `4`, MsgType: 1, Time: base.Add(3 * time.Hour), Content: `收据`}); err != nil {
+		t.Fatal(err)
+	}
+	if ids := searchIDs(t, wechat, SearchQuery{Text: `invoice`}); ids != `3` {
+		t.Fatalf(`replaced message is still found: %s`, ids)
+	}
+	if ids := searchIDs(t, wechat, SearchQuery{Text: `收据`}); ids != `4` {
+		t.Fatalf(`replaced message is not found: %s`, ids)
+	}
+	if words := wechat.archive.index.words; strings.Join(words, ` `) != `2017 invoices pdf` {
+		t.Fatalf(`words of replaced message are kept: %v`, words)
+	}
+}
@@ -88,8 +88,10 @@ func (wechat *WeChat) beginSync() error {
 				if resp.DelContactCount > 0 {
 					wechat.contactDidChange(resp.DelContactList, Delete)
 				}
-				if resp.ModChatRoomMemberCount > 0 {
-					wechat.groupMemberDidChange(resp.ModChatRoomMemberList)
+				// 群里 `邀请…加入了群聊` 这样的系统消息, 用来说明成员为什么变化
+				hinted := wechat.collectGroupHints(resp.AddMsgList)
+				if resp.ModChatRoomMemberCount > 0 || len(hinted) > 0 {
+					wechat.groupMemberDidChange(resp.ModChatRoomMemberList, hinted)
 				}
 				logger.Debugf(`server sync summary:
 					AddNewMessage(s)    : %d
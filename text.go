@@ -0,0 +1,82 @@
+package wechat
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	emojiSpanReg   = regexp.MustCompile(`<span class="emoji emoji([a-f0-9]+)"></span>`)
+	qqEmojiSpanReg = regexp.MustCompile(`<span class="qqemoji qqemoji([0-9]+)"></span>`)
+	lineBreakReg   = regexp.MustCompile(`<br\s*/?>`)
+)
+
+// qqFaces is the name of qq face by index, `[微笑]` is the text form of qqemoji0
+var qqFaces = []string{
+	`微笑`, `撇嘴`, `色`, `发呆`, `得意`, `流泪`, `害羞`, `闭嘴`, `睡`, `大哭`,
+	`尴尬`, `发怒`, `调皮`, `呲牙`, `惊讶`, `难过`, `酷`, `冷汗`, `抓狂`, `吐`,
+	`偷笑`, `愉快`, `白眼`, `傲慢`, `饥饿`, `困`, `惊恐`, `流汗`, `憨笑`, `悠闲`,
+	`奋斗`, `咒骂`, `疑问`, `嘘`, `晕`, `疯了`, `衰`, `骷髅`, `敲打`, `再见`,
+	`擦汗`, `抠鼻`, `鼓掌`, `糗大了`, `坏笑`, `左哼哼`, `右哼哼`, `哈欠`, `鄙视`, `委屈`,
+	`快哭了`, `阴险`, `亲亲`, `吓`, `可怜`, `菜刀`, `西瓜`, `啤酒`, `篮球`, `乒乓`,
+	`咖啡`, `饭`, `猪头`, `玫瑰`, `凋谢`, `嘴唇`, `爱心`, `心碎`, `蛋糕`, `闪电`,
+	`炸弹`, `刀`, `足球`, `瓢虫`, `便便`, `月亮`, `太阳`, `礼物`, `拥抱`, `强`,
+	`弱`, `握手`, `胜利`, `抱拳`, `勾引`, `拳头`, `差劲`, `爱你`, `NO`, `OK`,
+	`爱情`, `飞吻`, `跳跳`, `发抖`, `怄火`, `转圈`, `磕头`, `回头`, `跳绳`, `投降`,
+	`激动`, `乱舞`, `献吻`, `左太极`, `右太极`,
+}
+
+// normalizeText turn the html form wx server send to plain text:
+// emoji spans become code points, qqemoji spans become `[微笑]` codes,
+// `<br/>` become `\n` and html entities are unescaped.
+func normalizeText(raw string) string {
+
+	if !strings.ContainsAny(raw, `<&`) {
+		return raw
+	}
+
+	s := replaceEmoji(raw)
+	s = qqEmojiSpanReg.ReplaceAllStringFunc(s, func(span string) string {
+		idx, err := strconv.Atoi(qqEmojiSpanReg.FindStringSubmatch(span)[1])
+		if err != nil || idx >= len(qqFaces) {
+			return span
+		}
+		return `[` + qqFaces[idx] + `]`
+	})
+	s = lineBreakReg.ReplaceAllString(s, "\n")
+
+	return html.UnescapeString(s)
+}
+
+// ReplaceEmoji replace <span class="emoji emoji1f34e"></span> to 🍎,
+// flags and keycaps are made of more than one code point, e.g. emoji1f1e81f1f3.
+func replaceEmoji(oriStr string) string {
+
+	if !strings.Contains(oriStr, `<span class="emoji`) {
+		return oriStr
+	}
+
+	return emojiSpanReg.ReplaceAllStringFunc(oriStr, func(span string) string {
+		hex := emojiSpanReg.FindStringSubmatch(span)[1]
+		var runes []rune
+		for len(hex) > 0 {
+			// code points out of BMP are 5 hex digits, 1xxxx
+			n := 4
+			if hex[0] == '1' && len(hex) >= 5 {
+				n = 5
+			}
+			if n > len(hex) {
+				return span
+			}
+			cp, err := strconv.ParseUint(hex[:n], 16, 32)
+			if err != nil {
+				return span
+			}
+			runes = append(runes, rune(cp))
+			hex = hex[n:]
+		}
+		return string(runes)
+	})
+}
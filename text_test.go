@@ -0,0 +1,35 @@
+package wechat
+
+import "testing"
+
+func TestNormalizeText(t *testing.T) {
+	cases := []struct {
+		raw, want string
+	}{
+		{`plain 文本`, `plain 文本`},
+		{`<span class="emoji emoji1f604"></span>`, "\U0001f604"},
+		{`hi<span class="emoji emoji2764"></span>you`, "hi❤you"},
+		{`<span class="emoji emoji1f1e81f1f3"></span>`, "\U0001f1e8\U0001f1f3"}, // flag
+		{`<span class="emoji emoji002320e3"></span>`, "#⃣"},                     // keycap
+		{`<span class="emoji emoji1f6"></span>`, `<span class="emoji emoji1f6"></span>`},
+		{`<span class="qqemoji qqemoji0"></span>好`, `[微笑]好`},
+		{`<span class="qqemoji qqemoji999"></span>`, `<span class="qqemoji qqemoji999"></span>`},
+		{`a&amp;b&lt;c&gt; &quot;d&quot; &#39;e&#39;`, `a&b<c> "d" 'e'`},
+		{`one<br/>two<br>three<br />four`, "one\ntwo\nthree\nfour"},
+		// 用户打出来的 span 是转义过的, 不是表情
+		{`&lt;span class="emoji emoji1f604"&gt;&lt;/span&gt;`, `<span class="emoji emoji1f604"></span>`},
+		{`&lt;br/&gt;`, `<br/>`},
+	}
+	for _, c := range cases {
+		if got := normalizeText(c.raw); got != c.want {
+			t.Errorf(`normalizeText(%q) = %q, want %q`, c.raw, got, c.want)
+		}
+	}
+}
+
+func TestReplaceEmojiKeepsText(t *testing.T) {
+	raw := `a &amp; <span class="emoji emoji1f34e"></span><span class="emoji emoji1f34e"></span>`
+	if got := replaceEmoji(raw); got != "a &amp; \U0001f34e\U0001f34e" {
+		t.Errorf(`replaceEmoji = %q`, got)
+	}
+}
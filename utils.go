@@ -6,7 +6,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -33,26 +32,6 @@ func search(source, prefix, suffix string) (string, error) {
 	return result, nil
 }
 
-// ReplaceEmoji replace <span class="emoji emoji[a-f0-9]{5}"></span> to 🍎
-func replaceEmoji(oriStr string) string {
-
-	newStr := oriStr
-
-	if strings.Contains(oriStr, `<span class="emoji`) {
-		reg, _ := regexp.Compile(`<span class="emoji emoji[a-f0-9]{5}"></span>`)
-		newStr = reg.ReplaceAllStringFunc(oriStr, func(arg2 string) string {
-			num := `'\U000` + arg2[len(arg2)-14:len(arg2)-9] + `'`
-			emoji, err := strconv.Unquote(num)
-			if err == nil {
-				return emoji
-			}
-			return num
-		})
-	}
-
-	return newStr
-}
-
 // CreateFile save data to filesystem.
 func createFile(name string, data []byte, isAppend bool) (err error) {
 
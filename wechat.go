@@ -2,6 +2,7 @@ package wechat
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
@@ -58,7 +59,17 @@ func (response *Response) IsSuccess() bool {
 
 // response's error msg.
 func (response *Response) Error() error {
-	return fmt.Errorf("error message:[%s]", response.BaseResponse.ErrMsg)
+	return &ResponseError{response.BaseResponse.Ret, response.BaseResponse.ErrMsg}
+}
+
+// ResponseError is returned when BaseResponse.Ret is not 0.
+type ResponseError struct {
+	Ret    int
+	ErrMsg string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("error message:[%s] ret:[%d]", e.ErrMsg, e.Ret)
 }
 
 // BaseResponse for all api resp.
@@ -69,27 +80,64 @@ type BaseResponse struct {
 
 // Configure ...
 type Configure struct {
-	Processor         UUIDProcessor
-	Debug             bool
-	CachePath         string
-	UniqueGroupMember bool
-	version           string
+	Processor              UUIDProcessor
+	Debug                  bool
+	CachePath              string
+	UniqueGroupMember      bool
+	PrefetchMedia          []int64       // MsgType of media downloaded on arrival, e.g. 3 image, 34 voice
+	MediaCacheSize         int64         // max bytes of cached media, least recently read are evicted first, 0 means no limit
+	MediaCacheAge          time.Duration // cached media not read for this long will be evicted, 0 means never
+	SendRate               float64       // messages per second for all recipients, 0 means no limit
+	SendBurst              int
+	SendRatePerUser        float64 // messages per second for one recipient, 0 means no limit
+	SendBurstPerUser       int
+	SendRetryTimes         int          // retry times of a retryable failure
+	SendBacklog            bool         // persist unsent messages, they are sent after restart
+	MemberFetchConcurrency int          // concurrent webwxbatchgetcontact requests when loading group members
+	MemberFetchRetryTimes  int          // retry times of a failed batch
+	PreloadMembers         bool         // load member details of all groups in background, recent active groups first
+	Archive                bool         // record all inbound and outbound messages, see WeChat.Archive
+	ArchiveStore           ArchiveStore // storage of archive, a log file in CachePath if nil
+	LocationMsg            bool         // allow messages.LocationMsg, which is not verified against wx server
+	version                string
 }
 
 // DefaultConfigure create default configuration
 func DefaultConfigure() *Configure {
 	return &Configure{
-		Processor:         new(defaultUUIDProcessor),
-		Debug:             true,
-		UniqueGroupMember: true,
-		CachePath:         `.wechat/debug`,
-		version:           `1.0.1-rc1`,
+		Processor:              new(defaultUUIDProcessor),
+		Debug:                  true,
+		UniqueGroupMember:      true,
+		CachePath:              `.wechat/debug`,
+		MediaCacheSize:         512 * 1024 * 1024,
+		MediaCacheAge:          7 * 24 * time.Hour,
+		SendRate:               1,
+		SendBurst:              5,
+		SendRatePerUser:        0.5,
+		SendBurstPerUser:       3,
+		SendRetryTimes:         3,
+		MemberFetchConcurrency: 4,
+		MemberFetchRetryTimes:  3,
+		PreloadMembers:         true,
+		version:                `1.0.1-rc1`,
 	}
 }
 
 func (c *Configure) contactCachePath() string {
 	return filepath.Join(c.CachePath, `contact-cache.json`)
 }
+func (c *Configure) mediaCachePath() string {
+	return filepath.Join(c.CachePath, `media`)
+}
+func (c *Configure) avatarCachePath() string {
+	return filepath.Join(c.CachePath, `avatars`)
+}
+func (c *Configure) archivePath() string {
+	return filepath.Join(c.CachePath, `archive.log`)
+}
+func (c *Configure) sendBacklogPath() string {
+	return filepath.Join(c.CachePath, `send-backlog.json`)
+}
 func (c *Configure) baseInfoCachePath() string {
 	return filepath.Join(c.CachePath, `basic-info-cache.json`)
 }
@@ -109,15 +157,25 @@ type WeChat struct {
 	BaseURL     string
 	BaseRequest *BaseRequest
 	MySelf      Contact
-	IsLogin     bool
-
-	conf       *Configure
-	evtStream  *evtStream
-	cache      *cache
-	syncKey    map[string]interface{}
-	syncHost   string
-	retryTimes time.Duration
-	loginState chan int // -1 登录失败 1登录成功
+	IsLogin     bool // use LoggedIn() in other goroutines
+
+	conf         *Configure
+	evtStream    *evtStream
+	cache        *cache
+	uploaded     uploadedMedia
+	mediaCache   *mediaCache
+	sendQueue    *sendQueue
+	identities   identities
+	groupHints   groupHints
+	groupLocks   groupLocks
+	memberLoader *memberLoader
+	avatars      *avatarCache
+	archive      *Archive
+	syncKey      map[string]interface{}
+	syncHost     string
+	retryTimes   time.Duration
+	loginState   chan int // -1 登录失败 1登录成功
+	loggedIn     int32    // atomic, 1 if logged in
 }
 
 // NewWeChat is designed for Create a new Wechat instance.
@@ -144,14 +202,29 @@ func newWeChat(conf *Configure) (*WeChat, error) {
 	baseReq.DeviceID = `e999471493880231`
 
 	wechat := &WeChat{
-		Client:      client,
-		BaseRequest: baseReq,
-		evtStream:   newEvtStream(),
-		IsLogin:     false,
-		retryTimes:  time.Duration(0),
-		loginState:  make(chan int),
-		conf:        conf,
-		cache:       newCache(),
+		Client:       client,
+		BaseRequest:  baseReq,
+		evtStream:    newEvtStream(),
+		IsLogin:      false,
+		retryTimes:   time.Duration(0),
+		loginState:   make(chan int),
+		conf:         conf,
+		cache:        newCache(),
+		mediaCache:   newMediaCache(conf.mediaCachePath(), conf.MediaCacheSize, conf.MediaCacheAge),
+		sendQueue:    newSendQueue(conf),
+		memberLoader: newMemberLoader(),
+		avatars:      newAvatarCache(conf.avatarCachePath()),
+	}
+
+	if conf.Archive {
+		if wechat.archive, err = newArchive(conf); err != nil {
+			return nil, err
+		}
+	}
+
+	// 先用上次缓存的通讯录，登录后再和服务器同步
+	if err = wechat.cache.load(conf.contactCachePath()); err == nil {
+		logger.Infof(`loaded %d contact(s) from cache`, len(wechat.cache.contacts))
 	}
 
 	return wechat, nil
@@ -212,6 +285,11 @@ func NewBot(conf *Configure) (*WeChat, error) {
 	}()
 
 	wechat.keepAlive()
+	go wechat.runSendQueue()
+	go wechat.runCacheSaver()
+	if conf.PreloadMembers {
+		go wechat.runMemberLoader()
+	}
 
 	if conf.Debug {
 		log.SetLevel(log.DebugLevel)
@@ -268,6 +346,11 @@ func (wechat *WeChat) ExecuteRequest(req *http.Request, call Caller) error {
 
 // Execute a http request by default http client.
 func (wechat *WeChat) Execute(path string, body io.Reader, call Caller) error {
+	return wechat.ExecuteContext(context.Background(), path, body, call)
+}
+
+// ExecuteContext is Execute with a context, request will be canceled when ctx is done.
+func (wechat *WeChat) ExecuteContext(ctx context.Context, path string, body io.Reader, call Caller) error {
 	method := "GET"
 	if body != nil {
 		method = "POST"
@@ -276,6 +359,7 @@ func (wechat *WeChat) Execute(path string, body io.Reader, call Caller) error {
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
 
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	req.Header.Set(`User-Agent`, `Mozilla/5.0 (Macintosh; Intel Mac OS X 10_12_2) AppleWebKit/602.3.12 (KHTML, like Gecko) Version/10.0.2 Safari/602.3.12`)
@@ -0,0 +1,34 @@
+package wechat
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// newServerTestBot returns a bot talking to a fake wx server, done stops
+// the server and removes the cache dir.
+func newServerTestBot(t *testing.T, handler http.Handler) (*WeChat, func()) {
+
+	dir, err := ioutil.TempDir(``, `wechat`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+
+	wechat := &WeChat{
+		BaseURL:      server.URL,
+		BaseRequest:  &BaseRequest{Skey: `skey`},
+		Client:       server.Client(),
+		conf:         &Configure{CachePath: dir, MemberFetchConcurrency: 1},
+		cache:        newCache(),
+		evtStream:    newEvtStream(),
+		memberLoader: newMemberLoader(),
+	}
+	return wechat, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}